@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+var gCANDLE_LEN = 48
+
+// FstCandle 派生序列symbol@interval里的一根K线, Start就是序列的Timestamp
+type FstCandle struct {
+	Start  int64
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+	Count  int64
+}
+
+// FstTickDecoder 从tick的Data解出价格和成交量
+type FstTickDecoder func(data []byte) (price, volume float64)
+
+// FstCandleConf Intervals形如1s/1m/1h/1d, Unit是Timestamp的单位(默认毫秒)
+type FstCandleConf struct {
+	Intervals []string
+	Unit      time.Duration
+	Decode    FstTickDecoder
+}
+
+// DecodeTickLE 前8字节是价格, 后8字节是成交量, 都是小端float64
+func DecodeTickLE(data []byte) (float64, float64) {
+	if len(data) < 16 {
+		return DecodeFloat64LE(data), 0
+	}
+	return DecodeFloat64LE(data), DecodeFloat64LE(data[8:])
+}
+
+func EncodeCandle(c *FstCandle) []byte {
+	buf := make([]byte, gCANDLE_LEN)
+	lwd := binary.LittleEndian
+	lwd.PutUint64(buf, math.Float64bits(c.Open))
+	lwd.PutUint64(buf[8:], math.Float64bits(c.High))
+	lwd.PutUint64(buf[16:], math.Float64bits(c.Low))
+	lwd.PutUint64(buf[24:], math.Float64bits(c.Close))
+	lwd.PutUint64(buf[32:], math.Float64bits(c.Volume))
+	lwd.PutUint64(buf[40:], uint64(c.Count))
+	return buf
+}
+
+func DecodeCandle(value *FstTsdbValue) (*FstCandle, error) {
+	if len(value.Data) < gCANDLE_LEN {
+		return nil, fmt.Errorf("%w: candle length=%d", ErrCorrupt, len(value.Data))
+	}
+	lwd := binary.LittleEndian
+	data := value.Data
+	return &FstCandle{
+		Start:  value.Timestamp,
+		Open:   math.Float64frombits(lwd.Uint64(data)),
+		High:   math.Float64frombits(lwd.Uint64(data[8:])),
+		Low:    math.Float64frombits(lwd.Uint64(data[16:])),
+		Close:  math.Float64frombits(lwd.Uint64(data[24:])),
+		Volume: math.Float64frombits(lwd.Uint64(data[32:])),
+		Count:  int64(lwd.Uint64(data[40:])),
+	}, nil
+}
+
+// CandleSymbol K线派生序列的名字, 如btc_usd@1m
+func CandleSymbol(symbol, interval string) string {
+	return symbol + "@" + interval
+}
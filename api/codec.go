@@ -0,0 +1,24 @@
+package api
+
+// leaf block的压缩算法, id写在block头里, 0表示不压缩
+const (
+	CODEC_NONE  = "none"
+	CODEC_FLATE = "flate"
+)
+
+// 预留的id, 外部实现的snappy/zstd/lz4用这些id注册, 不同部署之间读写一致
+const (
+	CODEC_ID_NONE   = uint8(0)
+	CODEC_ID_FLATE  = uint8(1)
+	CODEC_ID_SNAPPY = uint8(2)
+	CODEC_ID_ZSTD   = uint8(3)
+	CODEC_ID_LZ4    = uint8(4)
+)
+
+// FstCodec Encode/Decode把结果追加到dst后返回, Decode知道解压后的长度
+type FstCodec interface {
+	Id() uint8
+	Name() string
+	Encode(dst, src []byte) ([]byte, error)
+	Decode(dst, src []byte) ([]byte, error)
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// DecodeFloat64LE 小端float64, 不足8字节按0补齐
+func DecodeFloat64LE(data []byte) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(pad8(data)))
+}
+
+// DecodeInt64LE 小端int64, 不足8字节按0补齐
+func DecodeInt64LE(data []byte) float64 {
+	return float64(int64(binary.LittleEndian.Uint64(pad8(data))))
+}
+
+func pad8(data []byte) []byte {
+	if len(data) >= 8 {
+		return data
+	}
+	buf := make([]byte, 8)
+	copy(buf, data)
+	return buf
+}
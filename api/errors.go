@@ -0,0 +1,43 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrOutOfOrder         = errors.New("out of order")
+	ErrDuplicateTimestamp = errors.New("duplicate timestamp")
+	ErrValueTooLarge      = errors.New("value too large")
+	ErrEmptyValue         = errors.New("empty value")
+	ErrEmpty              = errors.New("EMPTY")
+	ErrInvalidCursor      = errors.New("invalid cursor")
+	ErrBusy               = errors.New("busy")
+	ErrSeriesType         = errors.New("series type mismatch")
+	// ErrFormat 数据目录的格式和当前版本不兼容, 需要先迁移
+	ErrFormat = errors.New("incompatible data format")
+	// ErrCorrupt 校验和不对, 具体位置见CorruptError
+	ErrCorrupt = errors.New("corrupt")
+	// ErrEOF 与io.EOF相同, FastStoreCall.Read可以直接当io.Reader用
+	ErrEOF = io.EOF
+)
+
+// CorruptError 读到的block或日志帧校验失败; errors.Is(err, ErrCorrupt)为true
+type CorruptError struct {
+	Table   string
+	Type    string // ridx/idx/leaf, 日志为log
+	Segment uint32 // 日志为文件序号
+	Offset  int64
+	Reason  string
+	// Tail 日志最后一个文件末尾没写完的帧, 崩溃之后正常出现, 前面的帧都是完整的
+	Tail bool
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("corrupt table=%s, %s seg=%d, off=%d: %s", e.Table, e.Type, e.Segment, e.Offset, e.Reason)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return ErrCorrupt
+}
@@ -4,26 +4,151 @@ import "container/list"
 
 var DEF_LIMIT = 1000
 
+// 持久化策略
+const (
+	DURABILITY_NONE     = "none"
+	DURABILITY_BLOCK    = "block"
+	DURABILITY_INTERVAL = "interval"
+	DURABILITY_APPEND   = "append"
+)
+
+// seg文件的读方式
+const (
+	READ_PREAD = "pread"
+	READ_MMAP  = "mmap"
+)
+
+// 聚合函数
+const (
+	AGG_COUNT = "count"
+	AGG_SUM   = "sum"
+	AGG_MIN   = "min"
+	AGG_MAX   = "max"
+	AGG_AVG   = "avg"
+	AGG_FIRST = "first"
+	AGG_LAST  = "last"
+)
+
+// rollup的数值解码
+const (
+	DECODER_FLOAT64 = "float64"
+	DECODER_INT64   = "int64"
+)
+
 type FstTsdbValue struct {
 	Timestamp int64
 	Data      []byte
 }
 
+// RollupConf Step为raw或1m/1h这样的周期, Keep为空时永久保留
+type RollupConf struct {
+	Step string `yaml:"step"`
+	Keep string `yaml:"keep"`
+}
+
+type TableConf struct {
+	Durability   string            `yaml:"durability"`
+	SyncMs       int               `yaml:"sync_ms"`
+	Rollups      []RollupConf      `yaml:"rollups"`
+	Decoder      string            `yaml:"decoder"`
+	TimeUnit     string            `yaml:"time_unit"`
+	Ttl          string            `yaml:"ttl"`
+	SymbolTtl    map[string]string `yaml:"symbol_ttl"`
+	CompactRatio float64           `yaml:"compact_ratio"` // leaf block不连续的比例超过它时后台compact
+	Codec        string            `yaml:"codec"`         // 写满的leaf block的压缩算法
+	// block和segment的字节数, 0为默认值; 建表时记进表里, 之后和记录的不一致时打不开
+	RidxBlock   int `yaml:"ridx_block"`
+	IdxBlock    int `yaml:"idx_block"`
+	LeafBlock   int `yaml:"leaf_block"` // 放不进leaf block的数据写到单独的ovf block
+	SegmentSize int `yaml:"segment_size"`
+}
+
 type TsdbConf struct {
-	Level      string `yaml:"level"`
-	File       string `yaml:"log_file"`
-	MaxSize    int    `yaml:"max_size"`
-	MaxBackups int    `yaml:"max_backups"`
-	MaxAge     int    `yaml:"max_age"`
-	Env        string `yaml:"env"`
-	DataDir    string `yaml:"data"`
+	Level      string               `yaml:"level"`
+	File       string               `yaml:"log_file"`
+	MaxSize    int                  `yaml:"max_size"`
+	MaxBackups int                  `yaml:"max_backups"`
+	MaxAge     int                  `yaml:"max_age"`
+	Env        string               `yaml:"env"`
+	DataDir    string               `yaml:"data"`
+	OutOfOrder bool                 `yaml:"out_of_order"`
+	Durability string               `yaml:"durability"`
+	SyncMs     int                  `yaml:"sync_ms"`
+	Tables     map[string]TableConf `yaml:"tables"`
+	RollupMs   int                  `yaml:"rollup_ms"`
+	CacheMB    int                  `yaml:"cache_mb"` // 解码后block的LRU缓存, 0为默认64MB, 负数关闭
+	// 同时打开的seg文件数, 0为默认256
+	MaxOpenFiles int `yaml:"max_open_files"`
+	// 封口的segment用mmap读, 为空时pread, 不支持mmap的平台也退回pread
+	ReadMode string `yaml:"read_mode"`
+}
+
+type FstStats struct {
+	SyncCount   int64
+	SyncNanos   int64
+	CacheHits   int64
+	CacheMisses int64
+	CacheBytes  int64
+}
+
+// FstTsdbPage Cursor为空表示没有下一页, 否则原样传给下一次GetPage
+type FstTsdbPage struct {
+	Values []FstTsdbValue
+	Cursor string
+}
+
+// FstTsdbBucket Start按step对齐, 只返回有数据的bucket
+type FstTsdbBucket struct {
+	Start int64
+	Count int64
+	Value float64
+}
+
+type FstFloatPoint struct {
+	Timestamp int64
+	Value     float64
+}
+
+type FstIntPoint struct {
+	Timestamp int64
+	Value     int64
+}
+
+// FstDecoder 把存储的Data解码成数值
+type FstDecoder func(data []byte) float64
+
+// FstTsdbIter 按时间戳[low, high]遍历, Next返回false后检查Err
+type FstTsdbIter interface {
+	Next() bool
+	Value() *FstTsdbValue
+	Err() error
+	Close()
 }
 
 type FstTsdbCall interface {
 	Symbol() string
 	Append(value *FstTsdbValue) error
+	AppendBatch(values []FstTsdbValue) error
 	GetLastN(key int64, limit int) (*list.List, error)
 	GetBetween(low, high int64, off int) (*list.List, error)
+	GetPage(low, high int64, cursor string, limit int) (*FstTsdbPage, error)
+	Range(low, high int64) FstTsdbIter
+	Aggregate(low, high, step int64, fn string, decode FstDecoder) ([]FstTsdbBucket, error)
+	// DeleteBefore 删除时间戳小于ts的数据
+	DeleteBefore(ts int64) error
+	RangeReverse(low, high int64) FstTsdbIter
+	// RangeNoCopy/RangeReverseNoCopy 同Range/RangeReverse, 但Value().Data直接引用读到的block,
+	// 下一次Next或者Close之后失效, 要保留时自己复制
+	RangeNoCopy(low, high int64) FstTsdbIter
+	RangeReverseNoCopy(low, high int64) FstTsdbIter
+	// Scan 按时间戳正序回调[low, high]的数据, data只在回调里有效; 回调返回错误时停止并返回该错误
+	Scan(low, high int64, call func(ts int64, data []byte) error) error
+	// AppendFloat/AppendInt 写数值序列, 第一次写入决定序列类型, 按Gorilla编码成chunk存放;
+	// 通用接口读到的Data是8字节小端的float64或int64
+	AppendFloat(ts int64, v float64) error
+	AppendInt(ts int64, v int64) error
+	GetFloats(low, high int64, limit int) ([]FstFloatPoint, error)
+	GetInts(low, high int64, limit int) ([]FstIntPoint, error)
 	Close()
 }
 
@@ -40,3 +165,13 @@ type FastStoreCall interface {
 	Read(data []byte) (int, error)
 	Close()
 }
+
+// FstCheckReport 空闲表和数据链的一致性检查结果, 都按block计数
+type FstCheckReport struct {
+	Live     int64 // 被symbol或object引用
+	Free     int64 // 在空闲表里
+	Leaked   int64 // 既没有被引用也不在空闲表里
+	Conflict int64 // 被引用却在空闲表里
+	Missing  int64 // 被引用但segment文件已经删除
+	Repaired bool
+}
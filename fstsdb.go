@@ -9,6 +9,11 @@ import (
 var conf *api.TsdbConf
 var version string = "v1.0.3"
 
+// FsRegisterCodec 注册外部实现的压缩算法, 要在Start之前调用
+func FsRegisterCodec(c api.FstCodec) error {
+	return impl.RegisterCodec(c)
+}
+
 func Start(c *api.TsdbConf) error {
 	conf = c
 	common.InitLogger(c)
@@ -30,6 +35,39 @@ func FsTsdbLogGet(table string) api.FstLogger {
 	return impl.NewLogger(conf.DataDir, table)
 }
 
+func FsObjGet(table, key string) api.FastStoreCall {
+	return impl.NewObject(conf.DataDir, table, key)
+}
+
+func GetStats() api.FstStats {
+	return impl.GetStats()
+}
+
 func GetVersion() string {
 	return version
 }
+
+// FsCandleEnable 之后table里的tick序列写入时同时生成symbol@interval的K线
+func FsCandleEnable(table string, c *api.FstCandleConf) error {
+	return impl.EnableCandles(table, c)
+}
+
+func FsCandleBackfill(table, symbol string, low, high int64) error {
+	return impl.BackfillCandles(conf.DataDir, table, symbol, low, high)
+}
+
+// FsCheck 检查table的空闲表和数据链是否一致, repair时修复
+func FsCheck(table string, repair bool) (*api.FstCheckReport, error) {
+	return impl.CheckTable(conf.DataDir, table, repair)
+}
+
+// FsCompact 把symbol的数据重写到连续的block里, 写句柄的数据先落盘, 正在compact时返回ErrBusy
+func FsCompact(table, symbol string) error {
+	return impl.CompactSymbol(conf.DataDir, table, symbol)
+}
+
+// FsMigrate 离线把c.DataDir升级到当前的数据格式, dst为空时原地升级; 要在Start之前或Stop之后调用
+func FsMigrate(c *api.TsdbConf, dst string) error {
+	common.InitLogger(c)
+	return impl.MigrateDir(c, dst)
+}
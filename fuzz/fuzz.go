@@ -42,6 +42,31 @@ func testWr() {
 	call.Close()
 }
 
+func testBatch() {
+	now := gNow
+	data := []byte("Hello world")
+	call := faststore.FsTsdbGet("crpto", "btc_usd")
+	batch := make([]api.FstTsdbValue, 0, 10000)
+	for times := int64(0); times <= gYiyi; times += 1 {
+		batch = append(batch, api.FstTsdbValue{Timestamp: now + times, Data: data})
+		if len(batch) < cap(batch) {
+			continue
+		}
+		if err := call.AppendBatch(batch); err != nil {
+			log.Printf("AppendBatch key=%d, err:%s", batch[0].Timestamp, err)
+			break
+		}
+		batch = batch[:0]
+		if (times % baiWan) == 0 {
+			log.Printf("times:%d", times)
+		}
+	}
+	if err := call.AppendBatch(batch); err != nil {
+		log.Printf("AppendBatch err:%s", err)
+	}
+	call.Close()
+}
+
 func testSingle() {
 	call := faststore.FsTsdbGet("crpto", "btc_usd")
 	end := gNow + 10000
@@ -89,6 +114,37 @@ func testGetRange() {
 	call.Close()
 }
 
+func testIter() {
+	call := faststore.FsTsdbGet("crpto", "btc_usd")
+	low := gNow + 1000
+	high := gNow + gYiyi
+	it := call.Range(low, high)
+	next := low
+	for it.Next() {
+		v := it.Value()
+		if v.Timestamp != next {
+			log.Printf("Range: %d != %d", v.Timestamp, next)
+			break
+		}
+		next++
+	}
+	if it.Err() != nil {
+		log.Printf("Range error:%s", it.Err())
+	}
+	it.Close()
+	rit := call.RangeReverse(low, high)
+	for rit.Next() {
+		next--
+		if rit.Value().Timestamp != next {
+			log.Printf("RangeReverse: %d != %d", rit.Value().Timestamp, next)
+			break
+		}
+	}
+	rit.Close()
+	log.Printf("Range low=%d, next=%d", low, next)
+	call.Close()
+}
+
 func testMGet() {
 	call := faststore.FsTsdbGet("crpto", "btc_usd")
 	low := gNow + 1000
@@ -218,13 +274,80 @@ func testLg() {
 	log.Printf("number := %d, off:=%d", number, off)
 }
 
+func testLate() {
+	call := faststore.FsTsdbGet("crpto", "eth_usd")
+	data := []byte("Hello world")
+	fval := api.FstTsdbValue{Timestamp: gNow, Data: data}
+	for times := int64(0); times < baiWan; times += 2 {
+		fval.Timestamp = gNow + times
+		if err := call.Append(&fval); err != nil {
+			log.Printf("Append key=%d, err:%s", fval.Timestamp, err)
+			return
+		}
+	}
+	for times := int64(1); times < baiWan; times += 2 {
+		fval.Timestamp = gNow + times
+		if err := call.Append(&fval); err != nil {
+			log.Printf("Append late key=%d, err:%s", fval.Timestamp, err)
+			return
+		}
+	}
+	call.Close()
+	call = faststore.FsTsdbGet("crpto", "eth_usd")
+	items, err := call.GetLastN(gNow+baiWan-1, 1000)
+	if err != nil {
+		log.Printf("GetLastN err:%s", err)
+		return
+	}
+	first := items.Front().Value.(*api.FstTsdbValue)
+	tail := items.Back().Value.(*api.FstTsdbValue)
+	if (tail.Timestamp - first.Timestamp + 1) != 1000 {
+		log.Printf("GetLastN range error:%d - %d != 1000", tail.Timestamp, first.Timestamp)
+	}
+	call.Close()
+}
+
+func testObj() {
+	call := faststore.FsObjGet("crpto", "btc_usd.snapshot")
+	data := bytes.Repeat([]byte("Hello world"), 10000)
+	err := call.Save(data)
+	if err != nil {
+		log.Printf("Save error:%s", err)
+		return
+	}
+	err = call.Append(data)
+	if err != nil {
+		log.Printf("Append error:%s", err)
+		return
+	}
+	call.Close()
+	call = faststore.FsObjGet("crpto", "btc_usd.snapshot")
+	out := bytes.NewBuffer(nil)
+	buf := make([]byte, 4096)
+	for {
+		n, err := call.Read(buf)
+		if err != nil {
+			break
+		}
+		out.Write(buf[0:n])
+	}
+	call.Close()
+	if out.Len() != 2*len(data) || !bytes.Equal(out.Bytes()[len(data):], data) {
+		log.Printf("Read error: %d != %d", out.Len(), 2*len(data))
+		return
+	}
+	log.Printf("object len:%d", out.Len())
+}
+
 func main() {
-	conf := api.TsdbConf{Level: "info", File: "../log/tao.log", MaxSize: 50, MaxBackups: 10, MaxAge: 1, Env: "dev", DataDir: "../data/fstore"}
+	conf := api.TsdbConf{Level: "info", File: "../log/tao.log", MaxSize: 50, MaxBackups: 10, MaxAge: 1, Env: "dev", DataDir: "../data/fstore", OutOfOrder: true}
 	faststore.Start(&conf)
 	c := 'l'
 	switch c {
 	case 'w':
 		testWr()
+	case 'b':
+		testBatch()
 	case 'g':
 		testGn()
 	case 's':
@@ -235,6 +358,12 @@ func main() {
 		testMGet()
 	case 'l':
 		testLg()
+	case 'o':
+		testObj()
+	case 'i':
+		testIter()
+	case 't':
+		testLate()
 	}
 	faststore.Stop()
 }
@@ -2,10 +2,14 @@ module github.com/tao/faststore
 
 go 1.20
 
-require go.uber.org/zap v1.26.0
+require (
+	go.etcd.io/bbolt v1.3.9
+	go.uber.org/zap v1.26.0
+)
 
 require (
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
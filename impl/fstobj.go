@@ -0,0 +1,298 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+var gObj_Fmt = "fobj.%s"
+
+func (obj *fstObjImpl) Key() string {
+	return obj.key
+}
+
+// Save 覆盖写: 新的值总是写到新的block, ref落盘后整条旧链等读结束再回收
+func (obj *fstObjImpl) Save(data []byte) error {
+	k := obj.getKey()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	old := &ObjRef{}
+	err := getTsData(obj.table, obj.refKey(), old)
+	if err != nil && !errors.Is(err, api.ErrEmpty) {
+		return err
+	}
+	exists := err == nil
+	obj.resetRead()
+	if err = obj.newHead(); err != nil {
+		return err
+	}
+	alloced := []*BlockAddr{{SegNo: obj.ref.Head.SegNo, SegOffset: obj.ref.Head.SegOffset}}
+	if err = obj.write(data, &alloced); err != nil {
+		obj.tail, obj.ref = nil, nil
+		return errors.Join(err, freeBlocks(obj.dataDir, obj.table, map[string][]*BlockAddr{gData_VAL: alloced}))
+	}
+	if !exists {
+		return nil
+	}
+	addrs, err := objChain(obj.dataDir, obj.table, old.Head)
+	if err != nil {
+		return err
+	}
+	return retireBlocks(obj.dataDir, obj.table, map[string][]*BlockAddr{gData_VAL: addrs})
+}
+
+// objChain 从addr开始沿Next收集对象的block
+func objChain(dir, table string, addr BlockAddr) ([]*BlockAddr, error) {
+	addrs := make([]*BlockAddr, 0)
+	blk := &Block{}
+	for addr.SegNo != 0 {
+		cur := addr
+		addrs = append(addrs, &cur)
+		if err := loadBlock(&cur, dir, table, gData_VAL, blk); err != nil {
+			return nil, err
+		}
+		addr = blk.BH.Next
+	}
+	return addrs, nil
+}
+
+// Append 接在尾block后面写, 尾block在原地改写, 读的时候要持有读锁
+func (obj *fstObjImpl) Append(data []byte) error {
+	k := obj.getKey()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	fresh, err := obj.getTail()
+	if err != nil {
+		return err
+	}
+	alloced := make([]*BlockAddr, 0)
+	if fresh {
+		alloced = append(alloced, &BlockAddr{SegNo: obj.ref.Head.SegNo, SegOffset: obj.ref.Head.SegOffset})
+	}
+	if err = obj.write(data, &alloced); err != nil {
+		obj.tail, obj.ref = nil, nil
+		if fresh {
+			// 新对象的ref还没落盘, 分配的block都没有被引用
+			err = errors.Join(err, freeBlocks(obj.dataDir, obj.table, map[string][]*BlockAddr{gData_VAL: alloced}))
+		}
+		return err
+	}
+	return nil
+}
+
+// Read 第一次读时pin住table并取ref, 读完或者Close之前旧链不会被回收
+func (obj *fstObjImpl) Read(data []byte) (int, error) {
+	k := obj.getKey()
+	if obj.rdBlk == nil {
+		obj.epoch = pinTable(obj.table)
+		obj.pinned = true
+		ref := &ObjRef{}
+		k.lock.RLock()
+		err := getTsData(obj.table, obj.refKey(), ref)
+		if err == nil {
+			err = obj.toBlock(&ref.Head)
+		}
+		k.lock.RUnlock()
+		if err != nil {
+			obj.resetRead()
+			if errors.Is(err, api.ErrEmpty) {
+				return 0, api.ErrEmpty
+			}
+			return 0, err
+		}
+	}
+	n := uint32(0)
+	dLen := uint32(len(data))
+	for n < dLen {
+		if obj.rdOff >= obj.rdBlk.BH.Len {
+			next := obj.rdBlk.BH.Next
+			if next.SegNo == 0 {
+				break
+			}
+			k.lock.RLock()
+			err := obj.toBlock(&next)
+			k.lock.RUnlock()
+			if err != nil {
+				return int(n), err
+			}
+			continue
+		}
+		left := obj.rdBlk.BH.Len - obj.rdOff
+		if left > (dLen - n) {
+			left = dLen - n
+		}
+		bcopy(data, obj.rdBlk.Data, n, obj.rdOff, left)
+		obj.rdOff += left
+		n += left
+	}
+	if n == 0 && dLen > 0 {
+		obj.unpin()
+		return 0, api.ErrEOF
+	}
+	return int(n), nil
+}
+
+func (obj *fstObjImpl) Close() {
+	obj.resetRead()
+	obj.tail = nil
+	obj.ref = nil
+	if obj.lock != nil {
+		obj.lock.unref()
+		obj.lock = nil
+	}
+}
+
+// write alloced记下新分配的block, 失败时由调用者决定是否回收
+func (obj *fstObjImpl) write(data []byte, alloced *[]*BlockAddr) error {
+	blkCap := tableLayout(obj.table).ObjSize - gBH_LEN
+	tailAddr := &BlockAddr{SegNo: obj.ref.Tail.SegNo, SegOffset: obj.ref.Tail.SegOffset}
+	dOff := uint32(0)
+	dLen := uint32(len(data))
+	for dOff < dLen {
+		room := blkCap - obj.tail.BH.Len
+		if room == 0 {
+			newRef, err := alloc(obj.dataDir, obj.table, gData_VAL)
+			if err != nil {
+				return err
+			}
+			*alloced = append(*alloced, newRef)
+			obj.tail.BH.Next.SegNo = newRef.SegNo
+			obj.tail.BH.Next.SegOffset = newRef.SegOffset
+			err = saveBlock(tailAddr, obj.dataDir, obj.table, gData_VAL, obj.tail)
+			if err != nil {
+				return err
+			}
+			blk := &Block{BH: BlockHeader{}, Data: make([]byte, blkCap)}
+			blk.BH.Pre.SegNo = tailAddr.SegNo
+			blk.BH.Pre.SegOffset = tailAddr.SegOffset
+			obj.tail = blk
+			tailAddr = newRef
+			obj.ref.Tail.SegNo = newRef.SegNo
+			obj.ref.Tail.SegOffset = newRef.SegOffset
+			continue
+		}
+		if room > (dLen - dOff) {
+			room = dLen - dOff
+		}
+		bcopy(obj.tail.Data, data, obj.tail.BH.Len, dOff, room)
+		obj.tail.BH.Len += room
+		obj.ref.Size += uint64(room)
+		dOff += room
+	}
+	err := saveBlock(tailAddr, obj.dataDir, obj.table, gData_VAL, obj.tail)
+	if err != nil {
+		return err
+	}
+	err = saveTsData(obj.table, obj.refKey(), obj.ref)
+	if err != nil {
+		common.Logger.Infof("save object ref table=%s,key=%s failed:%s", obj.table, obj.key, err)
+		return err
+	}
+	return nil
+}
+
+func (obj *fstObjImpl) refKey() string {
+	return fmt.Sprintf(gObj_Fmt, obj.key)
+}
+
+// getTail 别的句柄可能写过, 每次写之前重新取ref和尾block; 还没有这个对象时分配第一块, fresh为true
+func (obj *fstObjImpl) getTail() (bool, error) {
+	obj.ref = &ObjRef{}
+	err := getTsData(obj.table, obj.refKey(), obj.ref)
+	if errors.Is(err, api.ErrEmpty) {
+		return true, obj.newHead()
+	}
+	if err != nil {
+		obj.ref = nil
+		return false, err
+	}
+	blk := &Block{}
+	err = loadBlock(&obj.ref.Tail, obj.dataDir, obj.table, gData_VAL, blk)
+	if err != nil {
+		obj.ref = nil
+		return false, err
+	}
+	obj.tail = blk
+	return false, nil
+}
+
+// newHead 分配第一块, ref在write结束时才落盘
+func (obj *fstObjImpl) newHead() error {
+	head, err := alloc(obj.dataDir, obj.table, gData_VAL)
+	if err != nil {
+		obj.ref = nil
+		return err
+	}
+	obj.ref = &ObjRef{Head: *head, Tail: *head}
+	obj.tail = &Block{BH: BlockHeader{}, Data: make([]byte, (tableLayout(obj.table).ObjSize - gBH_LEN))}
+	return nil
+}
+
+// toBlock 调用时持有读锁
+func (obj *fstObjImpl) toBlock(addr *BlockAddr) error {
+	blk := &Block{}
+	err := loadBlock(addr, obj.dataDir, obj.table, gData_VAL, blk)
+	if err != nil {
+		return err
+	}
+	obj.rdBlk = blk
+	obj.rdOff = 0
+	return nil
+}
+
+func (obj *fstObjImpl) resetRead() {
+	obj.rdBlk = nil
+	obj.rdOff = 0
+	obj.unpin()
+}
+
+func (obj *fstObjImpl) unpin() {
+	if obj.pinned {
+		obj.pinned = false
+		unpinTable(obj.dataDir, obj.table, obj.epoch)
+	}
+}
+
+// objKey 每个table/key一个, 同一个key的句柄共用. 写时持有写锁, 读盘时持有读锁
+type objKey struct {
+	key  string
+	lock sync.RWMutex
+	refs int
+}
+
+var gObjLock sync.Mutex
+var gObjKeys = make(map[string]*objKey)
+
+func objOpen(dir, table, key string) *objKey {
+	name := dir + "/" + table + "/" + key
+	gObjLock.Lock()
+	defer gObjLock.Unlock()
+	k, ok := gObjKeys[name]
+	if !ok {
+		k = &objKey{key: name}
+		gObjKeys[name] = k
+	}
+	k.refs++
+	return k
+}
+
+func (k *objKey) unref() {
+	gObjLock.Lock()
+	defer gObjLock.Unlock()
+	k.refs--
+	if k.refs == 0 {
+		delete(gObjKeys, k.key)
+	}
+}
+
+// getKey 关闭之后再用的句柄重新登记
+func (obj *fstObjImpl) getKey() *objKey {
+	if obj.lock == nil {
+		obj.lock = objOpen(obj.dataDir, obj.table, obj.key)
+	}
+	return obj.lock
+}
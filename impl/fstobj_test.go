@@ -0,0 +1,103 @@
+package impl
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+// readObject 从头读完整个对象, 还没有时返回空
+func readObject(t *testing.T, obj *fstObjImpl) []byte {
+	t.Helper()
+	out := bytes.NewBuffer(nil)
+	buf := make([]byte, 1000)
+	for {
+		n, err := obj.Read(buf)
+		if errors.Is(err, api.ErrEOF) || errors.Is(err, api.ErrEmpty) {
+			return out.Bytes()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(buf[:n])
+	}
+}
+
+func TestObjectSaveWhileReading(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	w := NewObject(dir, "t", "o")
+	defer w.Close()
+	if err := w.Save(gTestObj); err != nil {
+		t.Fatal(err)
+	}
+	r := NewObject(dir, "t", "o")
+	buf := make([]byte, 1000)
+	if n, err := r.Read(buf); err != nil || n != len(buf) {
+		t.Fatal(err, n)
+	}
+	// 读到一半时覆盖写, 旧链要等读结束再回收
+	small := []byte("small")
+	if err := w.Save(small); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Save(bytes.Repeat(small, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	rest := readObject(t, r)
+	if !bytes.Equal(append(buf, rest...), gTestObj) {
+		t.Fatal("old value", len(rest))
+	}
+	r.Close()
+	r = NewObject(dir, "t", "o")
+	if !bytes.Equal(readObject(t, r), bytes.Repeat(small, 3000)) {
+		t.Fatal("new value")
+	}
+	r.Close()
+	checkTable(t, dir, "t")
+}
+
+func TestObjectConcurrentAppend(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	const W, N = 4, 200
+	var wg sync.WaitGroup
+	for i := 0; i < W; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			obj := NewObject(dir, "t", "o")
+			defer obj.Close()
+			chunk := bytes.Repeat([]byte{byte('a' + i)}, 100)
+			for j := 0; j < N; j++ {
+				if err := obj.Append(chunk); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	// 同时读的句柄只会读到整次Append写进去的数据
+	for k := 0; k < 20; k++ {
+		r := NewObject(dir, "t", "o")
+		data := readObject(t, r)
+		r.Close()
+		if len(data)%100 != 0 {
+			t.Fatal("partial append", len(data))
+		}
+	}
+	wg.Wait()
+	r := NewObject(dir, "t", "o")
+	data := readObject(t, r)
+	r.Close()
+	if len(data) != W*N*100 {
+		t.Fatal("size", len(data))
+	}
+	for off := 0; off < len(data); off += 100 {
+		if !bytes.Equal(data[off:off+100], bytes.Repeat(data[off:off+1], 100)) {
+			t.Fatal("interleaved at", off)
+		}
+	}
+	checkTable(t, dir, "t")
+}
@@ -2,7 +2,9 @@ package impl
 
 import (
 	"encoding/binary"
-	"errors"
+	"fmt"
+
+	"github.com/tao/faststore/api"
 )
 
 var (
@@ -13,11 +15,16 @@ var (
 
 	gBAL_LEN       = uint32(8)
 	gBA_LEN        = uint32(8)
-	gBH_LEN        = uint32(20)
+	gBH_LEN        = uint32(28)
 	gBLK_V_H_LEN   = uint32(4)
 	gBLK_K_LEN     = 8
 	gTSDB_RIDX_LEN = uint32(28)
 	gTSDB_IDX_LEN  = uint32(16)
+	gOBJ_REF_LEN   = uint32(24)
+	gOVF_REF_LEN   = uint32(12)
+	gPATCH_LEN     = uint32(21)
+	gFREED_LEN     = uint32(9)
+	gKEEP_LEN      = ^uint32(0)
 )
 
 type FsData interface {
@@ -39,9 +46,12 @@ type BlockAddr struct {
 
 type BlockHeader struct {
 	FsData
-	Pre  BlockAddr
-	Next BlockAddr
-	Len  uint32
+	Pre   BlockAddr
+	Next  BlockAddr
+	Len   uint32
+	Codec uint8
+	Ver   uint8
+	Sum   uint32
 }
 
 type TsdbRangIndex struct {
@@ -58,6 +68,20 @@ type TsdbIndex struct {
 	Addr BlockAddr
 }
 
+type ObjRef struct {
+	FsData
+	Head BlockAddr
+	Tail BlockAddr
+	Size uint64
+}
+
+// OvfRef leaf里放不下的数据, 实际内容在ovf block链里
+type OvfRef struct {
+	FsData
+	Head BlockAddr
+	Size uint32
+}
+
 type TsdbValue struct {
 	FsData
 	Timestamp int64
@@ -77,6 +101,39 @@ type Block struct {
 	Data []byte
 }
 
+// FormatMeta 数据目录的superblock和每个table的格式记录
+type FormatMeta struct {
+	FsData
+	Version  uint32
+	BhLen    uint32
+	RidxLen  uint32
+	IdxLen   uint32
+	RidxSize uint32
+	IdxSize  uint32
+	ObjSize  uint32
+	FileSize uint32
+}
+
+// MergePatch 乱序合并时前驱block头的改动, Len为gKEEP_LEN时不改长度
+type MergePatch struct {
+	Type uint8
+	Addr BlockAddr
+	Next BlockAddr
+	Len  uint32
+}
+
+// MergeLog 新链落盘后和topRef在同一个事务里提交, 前驱改完并回收旧链后删掉
+type MergeLog struct {
+	FsData
+	Patches []MergePatch
+	Freed   map[string][]*BlockAddr
+}
+
+// shortError 解码时数据不够长, 盘上或者bolt里的数据损坏
+func shortError(what string, n int) error {
+	return fmt.Errorf("%w: %s len=%d", api.ErrCorrupt, what, n)
+}
+
 // impl
 func (br *BlockAloc) MarshalBinary() ([]byte, error) {
 	buf := make([]byte, gBAL_LEN)
@@ -86,6 +143,9 @@ func (br *BlockAloc) MarshalBinary() ([]byte, error) {
 	return buf, nil
 }
 func (br *BlockAloc) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gBAL_LEN) {
+		return shortError("block aloc", len(data))
+	}
 	lwd := binary.LittleEndian
 	br.SegNo = lwd.Uint32(data)
 	br.AlocLen = lwd.Uint32(data[4:])
@@ -101,6 +161,9 @@ func (br *BlockAddr) MarshalBinary() ([]byte, error) {
 }
 
 func (br *BlockAddr) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gBA_LEN) {
+		return shortError("block addr", len(data))
+	}
 	lwd := binary.LittleEndian
 	br.SegNo = lwd.Uint32(data)
 	br.SegOffset = lwd.Uint32(data[4:])
@@ -114,17 +177,25 @@ func (br *BlockHeader) MarshalBinary() ([]byte, error) {
 	lwd.PutUint32(buf[4:], br.Pre.SegOffset)
 	lwd.PutUint32(buf[8:], br.Next.SegNo)
 	lwd.PutUint32(buf[12:], br.Next.SegOffset)
-	lwd.PutUint32(buf[16:], br.Len)
+	lwd.PutUint32(buf[16:], br.Len|uint32(br.Codec)<<gCODEC_SHIFT)
+	buf[gBH_VER_OFF] = gBH_VER
+	lwd.PutUint32(buf[gBH_SUM_OFF:], br.Sum)
 	return buf, nil
 }
 
 func (br *BlockHeader) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gBH_LEN) {
+		return shortError("block header", len(data))
+	}
 	lwd := binary.LittleEndian
 	br.Pre.SegNo = lwd.Uint32(data)
 	br.Pre.SegOffset = lwd.Uint32(data[4:])
 	br.Next.SegNo = lwd.Uint32(data[8:])
 	br.Next.SegOffset = lwd.Uint32(data[12:])
-	br.Len = lwd.Uint32(data[16:])
+	br.Len = lwd.Uint32(data[16:]) & gCODEC_MASK
+	br.Codec = uint8(lwd.Uint32(data[16:]) >> gCODEC_SHIFT)
+	br.Ver = data[gBH_VER_OFF]
+	br.Sum = lwd.Uint32(data[gBH_SUM_OFF:])
 	return nil
 }
 
@@ -140,6 +211,9 @@ func (br *TsdbRangIndex) MarshalBinary() ([]byte, error) {
 }
 
 func (br *TsdbRangIndex) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gTSDB_RIDX_LEN) {
+		return shortError("range index", len(data))
+	}
 	lwd := binary.LittleEndian
 	br.Low = lwd.Uint64(data)
 	br.High = lwd.Uint64(data[8:])
@@ -159,6 +233,9 @@ func (br *TsdbIndex) MarshalBinary() ([]byte, error) {
 }
 
 func (br *TsdbIndex) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gTSDB_IDX_LEN) {
+		return shortError("index", len(data))
+	}
 	lwd := binary.LittleEndian
 	br.Key = lwd.Uint64(data)
 	br.Addr.SegNo = lwd.Uint32(data[8:])
@@ -166,6 +243,50 @@ func (br *TsdbIndex) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+func (br *ObjRef) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, gOBJ_REF_LEN)
+	lwd := binary.LittleEndian
+	lwd.PutUint32(buf, br.Head.SegNo)
+	lwd.PutUint32(buf[4:], br.Head.SegOffset)
+	lwd.PutUint32(buf[8:], br.Tail.SegNo)
+	lwd.PutUint32(buf[12:], br.Tail.SegOffset)
+	lwd.PutUint64(buf[16:], br.Size)
+	return buf, nil
+}
+
+func (br *ObjRef) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gOBJ_REF_LEN) {
+		return shortError("object ref", len(data))
+	}
+	lwd := binary.LittleEndian
+	br.Head.SegNo = lwd.Uint32(data)
+	br.Head.SegOffset = lwd.Uint32(data[4:])
+	br.Tail.SegNo = lwd.Uint32(data[8:])
+	br.Tail.SegOffset = lwd.Uint32(data[12:])
+	br.Size = lwd.Uint64(data[16:])
+	return nil
+}
+
+func (br *OvfRef) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, gOVF_REF_LEN)
+	lwd := binary.LittleEndian
+	lwd.PutUint32(buf, br.Head.SegNo)
+	lwd.PutUint32(buf[4:], br.Head.SegOffset)
+	lwd.PutUint32(buf[8:], br.Size)
+	return buf, nil
+}
+
+func (br *OvfRef) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gOVF_REF_LEN) {
+		return shortError("overflow ref", len(data))
+	}
+	lwd := binary.LittleEndian
+	br.Head.SegNo = lwd.Uint32(data)
+	br.Head.SegOffset = lwd.Uint32(data[4:])
+	br.Size = lwd.Uint32(data[8:])
+	return nil
+}
+
 func (br *TsdbValue) MarshalBinary() ([]byte, error) {
 	bLen := len(br.Data)
 	buf := make([]byte, (gBLK_K_LEN + bLen))
@@ -178,7 +299,7 @@ func (br *TsdbValue) MarshalBinary() ([]byte, error) {
 func (br *TsdbValue) UnmarshalBinary(data []byte) error {
 	bLen := len(data) - gBLK_K_LEN
 	if bLen <= 0 {
-		return errors.New("out of range")
+		return shortError("value", len(data))
 	}
 	lwd := binary.LittleEndian
 	br.Timestamp = int64(lwd.Uint64(data))
@@ -190,7 +311,7 @@ func (br *TsdbValue) UnmarshalBinary(data []byte) error {
 func (br *TsdbValue) unmarshal(data []byte, dLen int) error {
 	bLen := dLen - gBLK_K_LEN
 	if bLen <= 0 {
-		return errors.New("out of range")
+		return shortError("value", dLen)
 	}
 	lwd := binary.LittleEndian
 	br.Timestamp = int64(lwd.Uint64(data))
@@ -199,6 +320,16 @@ func (br *TsdbValue) unmarshal(data []byte, dLen int) error {
 	return nil
 }
 
+// view 不复制, Data直接引用data, cap截到数据末尾
+func (br *TsdbValue) view(data []byte, dLen int) error {
+	if dLen <= gBLK_K_LEN {
+		return shortError("value", dLen)
+	}
+	br.Timestamp = int64(binary.LittleEndian.Uint64(data))
+	br.Data = data[gBLK_K_LEN:dLen:dLen]
+	return nil
+}
+
 func (br *TsdbLogValue) MarshalBinary() ([]byte, error) {
 	bKey := []byte(br.Key)
 	kLen := uint32(len(bKey))
@@ -222,12 +353,12 @@ func (br *TsdbLogValue) UnmarshalBinary(data []byte) error {
 
 func (br *TsdbLogValue) unmarshal(data []byte, dLen int) error {
 	if dLen <= 12 {
-		return errors.New("out of range")
+		return shortError("log value", dLen)
 	}
 	lwd := binary.LittleEndian
 	kLen := lwd.Uint32(data)
 	if uint32(dLen) < (uint32(12) + kLen) {
-		return errors.New("out of range")
+		return fmt.Errorf("%w: log value len=%d, key len=%d", api.ErrCorrupt, dLen, kLen)
 	}
 	sOff := 4
 	br.Key = string(duplicate(data[sOff : sOff+int(kLen)]))
@@ -235,7 +366,7 @@ func (br *TsdbLogValue) unmarshal(data []byte, dLen int) error {
 	br.Timestamp = int64(lwd.Uint64(data[sOff:]))
 	sOff += 8
 	if sOff >= dLen {
-		return errors.New("out of range")
+		return shortError("log value", dLen)
 	}
 	br.Data = make([]byte, (dLen - sOff))
 	bcopy(br.Data, data, 0, uint32(sOff), uint32(dLen-sOff))
@@ -251,24 +382,127 @@ func (br *Block) MarshalBinary() ([]byte, error) {
 	lwd.PutUint32(outBuf[4:], bh.Pre.SegOffset)
 	lwd.PutUint32(outBuf[8:], bh.Next.SegNo)
 	lwd.PutUint32(outBuf[12:], bh.Next.SegOffset)
-	lwd.PutUint32(outBuf[16:], bh.Len)
+	lwd.PutUint32(outBuf[16:], bh.Len|uint32(bh.Codec)<<gCODEC_SHIFT)
+	outBuf[gBH_VER_OFF] = gBH_VER
+	lwd.PutUint32(outBuf[gBH_SUM_OFF:], bh.Sum)
 	bcopy(outBuf, br.Data, gBH_LEN, 0, uint32(bLen))
 	return outBuf, nil
 }
 
 func (br *Block) UnmarshalBinary(data []byte) error {
+	if err := br.unmarshalHeader(data); err != nil {
+		return err
+	}
 	bLen := len(data) - int(gBH_LEN)
-	if bLen <= 0 {
-		return errors.New("out of range")
+	br.Data = make([]byte, bLen)
+	bcopy(br.Data, data, 0, gBH_LEN, uint32(bLen))
+	return nil
+}
+
+// unmarshalHeader 只解析块头, 不碰Data
+func (br *Block) unmarshalHeader(data []byte) error {
+	if len(data) <= int(gBH_LEN) {
+		return shortError("block", len(data))
 	}
 	lwd := binary.LittleEndian
 	br.BH.Pre.SegNo = lwd.Uint32(data)
 	br.BH.Pre.SegOffset = lwd.Uint32(data[4:])
 	br.BH.Next.SegNo = lwd.Uint32(data[8:])
 	br.BH.Next.SegOffset = lwd.Uint32(data[12:])
-	br.BH.Len = lwd.Uint32(data[16:])
-	br.Data = make([]byte, bLen)
-	bcopy(br.Data, data, 0, gBH_LEN, uint32(bLen))
+	br.BH.Len = lwd.Uint32(data[16:]) & gCODEC_MASK
+	br.BH.Codec = uint8(lwd.Uint32(data[16:]) >> gCODEC_SHIFT)
+	br.BH.Ver = data[gBH_VER_OFF]
+	br.BH.Sum = lwd.Uint32(data[gBH_SUM_OFF:])
+	return nil
+}
+
+func (br *FormatMeta) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, gFORMAT_LEN)
+	lwd := binary.LittleEndian
+	copy(buf, gFORMAT_MAGIC)
+	for i, v := range br.fields() {
+		lwd.PutUint32(buf[4+4*i:], *v)
+	}
+	lwd.PutUint32(buf[gFORMAT_LEN-4:], checksum(buf[:gFORMAT_LEN-4]))
+	return buf, nil
+}
+
+func (br *FormatMeta) UnmarshalBinary(data []byte) error {
+	if len(data) < int(gFORMAT_LEN) || string(data[:4]) != string(gFORMAT_MAGIC) {
+		return fmt.Errorf("%w: bad format magic", api.ErrFormat)
+	}
+	lwd := binary.LittleEndian
+	if checksum(data[:gFORMAT_LEN-4]) != lwd.Uint32(data[gFORMAT_LEN-4:]) {
+		return fmt.Errorf("%w: bad format checksum", api.ErrCorrupt)
+	}
+	for i, v := range br.fields() {
+		*v = lwd.Uint32(data[4+4*i:])
+	}
+	return nil
+}
+
+func (br *FormatMeta) fields() []*uint32 {
+	return []*uint32{&br.Version, &br.BhLen, &br.RidxLen, &br.IdxLen, &br.RidxSize, &br.IdxSize, &br.ObjSize, &br.FileSize}
+}
+
+// Type是datype在gData_Types里的下标
+func (br *MergeLog) MarshalBinary() ([]byte, error) {
+	n := 0
+	for _, list := range br.Freed {
+		n += len(list)
+	}
+	buf := make([]byte, 4+uint32(len(br.Patches))*gPATCH_LEN+uint32(n)*gFREED_LEN)
+	lwd := binary.LittleEndian
+	lwd.PutUint32(buf, uint32(len(br.Patches)))
+	off := uint32(4)
+	for _, p := range br.Patches {
+		buf[off] = p.Type
+		lwd.PutUint32(buf[off+1:], p.Addr.SegNo)
+		lwd.PutUint32(buf[off+5:], p.Addr.SegOffset)
+		lwd.PutUint32(buf[off+9:], p.Next.SegNo)
+		lwd.PutUint32(buf[off+13:], p.Next.SegOffset)
+		lwd.PutUint32(buf[off+17:], p.Len)
+		off += gPATCH_LEN
+	}
+	for t, datype := range gData_Types {
+		for _, addr := range br.Freed[datype] {
+			buf[off] = uint8(t)
+			lwd.PutUint32(buf[off+1:], addr.SegNo)
+			lwd.PutUint32(buf[off+5:], addr.SegOffset)
+			off += gFREED_LEN
+		}
+	}
+	return buf, nil
+}
+
+func (br *MergeLog) UnmarshalBinary(data []byte) error {
+	lwd := binary.LittleEndian
+	if len(data) < 4 {
+		return fmt.Errorf("%w: merge log len=%d", api.ErrCorrupt, len(data))
+	}
+	n := lwd.Uint32(data)
+	off := uint64(4) + uint64(n)*uint64(gPATCH_LEN)
+	if off > uint64(len(data)) || (uint64(len(data))-off)%uint64(gFREED_LEN) != 0 {
+		return fmt.Errorf("%w: merge log len=%d, patches=%d", api.ErrCorrupt, len(data), n)
+	}
+	br.Patches = make([]MergePatch, n)
+	for i := range br.Patches {
+		b := data[4+uint32(i)*gPATCH_LEN:]
+		if int(b[0]) >= len(gData_Types) {
+			return fmt.Errorf("%w: merge log type=%d", api.ErrCorrupt, b[0])
+		}
+		br.Patches[i] = MergePatch{Type: b[0], Addr: BlockAddr{SegNo: lwd.Uint32(b[1:]), SegOffset: lwd.Uint32(b[5:])},
+			Next: BlockAddr{SegNo: lwd.Uint32(b[9:]), SegOffset: lwd.Uint32(b[13:])}, Len: lwd.Uint32(b[17:])}
+	}
+	br.Freed = make(map[string][]*BlockAddr)
+	for ; off < uint64(len(data)); off += uint64(gFREED_LEN) {
+		b := data[off:]
+		if int(b[0]) >= len(gData_Types) {
+			return fmt.Errorf("%w: merge log type=%d", api.ErrCorrupt, b[0])
+		}
+		datype := gData_Types[b[0]]
+		br.Freed[datype] = append(br.Freed[datype], &BlockAddr{SegNo: lwd.Uint32(b[1:]), SegOffset: lwd.Uint32(b[5:])})
+	}
 	return nil
 }
 
@@ -282,14 +516,15 @@ func getIntFromB(data []byte) uint32 {
 	return lwd.Uint32(data)
 }
 
-func getIdxSegOff(off uint32) uint32 {
-	return ((off / gBLK_IDX_SIZE) * gBLK_IDX_SIZE)
+// 数据地址是block在segment里的偏移加上头部长度和block内的偏移, size是table的block大小
+func getIdxSegOff(off, size uint32) uint32 {
+	return ((off / size) * size)
 }
 
-func getValueSegOff(off uint32) uint32 {
-	return ((off / gBLK_OBJ_SIZE) * gBLK_OBJ_SIZE)
+func getValueSegOff(off, size uint32) uint32 {
+	return ((off / size) * size)
 }
 
-func getValueBlkOff(off uint32) uint32 {
-	return (off % gBLK_OBJ_SIZE) - gBH_LEN
+func getValueBlkOff(off, size uint32) uint32 {
+	return (off % size) - gBH_LEN
 }
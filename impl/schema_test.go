@@ -0,0 +1,32 @@
+package impl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func TestSchemaShortData(t *testing.T) {
+	short := make([]byte, 3)
+	for i, v := range []FsData{&BlockAloc{}, &BlockAddr{}, &BlockHeader{}, &TsdbRangIndex{}, &TsdbIndex{},
+		&ObjRef{}, &OvfRef{}, &TsdbValue{}, &TsdbLogValue{}, &Block{}, &MergeLog{}} {
+		if err := v.UnmarshalBinary(short); !errors.Is(err, api.ErrCorrupt) {
+			t.Fatal(i, err)
+		}
+	}
+	tv := &TsdbValue{}
+	buf := make([]byte, 16)
+	if err := tv.view(buf, gBLK_K_LEN); !errors.Is(err, api.ErrCorrupt) {
+		t.Fatal(err)
+	}
+	if err := tv.unmarshal(buf, gBLK_K_LEN); !errors.Is(err, api.ErrCorrupt) {
+		t.Fatal(err)
+	}
+	// key的长度超出了数据
+	lv := &TsdbLogValue{}
+	putIntToB(buf, 100)
+	if err := lv.UnmarshalBinary(buf); !errors.Is(err, api.ErrCorrupt) {
+		t.Fatal(err)
+	}
+}
@@ -1,16 +1,16 @@
 package impl
 
 import (
-	"errors"
 	"fmt"
 	"os"
 
-	"github.com/boltdb/bolt"
 	"github.com/tao/faststore/api"
 	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
 )
 
 var blotDb *bolt.DB
+var gConf *api.TsdbConf
 
 func StartDb(c *api.TsdbConf) error {
 	os.MkdirAll(fmt.Sprintf("%s/blot", c.DataDir), 0755)
@@ -21,13 +21,65 @@ func StartDb(c *api.TsdbConf) error {
 		return err
 	}
 	blotDb = db
+	gConf = c
+	resetLayouts()
+	initBlockCache(c)
+	if err = initFdPool(c); err != nil {
+		db.Close()
+		blotDb = nil
+		return err
+	}
+	if err = checkFormat(c.DataDir); err != nil {
+		common.Logger.Warnf("data dir=%s:%s", c.DataDir, err)
+		db.Close()
+		blotDb = nil
+		return err
+	}
+	if err = loadCodecs(c); err != nil {
+		db.Close()
+		blotDb = nil
+		return err
+	}
+	if err = startSyncer(c); err != nil {
+		common.Logger.Warnf("start syncer failed:%s", err)
+		db.Close()
+		blotDb = nil
+		return err
+	}
+	if err = redoMerges(c.DataDir); err != nil {
+		common.Logger.Warnf("redo merge failed:%s", err)
+		StopDb()
+		return err
+	}
+	if err = replayWal(c.DataDir); err != nil {
+		// wal留在磁盘上, 修好之后再启动
+		common.Logger.Warnf("replay wal failed:%s", err)
+		StopDb()
+		return err
+	}
+	if err = startRollup(c); err != nil {
+		common.Logger.Warnf("start rollup failed:%s", err)
+		StopDb()
+		return err
+	}
 	return nil
 }
 
 func StopDb() {
+	stopRollup()
+	closeWals()
+	closeSeries()
+	if gConf != nil {
+		releasePins(gConf.DataDir)
+	}
+	stopSyncer()
+	closeSegs()
 	if blotDb != nil {
 		blotDb.Close()
+		blotDb = nil
 	}
+	resetLayouts()
+	resetBlockCache()
 }
 
 func getTsData(table, key string, data FsData) error {
@@ -61,12 +113,12 @@ func getBValue(table, key string) ([]byte, error) {
 	err := blotDb.View(func(tx *bolt.Tx) error {
 		buck := tx.Bucket([]byte(table))
 		if buck == nil {
-			return errors.New("find none")
+			return api.ErrEmpty
 		}
 		bKey := []byte(key)
 		value = buck.Get(bKey)
 		if value == nil {
-			return errors.New("find none")
+			return api.ErrEmpty
 		}
 		return nil
 	})
@@ -75,7 +127,7 @@ func getBValue(table, key string) ([]byte, error) {
 
 func setBValue(table, key string, value []byte) error {
 	err := blotDb.Update(func(tx *bolt.Tx) error {
-		buck, err := tx.CreateBucketIfNotExists([]byte(table))
+		buck, err := tableBucket(tx, table)
 		if err != nil {
 			common.Logger.Infof("create bucket %s failed:%s", table, err)
 			return err
@@ -90,3 +142,13 @@ func setBValue(table, key string, value []byte) error {
 	})
 	return err
 }
+
+func delBValue(table, key string) error {
+	return blotDb.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		return buck.Delete([]byte(key))
+	})
+}
@@ -2,9 +2,11 @@ package impl
 
 import (
 	"container/list"
+	"errors"
 	"os"
 
 	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
 )
 
 type tsdbWRCache struct {
@@ -14,6 +16,7 @@ type tsdbWRCache struct {
 	impl      *fstTsdbImpl
 	addr      *BlockAddr
 	block     *Block
+	spare     []*BlockAddr
 }
 
 type tsdbRDCache struct {
@@ -21,7 +24,13 @@ type tsdbRDCache struct {
 	readOff  uint32
 	dataType string
 	impl     *fstTsdbImpl
+	addr     BlockAddr
 	block    *Block
+	offs     []uint32
+	scanned  bool
+	floor    int64
+	ovf      bool
+	noCopy   bool // 读出来的Data直接引用block, block和块缓存共用
 }
 
 type tsdbAppender struct {
@@ -31,16 +40,19 @@ type tsdbAppender struct {
 	ridxCache *tsdbWRCache
 	idxCache  *tsdbWRCache
 	datCache  *tsdbWRCache
+	late      []*api.FstTsdbValue
+	floor     *int64
+	headLow   *uint64
+	chunk     *numChunk
 }
 
+// tsdbQuery 每次GetLastN新建一个
 type tsdbQuery struct {
-	offset   int
-	low      int64
-	high     int64
 	impl     *fstTsdbImpl
 	tRidx    *TsdbRangIndex
 	tIdx     *TsdbIndex
 	datCache *tsdbRDCache
+	floor    int64
 }
 
 type fstTsdbImpl struct {
@@ -49,88 +61,164 @@ type fstTsdbImpl struct {
 	dataDir  string
 	symbol   string
 	appender *tsdbAppender
-	query    *tsdbQuery
+	wal      *tsdbWal
+	noWal    bool
+	rewrite  bool // K线序列重算时覆盖已有的数据, 不受OutOfOrder限制
+	candles  *tsdbCandles
+	series   *tsdbSeries
+	handle   bool // NewTsdb返回的句柄, 写交给series的写句柄, 读经过series的锁
+	wrote    bool
+	snap     *tsdbSnap
 }
 
 type fstLoggerImpl struct {
 	api.FstLogger
 	dir      string
 	table    string
+	sub      string
 	tailName string
 	ios      *os.File
 	cache    []byte
 	cacheOff uint32
 	fileOff  uint32
+	legacy   bool // 只读旧格式: 帧头没有校验和
 }
 
-type ftsdbEoff struct {
-}
-
-type ftsdbEmpty struct {
-}
-
+type fstObjImpl struct {
+	api.FastStoreCall
+	table   string
+	dataDir string
+	key     string
+	ref     *ObjRef
+	tail    *Block
+	rdBlk   *Block
+	rdOff   uint32
+	lock    *objKey
+	epoch   uint64 // 读的时候pin住table, 读完或者Close时解除
+	pinned  bool
+}
+
+// NewTsdb 同一symbol的句柄可以在多个goroutine里同时读写, 写入由共用的写句柄串行执行
 func NewTsdb(dir, table string, symbol string) *fstTsdbImpl {
 	dataDir := dir
-	return &fstTsdbImpl{table: table, dataDir: dataDir, symbol: symbol}
+	return &fstTsdbImpl{table: table, dataDir: dataDir, symbol: symbol, series: seriesOpen(dataDir, table, symbol), handle: true}
 }
 
 func NewLogger(dir, table string) *fstLoggerImpl {
-	return &fstLoggerImpl{dir: dir, table: table}
+	return &fstLoggerImpl{dir: dir, table: table, sub: gDlog_Dir}
 }
 
-func Tsdb_IsEoff(e error) bool {
-	if e != nil && e == gErr_Eof {
-		return true
-	}
-	return false
+func NewObject(dir, table, key string) *fstObjImpl {
+	return &fstObjImpl{table: table, dataDir: dir, key: key}
 }
 
-func Tsdb_IsEmpty(e error) bool {
-	return ((e != nil) && (e == gErr_Empty))
+// layout table的block和segment大小
+func (tsdb *fstTsdbImpl) layout() *FormatMeta {
+	return tableLayout(tsdb.table)
 }
 
 func (tsdb *fstTsdbImpl) Symbol() string {
 	return tsdb.symbol
 }
 func (tsdb *fstTsdbImpl) Append(value *api.FstTsdbValue) error {
-	if tsdb.appender == nil {
-		tsdb.appender = &tsdbAppender{impl: tsdb}
+	w := tsdb.lockWriter()
+	defer tsdb.series.lock.Unlock()
+	return w.append(value)
+}
+func (tsdb *fstTsdbImpl) AppendBatch(values []api.FstTsdbValue) error {
+	w := tsdb.lockWriter()
+	defer tsdb.series.lock.Unlock()
+	return w.appendBatch(values)
+}
+func (tsdb *fstTsdbImpl) append(value *api.FstTsdbValue) error {
+	if err := tsdb.loadCandles(); err != nil {
+		return err
+	}
+	if err := tsdb.getAppender().append(value); err != nil {
+		return err
+	}
+	if tsdb.candles != nil {
+		tsdb.candles.add(value)
+	}
+	return nil
+}
+func (tsdb *fstTsdbImpl) appendBatch(values []api.FstTsdbValue) error {
+	if err := tsdb.loadCandles(); err != nil {
+		return err
+	}
+	if err := tsdb.getAppender().appendBatch(values); err != nil {
+		return err
+	}
+	if tsdb.candles != nil {
+		for i := range values {
+			tsdb.candles.add(&values[i])
+		}
 	}
-	return tsdb.appender.append(value)
+	return nil
 }
 func (tsdb *fstTsdbImpl) GetLastN(key int64, limit int) (*list.List, error) {
-	if tsdb.query == nil {
-		tsdb.query = &tsdbQuery{impl: tsdb}
-	} else {
-		tsdb.query.close()
+	if kind, err := tsdb.getKind(); err != nil {
+		return nil, err
+	} else if kind != 0 {
+		return tsdb.getLastPoints(key, limit)
 	}
-	return tsdb.query.getLastN(key, limit)
+	epoch := pinTable(tsdb.table)
+	defer unpinTable(tsdb.dataDir, tsdb.table, epoch)
+	v, err := tsdb.view()
+	if err != nil {
+		return nil, err
+	}
+	query := &tsdbQuery{impl: v}
+	if v.snap == nil || len(v.snap.late) == 0 {
+		return query.getLastN(key, limit)
+	}
+	// 被迟到数据覆盖的要多读几个
+	late := lateUpTo(v.snap.late, key)
+	itemList, err := query.getLastN(key, limit+len(late))
+	if err != nil && !errors.Is(err, api.ErrEmpty) {
+		return nil, err
+	}
+	return overlayLast(itemList, late, limit)
 }
 func (tsdb *fstTsdbImpl) GetBetween(low, high int64, offset int) (*list.List, error) {
-	if tsdb.query == nil {
-		tsdb.query = &tsdbQuery{low: low, high: high, offset: 0, impl: tsdb}
-	} else {
-		if (low != tsdb.query.low) || (high != tsdb.query.high) {
-			tsdb.query.close()
-			tsdb.query.high = high
-			tsdb.query.low = low
+	it := tsdb.Range(low, high)
+	defer it.Close()
+	itemList := list.New()
+	for itemList.Len() < api.DEF_LIMIT && it.Next() {
+		if offset > 0 {
+			offset--
+			continue
 		}
+		v := it.Value()
+		itemList.PushBack(&api.FstTsdbValue{Timestamp: v.Timestamp, Data: v.Data})
 	}
-	return tsdb.query.getBetween(low, high, offset)
-}
-func (tsdb *fstTsdbImpl) Close() {
-	if tsdb.appender != nil {
-		tsdb.appender.close()
+	if it.Err() != nil {
+		return nil, it.Err()
 	}
-	if tsdb.query != nil {
-		tsdb.query.close()
+	if itemList.Len() == 0 {
+		common.Logger.Infof("low=%d, high=%d is empty", low, high)
+		return nil, api.ErrEmpty
 	}
+	return itemList, nil
 }
-
-func (e ftsdbEoff) Error() string {
-	return "EOF"
+func (tsdb *fstTsdbImpl) Close() {
+	_ = tsdb.release()
 }
 
-func (e ftsdbEmpty) Error() string {
-	return "EMPTY"
+// closeWriter 共用的写句柄: 最后一个写过数据的句柄关闭时调用
+func (tsdb *fstTsdbImpl) closeWriter() error {
+	var err error
+	if tsdb.candles != nil {
+		if err := tsdb.candles.close(); err != nil {
+			common.Logger.Warnf("symbol=%s close candles failed:%s", tsdb.symbol, err)
+		}
+	}
+	if tsdb.appender != nil {
+		err = tsdb.closeAppender()
+	}
+	if tsdb.wal != nil {
+		tsdb.wal.release(err == nil)
+		tsdb.wal = nil
+	}
+	return err
 }
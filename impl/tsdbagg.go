@@ -0,0 +1,133 @@
+package impl
+
+import (
+	"fmt"
+
+	"github.com/tao/faststore/api"
+)
+
+// tsdbAgg 一个bucket的聚合状态, 所有函数一起算
+type tsdbAgg struct {
+	start int64
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+	first float64
+	last  float64
+}
+
+func checkAggFunc(fn string) error {
+	switch fn {
+	case api.AGG_COUNT, api.AGG_SUM, api.AGG_MIN, api.AGG_MAX, api.AGG_AVG, api.AGG_FIRST, api.AGG_LAST:
+		return nil
+	}
+	return fmt.Errorf("unknown aggregate function:%s", fn)
+}
+
+// bucketStart 按step对齐到整数倍, 负数也向下取整
+func bucketStart(ts, step int64) int64 {
+	m := ts % step
+	if m < 0 {
+		m += step
+	}
+	return ts - m
+}
+
+func (ag *tsdbAgg) add(v float64) {
+	if ag.count == 0 {
+		ag.min = v
+		ag.max = v
+		ag.first = v
+	}
+	if v < ag.min {
+		ag.min = v
+	}
+	if v > ag.max {
+		ag.max = v
+	}
+	ag.last = v
+	ag.sum += v
+	ag.count++
+}
+
+func (ag *tsdbAgg) value(fn string) float64 {
+	switch fn {
+	case api.AGG_COUNT:
+		return float64(ag.count)
+	case api.AGG_SUM:
+		return ag.sum
+	case api.AGG_MIN:
+		return ag.min
+	case api.AGG_MAX:
+		return ag.max
+	case api.AGG_AVG:
+		return ag.sum / float64(ag.count)
+	case api.AGG_FIRST:
+		return ag.first
+	default:
+		return ag.last
+	}
+}
+
+// Aggregate step<=0时整个区间一个bucket; decode为nil且table配置了rollup时优先用rollup,
+// 迟到的数据改过的bucket在重算之前从原始数据算
+func (tsdb *fstTsdbImpl) Aggregate(low, high, step int64, fn string, decode api.FstDecoder) ([]api.FstTsdbBucket, error) {
+	if err := checkAggFunc(fn); err != nil {
+		return nil, err
+	}
+	buckets := make([]api.FstTsdbBucket, 0)
+	emit := func(ag *tsdbAgg) error {
+		buckets = append(buckets, api.FstTsdbBucket{Start: ag.start, Count: ag.count, Value: ag.value(fn)})
+		return nil
+	}
+	var err error
+	if rc := getRollupConf(tsdb.table); (decode == nil) && (rc != nil) {
+		m := &aggMerger{low: low, step: step, emit: emit}
+		if err = tsdb.aggregateTiers(rc.usableTiers(step), low, high, step, rc.decode, m.add); err == nil {
+			err = m.flush()
+		}
+	} else {
+		if decode == nil {
+			decode = api.DecodeFloat64LE
+			if kind, err := tsdb.getKind(); err != nil {
+				return nil, err
+			} else if kind == gNUM_INT {
+				decode = api.DecodeInt64LE
+			}
+		}
+		err = tsdb.aggregate(low, high, step, decode, emit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+func (tsdb *fstTsdbImpl) aggregate(low, high, step int64, decode api.FstDecoder, emit func(ag *tsdbAgg) error) error {
+	it := tsdb.Range(low, high)
+	defer it.Close()
+	ag := &tsdbAgg{}
+	for it.Next() {
+		v := it.Value()
+		start := low
+		if step > 0 {
+			start = bucketStart(v.Timestamp, step)
+		}
+		if ag.count > 0 && start != ag.start {
+			if err := emit(ag); err != nil {
+				return err
+			}
+			ag = &tsdbAgg{}
+		}
+		ag.start = start
+		ag.add(decode(v.Data))
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	if ag.count > 0 {
+		return emit(ag)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package impl
+
+import (
+	"math"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+func (ta *tsdbAppender) appendBatch(values []api.FstTsdbValue) error {
+	if len(values) == 0 {
+		return nil
+	}
+	for i := range values {
+		if len(values[i].Data) == 0 {
+			return api.ErrEmptyValue
+		}
+	}
+	err := ta.getTailRIdx()
+	if err != nil {
+		common.Logger.Infof("batch=%d, failed:%s", len(values), err)
+		return err
+	}
+	// 一次校验顺序
+	high := int64(math.MinInt64)
+	if ta.lastRidx != nil {
+		high = int64(ta.lastRidx.High)
+	}
+	ordered := values
+	var late []*api.FstTsdbValue
+	for i := range values {
+		ts := values[i].Timestamp
+		if ts >= high {
+			high = ts + 1
+			if late != nil {
+				ordered = append(ordered, values[i])
+			}
+			continue
+		}
+		if !ta.lateAllowed() {
+			if ts == (high - 1) {
+				return api.ErrDuplicateTimestamp
+			}
+			return api.ErrOutOfOrder
+		}
+		if err = ta.checkFloor(ts); err != nil {
+			return err
+		}
+		if late == nil {
+			late = make([]*api.FstTsdbValue, 0, len(values)-i)
+			ordered = make([]api.FstTsdbValue, i, len(values))
+			copy(ordered, values[:i])
+		}
+		late = append(late, &values[i])
+	}
+	if err = ta.impl.logWal(values); err != nil {
+		return err
+	}
+
+	if len(ordered) > 0 {
+		if err = ta.getDataCache(); err != nil {
+			return err
+		}
+		// 数值序列按chunk打包, 不预分配
+		if kind, err := ta.impl.getKind(); err != nil {
+			return err
+		} else if kind == 0 {
+			if err = ta.reserve(ordered); err != nil {
+				return err
+			}
+		}
+		for i := range ordered {
+			if err = ta.appendData(&ordered[i]); err != nil {
+				return err
+			}
+		}
+	}
+	first := int64(math.MaxInt64)
+	for _, v := range late {
+		if err = ta.stage(v); err != nil {
+			return err
+		}
+		if v.Timestamp < first {
+			first = v.Timestamp
+		}
+	}
+	if len(late) > 0 {
+		return markRollupDirty(ta.impl.table, ta.impl.symbol, first)
+	}
+	return nil
+}
+
+// blockPlan 模拟打包, 算出leaf/idx/ridx各需要多少新block
+type blockPlan struct {
+	datFill   uint32
+	idxFill   uint32
+	ridxFill  uint32
+	hasRidx   bool
+	ridxSaved bool
+	need      map[string]uint32
+	lay       *FormatMeta
+}
+
+func newBlockPlan(lay *FormatMeta) *blockPlan {
+	return &blockPlan{need: map[string]uint32{gData_VAL: 0, gData_IDX: 0, gData_RIDX: 0}, lay: lay}
+}
+
+func (p *blockPlan) add(dLen int) error {
+	if needOverflow(dLen, p.lay.ObjSize) {
+		// ovf链写的时候再分配, leaf里只有引用
+		if uint32(dLen) > gVAL_MAX_SIZE {
+			return api.ErrValueTooLarge
+		}
+		dLen = int(gOVF_REF_LEN)
+	}
+	vLen := gBLK_V_H_LEN + uint32(gBLK_K_LEN+dLen)
+	if (p.datFill + vLen) > (p.lay.ObjSize - gBH_LEN) {
+		p.need[gData_VAL]++
+		p.datFill = 0
+	}
+	p.datFill += vLen
+	if (p.idxFill + gTSDB_IDX_LEN) > (p.lay.IdxSize - gBH_LEN) {
+		p.need[gData_IDX]++
+		p.idxFill = 0
+		// 换idxBlock时把上一个range index写进ridx block
+		p.saveRidx()
+		p.ridxSaved = false
+	}
+	p.idxFill += gTSDB_IDX_LEN
+	p.hasRidx = true
+	return nil
+}
+
+func (p *blockPlan) saveRidx() {
+	if p.hasRidx && !p.ridxSaved {
+		if (p.ridxFill + gTSDB_RIDX_LEN) > (p.lay.RidxSize - gBH_LEN) {
+			p.need[gData_RIDX]++
+			p.ridxFill = 0
+		}
+		p.ridxFill += gTSDB_RIDX_LEN
+	}
+}
+
+// reserve 模拟一遍打包,算出leaf/idx/ridx各需要多少新block,一次bolt更新分配完并保存topRef
+func (ta *tsdbAppender) reserve(values []api.FstTsdbValue) error {
+	p := newBlockPlan(ta.impl.layout())
+	p.datFill = ta.datCache.block.BH.Len
+	p.idxFill = ta.idxCache.block.BH.Len
+	p.ridxFill = ta.ridxCache.block.BH.Len
+	p.hasRidx = ta.lastRidx != nil
+	p.ridxSaved = p.hasRidx && (ta.lastRidx.Off != 0)
+	for i := range values {
+		if err := p.add(len(values[i].Data)); err != nil {
+			return err
+		}
+	}
+	topRef := ta.topRef
+	addrs, err := allocBlocks(ta.impl.dataDir, ta.impl.table, p.need, func(buck *bolt.Bucket) error {
+		buf, err := topRef.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return buck.Put([]byte(ta.impl.symbol), buf)
+	})
+	if err != nil {
+		common.Logger.Infof("reserve symbol=%s failed:%s", ta.impl.symbol, err)
+		return err
+	}
+	ta.datCache.spare = append(ta.datCache.spare, addrs[gData_VAL]...)
+	ta.idxCache.spare = append(ta.idxCache.spare, addrs[gData_IDX]...)
+	ta.ridxCache.spare = append(ta.ridxCache.spare, addrs[gData_RIDX]...)
+	return nil
+}
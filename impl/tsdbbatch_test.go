@@ -0,0 +1,26 @@
+package impl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func TestAppendBatchEmptyValue(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 10)
+	// 整批都不写
+	batch := []api.FstTsdbValue{{Timestamp: 11, Data: testValue(11)}, {Timestamp: 12, Data: []byte{}}}
+	if err := db.AppendBatch(batch); !errors.Is(err, api.ErrEmptyValue) {
+		t.Fatal(err)
+	}
+	batch[1].Data = testValue(12)
+	if err := db.AppendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	crashDb(t)
+	checkValues(t, dir, "t", "s", 12)
+}
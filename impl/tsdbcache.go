@@ -0,0 +1,148 @@
+package impl
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/tao/faststore/api"
+)
+
+// 解码后的block按(目录, table, 类型, 地址)缓存, 所有查询共用, 按LRU淘汰.
+// saveBlock和回收清头写盘之后删掉对应的项; 读盘期间被改写的block不放进缓存
+var (
+	gCACHE_DEF_MB = 64
+	gCACHE_STRIPE = uint32(256)
+)
+
+type blockKey struct {
+	dir    string
+	table  string
+	datype string
+	addr   BlockAddr
+}
+
+type cacheEntry struct {
+	key blockKey
+	blk *Block
+}
+
+type blockCache struct {
+	lock  sync.Mutex
+	limit int64
+	size  int64
+	lru   *list.List
+	items map[blockKey]*list.Element
+	// 每个分段改写一次加1, 读盘前后不一样时说明读的可能是旧数据
+	gens []uint64
+}
+
+var gBlockCache = makeBlockCache(0)
+
+func makeBlockCache(limit int64) *blockCache {
+	return &blockCache{limit: limit, lru: list.New(), items: make(map[blockKey]*list.Element),
+		gens: make([]uint64, gCACHE_STRIPE)}
+}
+
+// initBlockCache CacheMB为0时用默认大小, 负数关闭
+func initBlockCache(c *api.TsdbConf) {
+	mb := gCACHE_DEF_MB
+	if c != nil && c.CacheMB != 0 {
+		mb = c.CacheMB
+	}
+	if mb < 0 {
+		mb = 0
+	}
+	gBlockCache = makeBlockCache(int64(mb) << 20)
+}
+
+func resetBlockCache() {
+	gBlockCache = makeBlockCache(gBlockCache.limit)
+}
+
+// stripe 只按地址分段, 不同table落在同一段只是多一些不放进缓存的读
+func (bc *blockCache) stripe(key *blockKey) *uint64 {
+	n := (key.addr.SegNo * 2654435761) ^ (key.addr.SegOffset >> 12)
+	return &bc.gens[n%gCACHE_STRIPE]
+}
+
+// get 命中时复制一份, 调用者可以改; shared时直接共用缓存里的Data, 调用者只能读
+func (bc *blockCache) get(key blockKey, data *Block, shared bool) (uint64, bool) {
+	if bc.limit <= 0 {
+		return 0, false
+	}
+	bc.lock.Lock()
+	gen := *bc.stripe(&key)
+	el, ok := bc.items[key]
+	if !ok {
+		bc.lock.Unlock()
+		gStats.addCache(false)
+		return gen, false
+	}
+	bc.lru.MoveToFront(el)
+	blk := el.Value.(*cacheEntry).blk
+	bc.lock.Unlock()
+	data.BH = blk.BH
+	if shared {
+		data.Data = blk.Data
+	} else {
+		data.Data = make([]byte, len(blk.Data))
+		copy(data.Data, blk.Data)
+	}
+	gStats.addCache(true)
+	return gen, true
+}
+
+// put gen是读盘之前get返回的; shared时data.Data之后不会再被改, 不用复制
+func (bc *blockCache) put(key blockKey, gen uint64, data *Block, shared bool) {
+	if bc.limit <= 0 || int64(len(data.Data)) > bc.limit {
+		return
+	}
+	blk := &Block{BH: data.BH, Data: data.Data}
+	if !shared {
+		blk.Data = make([]byte, len(data.Data))
+		copy(blk.Data, data.Data)
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if *bc.stripe(&key) != gen {
+		return
+	}
+	if el, ok := bc.items[key]; ok {
+		bc.size -= int64(len(el.Value.(*cacheEntry).blk.Data))
+		bc.lru.Remove(el)
+	}
+	bc.items[key] = bc.lru.PushFront(&cacheEntry{key: key, blk: blk})
+	bc.size += int64(len(blk.Data))
+	for bc.size > bc.limit {
+		el := bc.lru.Back()
+		e := el.Value.(*cacheEntry)
+		bc.lru.Remove(el)
+		delete(bc.items, e.key)
+		bc.size -= int64(len(e.blk.Data))
+	}
+}
+
+// invalidate 写盘之后调用, 之前开始读盘的旧数据不会再放进来
+func (bc *blockCache) invalidate(key blockKey) {
+	if bc.limit <= 0 {
+		return
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	*bc.stripe(&key)++
+	if el, ok := bc.items[key]; ok {
+		bc.size -= int64(len(el.Value.(*cacheEntry).blk.Data))
+		bc.lru.Remove(el)
+		delete(bc.items, key)
+	}
+}
+
+func (bc *blockCache) bytes() int64 {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.size
+}
+
+func cacheKey(addr *BlockAddr, dir, table, datype string) blockKey {
+	return blockKey{dir: dir, table: table, datype: datype, addr: BlockAddr{SegNo: addr.SegNo, SegOffset: addr.SegOffset}}
+}
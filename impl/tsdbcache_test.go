@@ -0,0 +1,79 @@
+package impl
+
+import (
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func cachedBlock(addr *BlockAddr, dir, table, datype string) bool {
+	gBlockCache.lock.Lock()
+	defer gBlockCache.lock.Unlock()
+	_, ok := gBlockCache.items[cacheKey(addr, dir, table, datype)]
+	return ok
+}
+
+func saveTestBlock(t *testing.T, addr *BlockAddr, dir, data string) {
+	t.Helper()
+	size := tableLayout("t").blockSize(gData_VAL)
+	blk := &Block{Data: make([]byte, size-gBH_LEN)}
+	blk.BH.Len = uint32(copy(blk.Data, data))
+	if err := saveBlock(addr, dir, "t", gData_VAL, blk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockCacheSave(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	addrs, err := allocBlocks(dir, "t", map[string]uint32{gData_VAL: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := addrs[gData_VAL][0]
+	saveTestBlock(t, addr, dir, "old")
+	blk := &Block{}
+	if err = loadBlock(addr, dir, "t", gData_VAL, blk); err != nil || string(blk.Data[:blk.BH.Len]) != "old" {
+		t.Fatal(err, blk.BH)
+	}
+	if !cachedBlock(addr, dir, "t", gData_VAL) {
+		t.Fatal("not cached")
+	}
+	// 改写之后缓存里的旧block删掉, 再读是新的
+	saveTestBlock(t, addr, dir, "new")
+	if cachedBlock(addr, dir, "t", gData_VAL) {
+		t.Fatal("stale entry")
+	}
+	if err = loadBlock(addr, dir, "t", gData_VAL, blk); err != nil || string(blk.Data[:blk.BH.Len]) != "new" {
+		t.Fatal(err, blk.BH)
+	}
+	// 改写之前开始的读盘不会把旧数据放进缓存
+	key := cacheKey(addr, dir, "t", gData_VAL)
+	gBlockCache.invalidate(key)
+	gen, _ := gBlockCache.get(key, &Block{}, false)
+	saveTestBlock(t, addr, dir, "newer")
+	gBlockCache.put(key, gen, blk, false)
+	if cachedBlock(addr, dir, "t", gData_VAL) {
+		t.Fatal("stale put")
+	}
+	if err = loadBlock(addr, dir, "t", gData_VAL, blk); err != nil || string(blk.Data[:blk.BH.Len]) != "newer" {
+		t.Fatal(err, blk.BH)
+	}
+}
+
+func TestBlockCacheRewrite(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	db := NewTsdb(dir, "t", "s")
+	defer db.Close()
+	appendValues(t, db, 1, 3000)
+	db.Close()
+	checkValues(t, dir, "t", "s", 3000)
+	// 尾block已经在缓存里, 再写要改写它
+	db = NewTsdb(dir, "t", "s")
+	appendValues(t, db, 3001, 3010)
+	db.Close()
+	checkValues(t, dir, "t", "s", 3010)
+	l, err := NewTsdb(dir, "t", "s").GetLastN(3010, 1)
+	if err != nil || l.Front().Value.(*api.FstTsdbValue).Timestamp != 3010 {
+		t.Fatal(err, l)
+	}
+}
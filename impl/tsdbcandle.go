@@ -0,0 +1,308 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+type candleConf struct {
+	names  []string
+	steps  []int64
+	decode api.FstTickDecoder
+}
+
+var gCandleLock sync.Mutex
+var gCandles = make(map[string]*candleConf)
+
+// candleBuilder 一个周期的当前K线, 之前的K线都已写进派生序列
+type candleBuilder struct {
+	step   int64
+	series *fstTsdbImpl
+	bar    *api.FstCandle
+	lastTs int64
+	stale  bool
+	dirty  map[int64]bool
+}
+
+// tsdbCandles 跟着tick序列共用的写句柄走, 第一次写入时从已有数据恢复当前K线
+type tsdbCandles struct {
+	impl     *fstTsdbImpl
+	conf     *candleConf
+	builders []*candleBuilder
+	ready    bool
+}
+
+// parseInterval 支持time.ParseDuration的格式, 另外支持天(1d)
+func parseInterval(name string, unit time.Duration) (int64, error) {
+	var d time.Duration
+	if strings.HasSuffix(name, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(name, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("bad candle interval:%s", name)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(name); err != nil {
+			return 0, fmt.Errorf("bad candle interval:%s", name)
+		}
+	}
+	step := int64(d / unit)
+	if step <= 0 {
+		return 0, fmt.Errorf("bad candle interval:%s", name)
+	}
+	return step, nil
+}
+
+// EnableCandles 之后打开的句柄写tick时同时更新K线
+func EnableCandles(table string, c *api.FstCandleConf) error {
+	unit := c.Unit
+	if unit <= 0 {
+		unit = time.Millisecond
+	}
+	cc := &candleConf{decode: c.Decode}
+	if cc.decode == nil {
+		cc.decode = api.DecodeTickLE
+	}
+	for _, name := range c.Intervals {
+		step, err := parseInterval(name, unit)
+		if err != nil {
+			return err
+		}
+		cc.names = append(cc.names, name)
+		cc.steps = append(cc.steps, step)
+	}
+	gCandleLock.Lock()
+	defer gCandleLock.Unlock()
+	if len(cc.names) == 0 {
+		delete(gCandles, table)
+		return nil
+	}
+	gCandles[table] = cc
+	return nil
+}
+
+func newCandles(tsdb *fstTsdbImpl) *tsdbCandles {
+	if strings.Contains(tsdb.symbol, "@") {
+		return nil
+	}
+	gCandleLock.Lock()
+	cc, ok := gCandles[tsdb.table]
+	gCandleLock.Unlock()
+	if !ok {
+		return nil
+	}
+	tc := &tsdbCandles{impl: tsdb, conf: cc}
+	for i, name := range cc.names {
+		series := NewTsdb(tsdb.dataDir, tsdb.table, api.CandleSymbol(tsdb.symbol, name))
+		series.rewrite = true
+		tc.builders = append(tc.builders, &candleBuilder{step: cc.steps[i], series: series, dirty: make(map[int64]bool)})
+	}
+	return tc
+}
+
+func addTick(c *api.FstCandle, price, volume float64) {
+	if c.Count == 0 {
+		c.Open = price
+		c.High = price
+		c.Low = price
+	}
+	if price > c.High {
+		c.High = price
+	}
+	if price < c.Low {
+		c.Low = price
+	}
+	c.Close = price
+	c.Volume += volume
+	c.Count++
+}
+
+func lastValue(tsdb *fstTsdbImpl) (*api.FstTsdbValue, error) {
+	it := tsdb.RangeReverse(math.MinInt64, math.MaxInt64)
+	defer it.Close()
+	if it.Next() {
+		v := it.Value()
+		return &api.FstTsdbValue{Timestamp: v.Timestamp, Data: append([]byte(nil), v.Data...)}, nil
+	}
+	return nil, it.Err()
+}
+
+// buildCandles 从tick序列按step切K线
+func (tsdb *fstTsdbImpl) buildCandles(low, high, step int64, decode api.FstTickDecoder, emit func(c *api.FstCandle) error) error {
+	it := tsdb.Range(low, high)
+	defer it.Close()
+	var bar *api.FstCandle
+	for it.Next() {
+		v := it.Value()
+		start := bucketStart(v.Timestamp, step)
+		if bar != nil && start != bar.Start {
+			if err := emit(bar); err != nil {
+				return err
+			}
+			bar = nil
+		}
+		if bar == nil {
+			bar = &api.FstCandle{Start: start}
+		}
+		price, volume := decode(v.Data)
+		addTick(bar, price, volume)
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	if bar != nil {
+		return emit(bar)
+	}
+	return nil
+}
+
+// writeBar 派生序列里已有的K线直接覆盖, 早于DeleteBefore的返回ErrOutOfOrder
+func writeBar(b *candleBuilder, c *api.FstCandle) error {
+	return b.series.Append(&api.FstTsdbValue{Timestamp: c.Start, Data: api.EncodeCandle(c)})
+}
+
+// rebuild 按tick序列重算一根K线
+func (tc *tsdbCandles) rebuild(b *candleBuilder, start int64) error {
+	return tc.impl.buildCandles(start, start+b.step-1, b.step, tc.conf.decode, func(c *api.FstCandle) error {
+		return writeBar(b, c)
+	})
+}
+
+// load 恢复当前K线; 派生序列落后时补齐中间缺的K线, 更早的历史用BackfillCandles
+func (tc *tsdbCandles) load() error {
+	tc.ready = true
+	last, err := lastValue(tc.impl)
+	if err != nil || last == nil {
+		return err
+	}
+	for _, b := range tc.builders {
+		openStart := bucketStart(last.Timestamp, b.step)
+		from := openStart
+		sealed, err := lastValue(b.series)
+		if err != nil {
+			return err
+		}
+		if sealed != nil && sealed.Timestamp+b.step < openStart {
+			from = sealed.Timestamp + b.step
+		}
+		err = tc.impl.buildCandles(from, last.Timestamp, b.step, tc.conf.decode, func(c *api.FstCandle) error {
+			if c.Start < openStart {
+				return writeBar(b, c)
+			}
+			b.bar = c
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		b.lastTs = last.Timestamp
+	}
+	return nil
+}
+
+// add tick已经写成功后调用, K线出错只记日志, 可以用BackfillCandles修复
+func (tc *tsdbCandles) add(value *api.FstTsdbValue) {
+	price, volume := tc.conf.decode(value.Data)
+	for _, b := range tc.builders {
+		start := bucketStart(value.Timestamp, b.step)
+		switch {
+		case b.bar != nil && start == b.bar.Start:
+			if value.Timestamp <= b.lastTs {
+				b.stale = true
+			}
+		case b.bar == nil || start > b.bar.Start:
+			if b.bar != nil {
+				if err := tc.seal(b); err != nil {
+					common.Logger.Warnf("candle symbol=%s seal failed:%s", b.series.symbol, err)
+				}
+			}
+			b.bar = &api.FstCandle{Start: start}
+		default:
+			b.dirty[start] = true
+			continue
+		}
+		addTick(b.bar, price, volume)
+		if value.Timestamp > b.lastTs {
+			b.lastTs = value.Timestamp
+		}
+	}
+}
+
+func (tc *tsdbCandles) seal(b *candleBuilder) error {
+	bar := b.bar
+	b.bar = nil
+	if !b.stale {
+		return writeBar(b, bar)
+	}
+	// 当前K线里有乱序的tick, 按落盘后的数据重算
+	b.stale = false
+	if err := tc.impl.mergeLate(); err != nil {
+		return err
+	}
+	return tc.rebuild(b, bar.Start)
+}
+
+// close 重算收到过迟到tick的K线, 当前K线不写, 下次打开时从tick恢复
+func (tc *tsdbCandles) close() error {
+	var lastErr error
+	for _, b := range tc.builders {
+		if len(b.dirty) > 0 {
+			if err := tc.impl.mergeLate(); err != nil {
+				lastErr = err
+			}
+		}
+		for start := range b.dirty {
+			if err := tc.rebuild(b, start); err != nil {
+				common.Logger.Warnf("candle symbol=%s rebuild failed:%s", b.series.symbol, err)
+				lastErr = err
+			}
+		}
+		b.dirty = make(map[int64]bool)
+		b.series.Close()
+	}
+	return lastErr
+}
+
+// BackfillCandles 按tick历史补[low, high]里已经结束的K线
+func BackfillCandles(dir, table, symbol string, low, high int64) error {
+	tsdb := NewTsdb(dir, table, symbol)
+	defer tsdb.Close()
+	tc := newCandles(tsdb)
+	if tc == nil {
+		return fmt.Errorf("table %s candles not enabled", table)
+	}
+	defer tc.close()
+	tc.ready = true
+	last, err := lastValue(tsdb)
+	if err != nil || last == nil {
+		return err
+	}
+	for _, b := range tc.builders {
+		hi := bucketStart(last.Timestamp, b.step) - 1
+		if high < hi {
+			hi = bucketStart(high, b.step) + b.step - 1
+		}
+		err = tsdb.buildCandles(bucketStart(low, b.step), hi, b.step, tc.conf.decode, func(c *api.FstCandle) error {
+			return writeBar(b, c)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tsdb *fstTsdbImpl) loadCandles() error {
+	if tsdb.candles == nil || tsdb.candles.ready {
+		return nil
+	}
+	return tsdb.candles.load()
+}
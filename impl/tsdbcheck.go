@@ -0,0 +1,278 @@
+package impl
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// blockRefs 每种类型被引用的block
+type blockRefs map[string]map[BlockAddr]bool
+
+func (refs blockRefs) add(datype string, addr BlockAddr) {
+	refs[datype][BlockAddr{SegNo: addr.SegNo, SegOffset: addr.SegOffset}] = true
+}
+
+func (refs blockRefs) addSymbol(dir, table string, topRef *BlockAddr, numeric bool) error {
+	leaves := make([]BlockAddr, 0)
+	err := walkChain(dir, table, topRef, numeric, func(datype string, addr BlockAddr) {
+		refs.add(datype, addr)
+		if datype == gData_VAL && !numeric {
+			leaves = append(leaves, addr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, leaf := range leaves {
+		if err = leafOverflow(dir, table, leaf, refs.add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkChain 按时间顺序访问symbol的ridx/idx/leaf block, 连续的同一个leaf block只访问一次;
+// 数值序列DeleteBefore之后, 包含下界的chunk起点比下界小, 也要算上
+func walkChain(dir, table string, topRef *BlockAddr, numeric bool, visit func(datype string, addr BlockAddr)) error {
+	addr := &BlockAddr{SegNo: topRef.SegNo, SegOffset: topRef.SegOffset}
+	rBlk := &Block{}
+	iBlk := &Block{}
+	ridx := &TsdbRangIndex{}
+	tidx := &TsdbIndex{}
+	var leaf BlockAddr
+	objSize := tableLayout(table).ObjSize
+	visitLeaf := func(next BlockAddr) {
+		if next != leaf {
+			leaf = next
+			visit(gData_VAL, leaf)
+		}
+	}
+	for addr.SegNo != 0 {
+		if err := loadBlock(addr, dir, table, gData_RIDX, rBlk); err != nil {
+			return err
+		}
+		if rBlk.BH.Len == 0 && *addr != *topRef {
+			break
+		}
+		visit(gData_RIDX, *addr)
+		for k := uint32(0); ((k + 1) * gTSDB_RIDX_LEN) <= rBlk.BH.Len; k++ {
+			if err := ridx.UnmarshalBinary(rBlk.Data[k*gTSDB_RIDX_LEN:]); err != nil {
+				return err
+			}
+			visit(gData_IDX, ridx.Addr)
+			if err := loadBlock(&ridx.Addr, dir, table, gData_IDX, iBlk); err != nil {
+				return err
+			}
+			var hidden *BlockAddr
+			for e := uint32(0); ((e + 1) * gTSDB_IDX_LEN) <= iBlk.BH.Len; e++ {
+				if err := tidx.UnmarshalBinary(iBlk.Data[e*gTSDB_IDX_LEN:]); err != nil {
+					return err
+				}
+				if tidx.Key >= ridx.High {
+					break
+				}
+				next := BlockAddr{SegNo: tidx.Addr.SegNo, SegOffset: getValueSegOff(tidx.Addr.SegOffset, objSize)}
+				// 已删除的部分不算
+				if tidx.Key < ridx.Low {
+					if numeric {
+						hidden = &next
+					}
+					continue
+				}
+				if hidden != nil && tidx.Key > ridx.Low {
+					visitLeaf(*hidden)
+				}
+				hidden = nil
+				visitLeaf(next)
+			}
+			if hidden != nil {
+				visitLeaf(*hidden)
+			}
+		}
+		addr = &BlockAddr{SegNo: rBlk.BH.Next.SegNo, SegOffset: rBlk.BH.Next.SegOffset}
+	}
+	return nil
+}
+
+func (refs blockRefs) addObject(dir, table string, ref *ObjRef) error {
+	addr := &BlockAddr{SegNo: ref.Head.SegNo, SegOffset: ref.Head.SegOffset}
+	blk := &Block{}
+	for addr.SegNo != 0 {
+		refs.add(gData_VAL, *addr)
+		if err := loadBlock(addr, dir, table, gData_VAL, blk); err != nil {
+			return err
+		}
+		addr = &BlockAddr{SegNo: blk.BH.Next.SegNo, SegOffset: blk.BH.Next.SegOffset}
+	}
+	return nil
+}
+
+func loadRefs(dir, table string) (blockRefs, error) {
+	refs := blockRefs{}
+	for _, datype := range gData_Types {
+		refs[datype] = make(map[BlockAddr]bool)
+	}
+	topRefs := make(map[string]*BlockAddr)
+	kinds := make(map[string]bool)
+	objRefs := make([]*ObjRef, 0)
+	err := blotDb.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		return buck.ForEach(func(k, v []byte) error {
+			key := string(k)
+			switch {
+			case strings.HasPrefix(key, "tsdb.num."):
+				kinds[strings.TrimPrefix(key, "tsdb.num.")] = true
+			case strings.HasPrefix(key, "tsdb."):
+				return nil
+			case strings.HasPrefix(key, "fobj."):
+				ref := &ObjRef{}
+				if err := ref.UnmarshalBinary(v); err != nil {
+					return err
+				}
+				objRefs = append(objRefs, ref)
+			default:
+				ref := &BlockAddr{}
+				if err := ref.UnmarshalBinary(v); err != nil {
+					return err
+				}
+				topRefs[key] = ref
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for symbol, ref := range topRefs {
+		if err = refs.addSymbol(dir, table, ref, kinds[symbol]); err != nil {
+			return nil, err
+		}
+	}
+	for _, ref := range objRefs {
+		if err = refs.addObject(dir, table, ref); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// CheckTable 对比空闲表和所有symbol/object的链; repair时回收泄漏的block, 并把被引用的block移出空闲表.
+// 写句柄还没落盘的block看起来像泄漏, 所以有写句柄打开时不能repair
+func CheckTable(dir, table string, repair bool) (*api.FstCheckReport, error) {
+	gWriterLock.Lock()
+	defer gWriterLock.Unlock()
+	if repair && len(gWriters[table]) > 0 {
+		return nil, api.ErrBusy
+	}
+	refs, err := loadRefs(dir, table)
+	if err != nil {
+		return nil, err
+	}
+	report := &api.FstCheckReport{}
+	leaked := make(map[string][]*BlockAddr)
+	conflict := make(map[string][]*BlockAddr)
+	gAlocLock.Lock()
+	err = blotDb.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		for _, datype := range gData_Types {
+			ba, err := getAloc(buck, datype)
+			if err != nil {
+				return err
+			}
+			lay := bucketLayout(buck)
+			size := lay.blockSize(datype)
+			for segNo := uint32(1); segNo <= ba.SegNo; segNo++ {
+				if _, err := os.Stat(fmt.Sprintf(gSeg_Fmt, dir, table, segNo, datype)); err != nil {
+					continue
+				}
+				bits := buck.Get(freeKey(datype, segNo))
+				n := lay.segBlocks(datype)
+				if segNo == ba.SegNo {
+					n = ba.AlocLen / size
+				}
+				for i := uint32(0); i < n; i++ {
+					addr := BlockAddr{SegNo: segNo, SegOffset: i * size}
+					free := (bits != nil) && (bits[i/8]&(1<<(i%8)) != 0)
+					live := refs[datype][addr]
+					delete(refs[datype], addr)
+					switch {
+					case live && free:
+						report.Conflict++
+						conflict[datype] = append(conflict[datype], &addr)
+					case live:
+						report.Live++
+					case free:
+						report.Free++
+					default:
+						report.Leaked++
+						leaked[datype] = append(leaked[datype], &addr)
+					}
+				}
+			}
+			// 剩下的引用都在已删除的segment里
+			for addr := range refs[datype] {
+				common.Logger.Warnf("check table=%s, %s seg=%d,off=%d is missing", table, datype, addr.SegNo, addr.SegOffset)
+				report.Missing++
+			}
+		}
+		return nil
+	})
+	gAlocLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	common.Logger.Infof("check table=%s, report=%+v", table, *report)
+	if !repair || (report.Leaked == 0 && report.Conflict == 0) {
+		return report, nil
+	}
+	if err = unfreeBlocks(table, conflict); err != nil {
+		return nil, err
+	}
+	if err = freeBlocks(dir, table, leaked); err != nil {
+		return nil, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// unfreeBlocks 把还被引用的block移出空闲表
+func unfreeBlocks(table string, addrs map[string][]*BlockAddr) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	gAlocLock.Lock()
+	defer gAlocLock.Unlock()
+	return blotDb.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		for datype, list := range addrs {
+			size := bucketLayout(buck).blockSize(datype)
+			for _, addr := range list {
+				key := freeKey(datype, addr.SegNo)
+				bits := append([]byte(nil), buck.Get(key)...)
+				if len(bits) == 0 {
+					continue
+				}
+				i := addr.SegOffset / size
+				bits[i/8] &^= 1 << (i % 8)
+				if err := buck.Put(key, bits); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
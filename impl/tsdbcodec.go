@@ -0,0 +1,179 @@
+package impl
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+// 压缩的block: 头里Len的高8位是codec id, Len仍然是解压后的长度; 数据区是4字节压缩长度加压缩数据.
+// 只压缩写满换块的leaf block, 正在写的尾block不压缩
+var (
+	gCODEC_SHIFT = 24
+	gCODEC_MASK  = uint32(1<<24 - 1)
+	gCODEC_H_LEN = uint32(4)
+)
+
+var gCodecLock sync.RWMutex
+var gCodecs = map[uint8]api.FstCodec{api.CODEC_ID_FLATE: &flateCodec{}}
+var gTableCodecs = make(map[string]uint8)
+
+// RegisterCodec 在StartDb之前注册外部实现的压缩算法
+func RegisterCodec(c api.FstCodec) error {
+	if c.Id() == api.CODEC_ID_NONE {
+		return fmt.Errorf("codec %s: id 0 is reserved", c.Name())
+	}
+	gCodecLock.Lock()
+	defer gCodecLock.Unlock()
+	if old, ok := gCodecs[c.Id()]; ok && old.Name() != c.Name() {
+		return fmt.Errorf("codec %s: id %d is used by %s", c.Name(), c.Id(), old.Name())
+	}
+	gCodecs[c.Id()] = c
+	return nil
+}
+
+func getCodec(id uint8) (api.FstCodec, error) {
+	gCodecLock.RLock()
+	defer gCodecLock.RUnlock()
+	c, ok := gCodecs[id]
+	if !ok {
+		return nil, fmt.Errorf("codec id=%d is not registered", id)
+	}
+	return c, nil
+}
+
+// loadCodecs 按配置找到每个table的codec
+func loadCodecs(c *api.TsdbConf) error {
+	gCodecLock.Lock()
+	defer gCodecLock.Unlock()
+	tables := make(map[string]uint8)
+	for table, tc := range c.Tables {
+		if tc.Codec == "" || tc.Codec == api.CODEC_NONE {
+			continue
+		}
+		found := false
+		for id, codec := range gCodecs {
+			if codec.Name() == tc.Codec {
+				tables[table] = id
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("table %s unknown codec:%s", table, tc.Codec)
+		}
+	}
+	gTableCodecs = tables
+	return nil
+}
+
+func tableCodec(table string) uint8 {
+	gCodecLock.RLock()
+	defer gCodecLock.RUnlock()
+	return gTableCodecs[table]
+}
+
+// encodeBlock 返回要写盘的数据, 压缩后没有变小时按不压缩写
+func encodeBlock(blk *Block) ([]byte, error) {
+	if blk.BH.Codec != api.CODEC_ID_NONE {
+		codec, err := getCodec(blk.BH.Codec)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, gBH_LEN+gCODEC_H_LEN, len(blk.Data))
+		buf, err = codec.Encode(buf, blk.Data[:blk.BH.Len])
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(buf)) < gBH_LEN+blk.BH.Len && len(buf) <= int(gBH_LEN)+len(blk.Data) {
+			bh, _ := blk.BH.MarshalBinary()
+			copy(buf, bh)
+			binary.LittleEndian.PutUint32(buf[gBH_LEN:], uint32(len(buf))-gBH_LEN-gCODEC_H_LEN)
+			sealBlock(buf)
+			return buf, nil
+		}
+		common.Logger.Debugf("codec=%s, len=%d is not compressible", codec.Name(), blk.BH.Len)
+		blk.BH.Codec = api.CODEC_ID_NONE
+	}
+	buf, err := blk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	sealBlock(buf)
+	return buf, nil
+}
+
+// decodeBlock 读出来的block是压缩的就解压到Data
+func decodeBlock(blk *Block) error {
+	if blk.BH.Codec == api.CODEC_ID_NONE {
+		return nil
+	}
+	codec, err := getCodec(blk.BH.Codec)
+	if err != nil {
+		return err
+	}
+	cLen := binary.LittleEndian.Uint32(blk.Data)
+	if gCODEC_H_LEN+cLen > uint32(len(blk.Data)) || blk.BH.Len > uint32(len(blk.Data)) {
+		return fmt.Errorf("codec=%s, bad block len=%d, compressed=%d", codec.Name(), blk.BH.Len, cLen)
+	}
+	data := make([]byte, len(blk.Data))
+	out, err := codec.Decode(data[:0], blk.Data[gCODEC_H_LEN:gCODEC_H_LEN+cLen])
+	if err != nil {
+		return err
+	}
+	if uint32(len(out)) != blk.BH.Len {
+		return fmt.Errorf("codec=%s, decoded len=%d, want %d", codec.Name(), len(out), blk.BH.Len)
+	}
+	// 超出容量时Decode会换新的buffer
+	copy(data, out)
+	blk.Data = data
+	return nil
+}
+
+// flateCodec 标准库的deflate, 不需要额外的依赖
+type flateCodec struct{}
+
+var gFlatePool = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+func (c *flateCodec) Id() uint8 {
+	return api.CODEC_ID_FLATE
+}
+
+func (c *flateCodec) Name() string {
+	return api.CODEC_FLATE
+}
+
+func (c *flateCodec) Encode(dst, src []byte) ([]byte, error) {
+	out := bytes.NewBuffer(dst)
+	w := gFlatePool.Get().(*flate.Writer)
+	defer gFlatePool.Put(w)
+	w.Reset(out)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (c *flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	out := bytes.NewBuffer(dst)
+	if _, err := io.Copy(out, r); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,188 @@
+package impl
+
+import (
+	"errors"
+	"math"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+func compactKey(table, symbol string) string {
+	return table + "/" + symbol
+}
+
+// CompactSymbol 把symbol的数据重写到连续分配的block里, 落盘后替换topRef, 旧的block等读结束后回收.
+// 共用写句柄的数据先落盘, compact期间新的写入等待, 读不受影响; 已经在compact或者别的目录有写句柄时返回ErrBusy
+func CompactSymbol(dir, table, symbol string) error {
+	key := compactKey(table, symbol)
+	db := NewTsdb(dir, table, symbol)
+	defer db.Close()
+	s := db.getSeries()
+	s.lock.Lock()
+	if w := s.writer; w != nil && w.appender != nil {
+		if err := w.closeAppender(); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+	gWriterLock.Lock()
+	if isBusy(dir, table, symbol) {
+		gWriterLock.Unlock()
+		s.lock.Unlock()
+		return api.ErrBusy
+	}
+	gCompacting[key] = true
+	gWriterLock.Unlock()
+	s.lock.Unlock()
+	defer func() {
+		gWriterLock.Lock()
+		delete(gCompacting, key)
+		gWriterCond.Broadcast()
+		gWriterLock.Unlock()
+	}()
+	// 这期间没有写句柄, 不经过series的锁
+	return db.inner().compact()
+}
+
+// waitCompact 写入在拿series的锁之前等compact结束, 不然等待期间读也会被挡住
+func waitCompact(table, symbol string) {
+	key := compactKey(table, symbol)
+	gWriterLock.Lock()
+	for gCompacting[key] {
+		gWriterCond.Wait()
+	}
+	gWriterLock.Unlock()
+}
+
+func (tsdb *fstTsdbImpl) compact() error {
+	topRef := &BlockAddr{}
+	if err := getTsData(tsdb.table, tsdb.symbol, topRef); err != nil {
+		if errors.Is(err, api.ErrEmpty) {
+			return nil
+		}
+		return err
+	}
+	floor, err := getFloor(tsdb)
+	if err != nil {
+		return err
+	}
+	kind, err := tsdb.getKind()
+	if err != nil {
+		return err
+	}
+	// 第一遍算出需要多少block, 一次分配; 数值序列按原来的chunk估算
+	p := newBlockPlan(tsdb.layout())
+	cnt := 0
+	it := tsdb.newIter(floor, math.MaxInt64, false)
+	it.raw = true
+	for it.Next() {
+		if err = p.add(len(it.Value().Data)); err != nil {
+			break
+		}
+		cnt++
+	}
+	it.Close()
+	if err == nil {
+		err = it.Err()
+	}
+	if err != nil || cnt == 0 {
+		return err
+	}
+	p.saveRidx()
+	for datype := range p.need {
+		p.need[datype]++
+	}
+	addrs, err := allocRun(tsdb.dataDir, tsdb.table, p.need)
+	if err != nil {
+		return err
+	}
+	ta := &tsdbAppender{impl: tsdb, topRef: addrs[gData_RIDX][0]}
+	ta.ridxCache = newBlockCache(gData_RIDX, nil, addrs[gData_RIDX][0], tsdb)
+	ta.idxCache = newBlockCache(gData_IDX, nil, addrs[gData_IDX][0], tsdb)
+	ta.datCache = newBlockCache(gData_VAL, nil, addrs[gData_VAL][0], tsdb)
+	ta.ridxCache.spare = addrs[gData_RIDX][1:]
+	ta.idxCache.spare = addrs[gData_IDX][1:]
+	ta.datCache.spare = addrs[gData_VAL][1:]
+	if floor != math.MinInt64 {
+		// 保留DeleteBefore设置的下界
+		low := uint64(floor)
+		ta.headLow = &low
+	}
+	// 第二遍复制, 这期间没有写, 数据和第一遍一样
+	it = tsdb.newIter(floor, math.MaxInt64, false)
+	for it.Next() {
+		if err = ta.appendData(it.Value()); err != nil {
+			break
+		}
+	}
+	it.Close()
+	if err == nil {
+		err = it.Err()
+	}
+	if err != nil {
+		// 新的block还没有被引用
+		common.Logger.Warnf("compact symbol=%s failed:%s", tsdb.symbol, err)
+		return errors.Join(err, freeBlocks(tsdb.dataDir, tsdb.table, addrs))
+	}
+	// flush最后保存topRef, 之后的读都走新的链, 多分配的block一起回收
+	spare := len(ta.datCache.spare)
+	if err = ta.flush(); err != nil {
+		return err
+	}
+	old := map[string][]*BlockAddr{}
+	if err = walkChain(tsdb.dataDir, tsdb.table, topRef, kind != 0, collectTo(old)); err != nil {
+		return err
+	}
+	// 大数据复制时写了新的ovf链, 数值序列没有ovf
+	for i := 0; kind == 0 && i < len(old[gData_VAL]); i++ {
+		if err = leafOverflow(tsdb.dataDir, tsdb.table, *old[gData_VAL][i], collectTo(old)); err != nil {
+			return err
+		}
+	}
+	common.Logger.Infof("compact symbol=%s, values=%d, leaf=%d->%d", tsdb.symbol, cnt, len(old[gData_VAL]), len(addrs[gData_VAL])-spare)
+	return retireBlocks(tsdb.dataDir, tsdb.table, old)
+}
+
+// fragmentation leaf block中和前一个block不相邻的比例
+func fragmentation(dir, table, symbol string) (float64, error) {
+	topRef := &BlockAddr{}
+	if err := getTsData(table, symbol, topRef); err != nil {
+		if errors.Is(err, api.ErrEmpty) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	db := NewTsdb(dir, table, symbol)
+	kind, err := db.getKind()
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+	var last BlockAddr
+	blocks, gaps := 0, 0
+	objSize := tableLayout(table).ObjSize
+	err = walkChain(dir, table, topRef, kind != 0, func(datype string, addr BlockAddr) {
+		if datype != gData_VAL {
+			return
+		}
+		if blocks > 0 && (addr.SegNo != last.SegNo || addr.SegOffset != last.SegOffset+objSize) {
+			gaps++
+		}
+		last = addr
+		blocks++
+	})
+	if err != nil || blocks < 2 {
+		return 0, err
+	}
+	return float64(gaps) / float64(blocks-1), nil
+}
+
+func compactIfFragmented(dir, table, symbol string, ratio float64) error {
+	frag, err := fragmentation(dir, table, symbol)
+	if err != nil || frag < ratio {
+		return err
+	}
+	common.Logger.Infof("compact table=%s, symbol=%s, fragmentation=%.2f", table, symbol, frag)
+	return CompactSymbol(dir, table, symbol)
+}
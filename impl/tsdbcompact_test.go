@@ -0,0 +1,81 @@
+package impl
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+// appendInterleaved 两个symbol交替写, a的block和b的block穿插在一起
+func appendInterleaved(t *testing.T, dir string, n int64) {
+	t.Helper()
+	a, b := NewTsdb(dir, "t", "a"), NewTsdb(dir, "t", "b")
+	for ts := int64(1); ts <= n; ts += 100 {
+		appendValues(t, a, ts, ts+99)
+		appendValues(t, b, ts, ts+99)
+	}
+	a.Close()
+	b.Close()
+}
+
+func TestCompactWhileReading(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	appendInterleaved(t, dir, 30000)
+	frag, err := fragmentation(dir, "t", "a")
+	if err != nil || frag < 0.3 {
+		t.Fatal(err, frag)
+	}
+	r := NewTsdb(dir, "t", "a")
+	defer r.Close()
+	it := r.Range(math.MinInt64, math.MaxInt64)
+	ts := int64(1)
+	for ; ts <= 5000 && it.Next(); ts++ {
+		if it.Value().Timestamp != ts {
+			t.Fatal("before compact", it.Value().Timestamp, ts)
+		}
+	}
+	if err = CompactSymbol(dir, "t", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if frag, err = fragmentation(dir, "t", "a"); err != nil || frag > 0.01 {
+		t.Fatal(err, frag)
+	}
+	// 打开的迭代器还在读旧链, 旧的block等它结束才回收
+	for ; it.Next(); ts++ {
+		if v := it.Value(); v.Timestamp != ts || string(v.Data) != string(testValue(ts)) {
+			t.Fatal("after compact", v.Timestamp, ts)
+		}
+	}
+	if it.Err() != nil || ts != 30001 {
+		t.Fatal(it.Err(), ts)
+	}
+	it.Close()
+	checkValues(t, dir, "t", "a", 30000)
+	checkValues(t, dir, "t", "b", 30000)
+	checkTable(t, dir, "t")
+}
+
+func TestCompactBusy(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	appendInterleaved(t, dir, 1000)
+	gWriterLock.Lock()
+	gCompacting[compactKey("t", "a")] = true
+	gWriterLock.Unlock()
+	if err := CompactSymbol(dir, "t", "a"); !errors.Is(err, api.ErrBusy) {
+		t.Fatal(err)
+	}
+	if err := NewTsdb(dir, "t", "a").DeleteBefore(10); !errors.Is(err, api.ErrBusy) {
+		t.Fatal(err)
+	}
+	gWriterLock.Lock()
+	delete(gCompacting, compactKey("t", "a"))
+	gWriterCond.Broadcast()
+	gWriterLock.Unlock()
+	if err := CompactSymbol(dir, "t", "a"); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, dir, "t", "a", 1000)
+	checkTable(t, dir, "t")
+}
@@ -0,0 +1,95 @@
+package impl
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/tao/faststore/api"
+)
+
+// block头: Pre(8) Next(8) Len(4, 高8位是codec) Ver(1) 保留(3) Sum(4).
+// Sum是CRC32C, 覆盖头的前24字节和实际写盘的数据: 不压缩时是Len字节, 压缩时是4字节压缩长度加压缩数据.
+// 这个头是数据格式版本2(gFORMAT_VER)定下来的, 改头的长度或者校验方式要升格式版本, 见gFormatBhLen
+var (
+	gBH_VER     = uint8(1)
+	gBH_VER_OFF = 20
+	gBH_SUM_OFF = 24
+	// 日志帧: 4字节长度, 4字节CRC32C, 然后是记录
+	gLOG_H_LEN = uint32(8)
+)
+
+var gCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, gCrcTable)
+}
+
+// storedLen 返回写盘数据区的有效长度, 超出block时ok为false
+func storedLen(raw []byte) (dLen uint32, ok bool) {
+	lv := binary.LittleEndian.Uint32(raw[16:])
+	dLen = lv & gCODEC_MASK
+	if uint8(lv>>gCODEC_SHIFT) != api.CODEC_ID_NONE {
+		if uint32(len(raw)) < gBH_LEN+gCODEC_H_LEN {
+			return 0, false
+		}
+		dLen = gCODEC_H_LEN + binary.LittleEndian.Uint32(raw[gBH_LEN:])
+	}
+	return dLen, uint64(gBH_LEN)+uint64(dLen) <= uint64(len(raw))
+}
+
+func blockSum(raw []byte, dLen uint32) uint32 {
+	sum := crc32.Update(0, gCrcTable, raw[:gBH_SUM_OFF])
+	return crc32.Update(sum, gCrcTable, raw[gBH_LEN:gBH_LEN+dLen])
+}
+
+// sealBlock 写盘前填上版本和校验和
+func sealBlock(raw []byte) {
+	raw[gBH_VER_OFF] = gBH_VER
+	dLen, ok := storedLen(raw)
+	if !ok {
+		dLen = uint32(len(raw)) - gBH_LEN
+	}
+	binary.LittleEndian.PutUint32(raw[gBH_SUM_OFF:], blockSum(raw, dLen))
+}
+
+// emptyHeader 回收的block写回一个校验过的空头, 数据区不清
+func emptyHeader() []byte {
+	raw := make([]byte, gBH_LEN)
+	sealBlock(raw)
+	return raw
+}
+
+// verifyBlock 校验读出来的block; 全0的只能是还没写过的block, 数据区也必须是0
+func verifyBlock(raw []byte, addr *BlockAddr, table, datype string) error {
+	corrupt := func(reason string) error {
+		return &api.CorruptError{Table: table, Type: datype, Segment: addr.SegNo, Offset: int64(addr.SegOffset), Reason: reason}
+	}
+	if uint32(len(raw)) < gBH_LEN {
+		return corrupt("short block")
+	}
+	switch raw[gBH_VER_OFF] {
+	case gBH_VER:
+	case 0:
+		for _, b := range raw[:gBH_LEN] {
+			if b != 0 {
+				return corrupt("header version 0")
+			}
+		}
+		for _, b := range raw[gBH_LEN:] {
+			if b != 0 {
+				return corrupt("zero header with data")
+			}
+		}
+		return nil
+	default:
+		return corrupt("unknown header version")
+	}
+	dLen, ok := storedLen(raw)
+	if !ok {
+		return corrupt("length out of block")
+	}
+	if blockSum(raw, dLen) != binary.LittleEndian.Uint32(raw[gBH_SUM_OFF:]) {
+		return corrupt("checksum mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func TestVerifyBlock(t *testing.T) {
+	raw := make([]byte, 4096)
+	addr := &BlockAddr{SegNo: 1, SegOffset: 4096}
+	// 还没写过的block
+	if err := verifyBlock(raw, addr, "t", gData_VAL); err != nil {
+		t.Fatal(err)
+	}
+	raw[100] = 1
+	var corrupt *api.CorruptError
+	if err := verifyBlock(raw, addr, "t", gData_VAL); !errors.As(err, &corrupt) || corrupt.Segment != 1 || corrupt.Offset != 4096 {
+		t.Fatal(err)
+	}
+	copy(raw, emptyHeader())
+	if err := verifyBlock(raw, addr, "t", gData_VAL); err != nil {
+		t.Fatal(err)
+	}
+	copy(raw[gBH_LEN:], "data")
+	raw[16] = 4
+	sealBlock(raw)
+	if err := verifyBlock(raw, addr, "t", gData_VAL); err != nil {
+		t.Fatal(err)
+	}
+	raw[gBH_LEN+1]++
+	if err := verifyBlock(raw, addr, "t", gData_VAL); !errors.As(err, &corrupt) || corrupt.Reason != "checksum mismatch" {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckTableCorrupt(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 1000)
+	db.Close()
+	topRef := &BlockAddr{}
+	if err := getTsData("t", "s", topRef); err != nil {
+		t.Fatal(err)
+	}
+	// 停掉再改盘上的数据, 不让块缓存挡住
+	c := gConf
+	StopDb()
+	f, err := os.OpenFile(fmt.Sprintf(gSeg_Fmt, dir, "t", topRef.SegNo, gData_RIDX), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, 1)
+	off := int64(topRef.SegOffset) + int64(gBH_LEN)
+	if _, err = f.ReadAt(raw, off); err == nil {
+		raw[0] ^= 0xff
+		_, err = f.WriteAt(raw, off)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = StartDb(c); err != nil {
+		t.Fatal(err)
+	}
+	// FsCheck就是CheckTable
+	var corrupt *api.CorruptError
+	if _, err = CheckTable(dir, "t", false); !errors.As(err, &corrupt) || !errors.Is(err, api.ErrCorrupt) ||
+		corrupt.Type != gData_RIDX || corrupt.Segment != topRef.SegNo || corrupt.Offset != int64(topRef.SegOffset) {
+		t.Fatal(err)
+	}
+	it := NewTsdb(dir, "t", "s").Range(math.MinInt64, math.MaxInt64)
+	for it.Next() {
+	}
+	if !errors.Is(it.Err(), api.ErrCorrupt) {
+		t.Fatal(it.Err())
+	}
+	it.Close()
+}
@@ -0,0 +1,115 @@
+package impl
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+var (
+	gCURSOR_VER = byte(1)
+	gCURSOR_LEN = 21
+)
+
+// tsdbCursor 记录上一页最后一个数据之后的位置, Off之前的一个数据就是LastTs
+type tsdbCursor struct {
+	Addr   BlockAddr
+	Off    uint32
+	LastTs int64
+}
+
+func (c *tsdbCursor) encode() string {
+	buf := make([]byte, gCURSOR_LEN)
+	lwd := binary.LittleEndian
+	buf[0] = gCURSOR_VER
+	lwd.PutUint32(buf[1:], c.Addr.SegNo)
+	lwd.PutUint32(buf[5:], c.Addr.SegOffset)
+	lwd.PutUint32(buf[9:], c.Off)
+	lwd.PutUint64(buf[13:], uint64(c.LastTs))
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(token string) (*tsdbCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != gCURSOR_LEN || buf[0] != gCURSOR_VER {
+		return nil, api.ErrInvalidCursor
+	}
+	lwd := binary.LittleEndian
+	c := &tsdbCursor{}
+	c.Addr.SegNo = lwd.Uint32(buf[1:])
+	c.Addr.SegOffset = lwd.Uint32(buf[5:])
+	c.Off = lwd.Uint32(buf[9:])
+	c.LastTs = int64(lwd.Uint64(buf[13:]))
+	return c, nil
+}
+
+func (tsdb *fstTsdbImpl) GetPage(low, high int64, cursor string, limit int) (*api.FstTsdbPage, error) {
+	if limit <= 0 {
+		limit = api.DEF_LIMIT
+	}
+	it := tsdb.newIter(low, high, false)
+	defer it.Close()
+	if cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.LastTs >= it.low {
+			it.low = c.LastTs + 1
+		}
+		it.rd = resumeLeaf(it.impl, c)
+	}
+	page := &api.FstTsdbPage{Values: make([]api.FstTsdbValue, 0, limit)}
+	for len(page.Values) < limit && it.Next() {
+		page.Values = append(page.Values, *it.Value())
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+	if len(page.Values) == limit && !it.done {
+		c := &tsdbCursor{LastTs: page.Values[limit-1].Timestamp}
+		// 数值序列可能停在chunk中间, 和迟到数据归并时可能多读了一个数据, 下一页都通过索引定位
+		if it.rd != nil && it.kind == 0 && !it.pend {
+			c.Addr, c.Off = it.rd.addr, it.rd.readOff
+		}
+		page.Cursor = c.encode()
+	}
+	return page, nil
+}
+
+// resumeLeaf 先用索引定位LastTs, 定位到的block就是游标里的block时才从Off继续;
+// block可能已经回收给别的symbol或者被改写, 不一致时从定位的位置往后读, 小于low的数据会跳过
+func resumeLeaf(impl *fstTsdbImpl, c *tsdbCursor) *tsdbRDCache {
+	if c.Addr.SegNo == 0 || c.Off == 0 {
+		return nil
+	}
+	rd, err := seekLeaf(impl, c.LastTs)
+	if err != nil {
+		return nil
+	}
+	if rd.addr != c.Addr || !atCursor(rd.block, c) {
+		common.Logger.Infof("cursor seg=%d,off=%d is stale, seek %d", c.Addr.SegNo, c.Addr.SegOffset, c.LastTs)
+		return rd
+	}
+	rd.readOff = c.Off
+	return rd
+}
+
+// atCursor Off必须是数据边界, 并且前一个数据的时间戳是LastTs
+func atCursor(blk *Block, c *tsdbCursor) bool {
+	if c.Off > blk.BH.Len {
+		return false
+	}
+	off, pre := uint32(0), uint32(0)
+	for off < c.Off {
+		pre = off
+		vLen, _ := valueLen(blk.Data[off:])
+		off += gBLK_V_H_LEN + vLen
+	}
+	if off != c.Off || (pre+gBLK_V_H_LEN+uint32(gBLK_K_LEN)) > off {
+		return false
+	}
+	return int64(binary.LittleEndian.Uint64(blk.Data[pre+gBLK_V_H_LEN:])) == c.LastTs
+}
@@ -0,0 +1,215 @@
+package impl
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 打开的seg文件按文件名复用, ReadAt/WriteAt可以并发; 超过上限时关掉最久没用的,
+// 正在用的等最后一个调用结束再关. 删除或者重建segment之前要先dropSeg
+var gDEF_OPEN_FILES = 256
+
+type segFile struct {
+	*os.File
+	name    string
+	refs    int
+	dropped bool
+	el      *list.Element
+	// mmap模式下第一次读封口的segment时映射整个文件, 关文件时解除
+	mapOnce sync.Once
+	mm      []byte
+}
+
+type fdPool struct {
+	lock  sync.Mutex
+	limit int
+	lru   *list.List
+	files map[string]*segFile
+	mmap  bool
+	// 每个table/类型正在分配的segment, 比它小的都已经封口
+	tailLock sync.RWMutex
+	tails    map[string]uint32
+}
+
+var gFdPool = makeFdPool(gDEF_OPEN_FILES)
+
+func makeFdPool(limit int) *fdPool {
+	return &fdPool{limit: limit, lru: list.New(), files: make(map[string]*segFile), tails: make(map[string]uint32)}
+}
+
+// initFdPool MaxOpenFiles为0时用默认值, ReadMode为空时用pread
+func initFdPool(c *api.TsdbConf) error {
+	limit := gDEF_OPEN_FILES
+	mode := api.READ_PREAD
+	if c != nil && c.MaxOpenFiles > 0 {
+		limit = c.MaxOpenFiles
+	}
+	if c != nil && c.ReadMode != "" {
+		mode = c.ReadMode
+	}
+	p := makeFdPool(limit)
+	switch mode {
+	case api.READ_PREAD:
+	case api.READ_MMAP:
+		p.mmap = gMmapOk
+		if !p.mmap {
+			common.Logger.Warnf("read mode=%s is not supported, use %s", mode, api.READ_PREAD)
+		}
+	default:
+		return fmt.Errorf("unknown read mode=%s", mode)
+	}
+	gFdPool = p
+	return nil
+}
+
+// openSeg 用完调用release
+func openSeg(name string) (*segFile, error) {
+	p := gFdPool
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if sf, ok := p.files[name]; ok {
+		sf.refs++
+		p.lru.MoveToFront(sf.el)
+		return sf, nil
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0755)
+	if os.IsPermission(err) {
+		// 只读的数据目录
+		f, err = os.OpenFile(name, os.O_RDONLY, 0755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sf := &segFile{File: f, name: name, refs: 1}
+	sf.el = p.lru.PushFront(sf)
+	p.files[name] = sf
+	for p.lru.Len() > p.limit {
+		p.remove(p.lru.Back().Value.(*segFile))
+	}
+	return sf, nil
+}
+
+func (sf *segFile) release() {
+	p := gFdPool
+	p.lock.Lock()
+	sf.refs--
+	closeNow := sf.dropped && sf.refs == 0
+	p.lock.Unlock()
+	if closeNow {
+		sf.close()
+	}
+}
+
+func (sf *segFile) close() {
+	if sf.mm != nil {
+		if err := munmapSeg(sf.mm); err != nil {
+			common.Logger.Warnf("munmap name=%s failed:%s", sf.name, err)
+		}
+		sf.mm = nil
+	}
+	sf.File.Close()
+}
+
+// mapped mmap模式下返回封口segment里这个block的映射, 否则返回nil走pread.
+// 映射只在release之前有效, 要继续引用时通过holdSeg把引用交给pin
+func (sf *segFile) mapped(addr *BlockAddr, size uint32, table, datype string) []byte {
+	if !gFdPool.mmap || addr.SegNo >= segTail(table, datype) {
+		return nil
+	}
+	sf.mapOnce.Do(func() {
+		st, err := sf.Stat()
+		if err == nil {
+			sf.mm, err = mmapSeg(sf.File, int(st.Size()))
+		}
+		if err != nil {
+			common.Logger.Infof("mmap name=%s failed, use pread:%s", sf.name, err)
+		}
+	})
+	end := uint64(addr.SegOffset) + uint64(size)
+	if end > uint64(len(sf.mm)) {
+		return nil
+	}
+	return sf.mm[addr.SegOffset:end]
+}
+
+// segTail 第一次用时从bolt里取分配位置, 之后由allocTail更新
+func segTail(table, datype string) uint32 {
+	p := gFdPool
+	key := table + "/" + datype
+	p.tailLock.RLock()
+	segNo, ok := p.tails[key]
+	p.tailLock.RUnlock()
+	if ok || blotDb == nil {
+		return segNo
+	}
+	_ = blotDb.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		ba, err := getAloc(buck, datype)
+		if err == nil {
+			segNo = ba.SegNo
+		}
+		return err
+	})
+	setSegTail(table, datype, segNo)
+	return segNo
+}
+
+// setSegTail 只会变大, 封口的segment不会再变回尾segment
+func setSegTail(table, datype string, segNo uint32) {
+	p := gFdPool
+	key := table + "/" + datype
+	p.tailLock.Lock()
+	if cur, ok := p.tails[key]; !ok || segNo > cur {
+		p.tails[key] = segNo
+	}
+	p.tailLock.Unlock()
+}
+
+// remove 调用时持有锁
+func (p *fdPool) remove(sf *segFile) {
+	if sf.dropped {
+		return
+	}
+	sf.dropped = true
+	p.lru.Remove(sf.el)
+	if p.files[sf.name] == sf {
+		delete(p.files, sf.name)
+	}
+	if sf.refs == 0 {
+		sf.close()
+	}
+}
+
+// dropSeg 删除或者重建seg文件之前关掉缓存的句柄
+func dropSeg(name string) {
+	p := gFdPool
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if sf, ok := p.files[name]; ok {
+		p.remove(sf)
+	}
+}
+
+// closeSegs StopDb时关掉所有句柄
+func closeSegs() {
+	p := gFdPool
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	n := p.lru.Len()
+	for p.lru.Len() > 0 {
+		p.remove(p.lru.Back().Value.(*segFile))
+	}
+	p.tailLock.Lock()
+	p.tails = make(map[string]uint32)
+	p.tailLock.Unlock()
+	common.Logger.Debugf("close seg files=%d", n)
+}
@@ -0,0 +1,89 @@
+package impl
+
+import (
+	"math"
+	"testing"
+	"unsafe"
+
+	"github.com/tao/faststore/api"
+)
+
+// inMapping data是不是某个seg文件映射里的切片
+func inMapping(data []byte) bool {
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(data)))
+	gFdPool.lock.Lock()
+	defer gFdPool.lock.Unlock()
+	for _, sf := range gFdPool.files {
+		if len(sf.mm) == 0 {
+			continue
+		}
+		base := uintptr(unsafe.Pointer(unsafe.SliceData(sf.mm)))
+		if p >= base && p+uintptr(len(data)) <= base+uintptr(len(sf.mm)) {
+			return true
+		}
+	}
+	return false
+}
+
+func heldSegs(table string) int {
+	gPinLock.Lock()
+	defer gPinLock.Unlock()
+	return len(getPins(table).held)
+}
+
+func TestMmapNoCopy(t *testing.T) {
+	if !gMmapOk {
+		t.Skip("mmap is not supported")
+	}
+	dir := startTestDb(t, &api.TsdbConf{CacheMB: -1, ReadMode: api.READ_MMAP,
+		Tables: map[string]api.TableConf{"t": {SegmentSize: 64 << 10, LeafBlock: 4 << 10, IdxBlock: 4 << 10, RidxBlock: 4 << 10}}})
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 20000)
+	db.Close()
+	if segTail("t", gData_VAL) < 2 {
+		t.Fatal("no sealed segment")
+	}
+	db = NewTsdb(dir, "t", "s")
+	defer db.Close()
+	mapped, n := 0, int64(0)
+	if err := db.Scan(math.MinInt64, math.MaxInt64, func(ts int64, data []byte) error {
+		if n++; ts != n || string(data) != string(testValue(ts)) {
+			t.Fatal("scan", ts, n)
+		}
+		if inMapping(data) {
+			mapped++
+		}
+		return nil
+	}); err != nil || n != 20000 {
+		t.Fatal(err, n)
+	}
+	if mapped == 0 || heldSegs("t") != 0 {
+		t.Fatal("scan mapped", mapped, heldSegs("t"))
+	}
+	it := db.RangeNoCopy(math.MinInt64, math.MaxInt64)
+	mapped, n, held := 0, int64(0), 0
+	for it.Next() {
+		if held == 0 {
+			held = heldSegs("t")
+		}
+		if n++; it.Value().Timestamp != n {
+			t.Fatal("range", it.Value().Timestamp, n)
+		}
+		if inMapping(it.Value().Data) {
+			mapped++
+		}
+	}
+	it.Close()
+	// 读结束后映射的引用交还给文件池
+	if mapped == 0 || held == 0 {
+		t.Fatal("range mapped", mapped, held)
+	}
+	if heldSegs("t") != 0 {
+		t.Fatal("held", heldSegs("t"))
+	}
+	// 复制读不引用映射
+	l, err := db.GetBetween(1, 100, 0)
+	if err != nil || l.Len() != 100 || inMapping(l.Front().Value.(*api.FstTsdbValue).Data) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,290 @@
+package impl
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 数据目录下的superblock和每个table bucket里的tsdb.format记录格式版本和block大小.
+// 版本1是加格式记录之前的数据: block头20字节没有校验和, 日志帧头只有4字节长度
+var (
+	gFORMAT_VER       = uint32(2)
+	gFORMAT_LEGACY    = uint32(1)
+	gFORMAT_LEN       = uint32(40)
+	gFORMAT_MAGIC     = []byte("FSTF")
+	gLEGACY_BH_LEN    = uint32(20)
+	gLEGACY_LOG_H_LEN = uint32(4)
+	gFormat_File      = "%s/superblock"
+	gFormat_Key       = "tsdb.format"
+	// Len的高8位是codec, block不能超过16MB; segment内偏移是uint32
+	gBLK_MIN_SIZE = uint32(4 << 10)
+	gBLK_MAX_SIZE = uint32(8 << 20)
+	gSEG_MAX_SIZE = uint32(1 << 31)
+)
+
+// gFormatBhLen 每个格式版本的block头长度: 版本2给block头加了校验和, 从20字节变成gBH_LEN.
+// 改block头或者日志帧头都要升gFORMAT_VER并在这里登记, 旧版本的目录由checkFormat拦下来, 用MigrateDir升级
+var gFormatBhLen = map[uint32]uint32{
+	gFORMAT_LEGACY: gLEGACY_BH_LEN,
+	gFORMAT_VER:    gBH_LEN,
+}
+
+// 每个table的block和segment大小建表时定下来, 记在tsdb.format里
+var gLayoutLock sync.RWMutex
+var gLayouts = make(map[string]*FormatMeta)
+
+func currentFormat() *FormatMeta {
+	return &FormatMeta{Version: gFORMAT_VER, BhLen: gBH_LEN, RidxLen: gTSDB_RIDX_LEN, IdxLen: gTSDB_IDX_LEN,
+		RidxSize: gBLK_RIDX_SIZE, IdxSize: gBLK_IDX_SIZE, ObjSize: gBLK_OBJ_SIZE, FileSize: gBLK_FILE_SZ}
+}
+
+func legacyFormat() *FormatMeta {
+	m := currentFormat()
+	m.Version = gFORMAT_LEGACY
+	m.BhLen = gFormatBhLen[gFORMAT_LEGACY]
+	return m
+}
+
+func (m *FormatMeta) blockSize(datype string) uint32 {
+	if datype == gData_RIDX {
+		return m.RidxSize
+	} else if datype == gData_IDX {
+		return m.IdxSize
+	}
+	return m.ObjSize
+}
+
+func (m *FormatMeta) segBlocks(datype string) uint32 {
+	return m.FileSize / m.blockSize(datype)
+}
+
+// compatible 版本和头/索引的长度一样才能直接打开, block大小每个table可以不同
+func compatible(m *FormatMeta, where string) error {
+	cur := currentFormat()
+	if bh, ok := gFormatBhLen[m.Version]; !ok || bh != m.BhLen {
+		return fmt.Errorf("%w: %s version=%d has bh=%d", api.ErrFormat, where, m.Version, m.BhLen)
+	}
+	if m.Version != cur.Version || m.BhLen != cur.BhLen || m.RidxLen != cur.RidxLen || m.IdxLen != cur.IdxLen {
+		return fmt.Errorf("%w: %s version=%d, bh=%d, want version=%d, migrate first", api.ErrFormat, where,
+			m.Version, m.BhLen, gFORMAT_VER)
+	}
+	return nil
+}
+
+// validLayout block是2的幂, segment至少放得下8个最大的block, 空闲位图按字节对齐
+func validLayout(m *FormatMeta) error {
+	maxSize := uint32(0)
+	for _, size := range []uint32{m.RidxSize, m.IdxSize, m.ObjSize} {
+		if size < gBLK_MIN_SIZE || size > gBLK_MAX_SIZE || size&(size-1) != 0 {
+			return fmt.Errorf("block size=%d must be a power of 2 in [%d, %d]", size, gBLK_MIN_SIZE, gBLK_MAX_SIZE)
+		}
+		if size > maxSize {
+			maxSize = size
+		}
+	}
+	if m.FileSize&(m.FileSize-1) != 0 || m.FileSize > gSEG_MAX_SIZE || m.FileSize < 8*maxSize {
+		return fmt.Errorf("segment size=%d must be a power of 2 in [%d, %d]", m.FileSize, 8*maxSize, gSEG_MAX_SIZE)
+	}
+	return nil
+}
+
+// confLayout 按配置建表时的大小
+func confLayout(table string) *FormatMeta {
+	m := currentFormat()
+	if gConf == nil {
+		return m
+	}
+	tc, ok := gConf.Tables[table]
+	if !ok {
+		return m
+	}
+	for _, c := range []struct {
+		conf int
+		size *uint32
+	}{{tc.RidxBlock, &m.RidxSize}, {tc.IdxBlock, &m.IdxSize}, {tc.LeafBlock, &m.ObjSize}, {tc.SegmentSize, &m.FileSize}} {
+		if c.conf > 0 {
+			*c.size = uint32(c.conf)
+		}
+	}
+	return m
+}
+
+// tableLayout 已经建表的用表里记录的大小, 否则按配置
+func tableLayout(table string) *FormatMeta {
+	gLayoutLock.RLock()
+	m, ok := gLayouts[table]
+	gLayoutLock.RUnlock()
+	if ok {
+		return m
+	}
+	if blotDb == nil {
+		return confLayout(table)
+	}
+	var stored *FormatMeta
+	_ = blotDb.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		if buf := buck.Get([]byte(gFormat_Key)); buf != nil {
+			m := &FormatMeta{}
+			if m.UnmarshalBinary(buf) == nil {
+				stored = m
+			}
+		}
+		return nil
+	})
+	if stored == nil {
+		return confLayout(table)
+	}
+	setLayout(table, stored)
+	return stored
+}
+
+// bucketLayout 在bolt事务里直接读格式记录
+func bucketLayout(buck *bolt.Bucket) *FormatMeta {
+	m := &FormatMeta{}
+	if buf := buck.Get([]byte(gFormat_Key)); buf == nil || m.UnmarshalBinary(buf) != nil {
+		return currentFormat()
+	}
+	return m
+}
+
+func setLayout(table string, m *FormatMeta) {
+	gLayoutLock.Lock()
+	gLayouts[table] = m
+	gLayoutLock.Unlock()
+}
+
+func resetLayouts() {
+	gLayoutLock.Lock()
+	gLayouts = make(map[string]*FormatMeta)
+	gLayoutLock.Unlock()
+}
+
+// readSuper 没有superblock时返回nil
+func readSuper(dir string) (*FormatMeta, error) {
+	buf, err := os.ReadFile(fmt.Sprintf(gFormat_File, dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &FormatMeta{}
+	if err = m.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("%w: superblock %s", api.ErrFormat, err)
+	}
+	return m, nil
+}
+
+func writeSuper(dir string, m *FormatMeta) error {
+	buf, _ := m.MarshalBinary()
+	name := fmt.Sprintf(gFormat_File, dir)
+	f, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// tableFormats 每个table的格式记录, 没有记录的是旧数据
+func tableFormats(db *bolt.DB) (map[string]*FormatMeta, error) {
+	tables := make(map[string]*FormatMeta)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, buck *bolt.Bucket) error {
+			m := legacyFormat()
+			if buf := buck.Get([]byte(gFormat_Key)); buf != nil {
+				if err := m.UnmarshalBinary(buf); err != nil {
+					return fmt.Errorf("%w: table %s %s", api.ErrFormat, name, err)
+				}
+			}
+			tables[string(name)] = m
+			return nil
+		})
+	})
+	return tables, err
+}
+
+// detectFormat 有superblock按superblock, 没有时有table就是旧数据; 空目录返回nil
+func detectFormat(dir string, db *bolt.DB) (*FormatMeta, map[string]*FormatMeta, error) {
+	m, err := readSuper(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	tables, err := tableFormats(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m == nil && len(tables) > 0 {
+		m = legacyFormat()
+	}
+	return m, tables, nil
+}
+
+// checkFormat 打开数据目录时检查格式, 新目录写入superblock; 不兼容的数据要先用MigrateDir升级
+func checkFormat(dir string) error {
+	m, tables, err := detectFormat(dir, blotDb)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		common.Logger.Infof("init data dir=%s, format version=%d", dir, gFORMAT_VER)
+		return writeSuper(dir, currentFormat())
+	}
+	if err = compatible(m, "data dir "+dir); err != nil {
+		return err
+	}
+	for table, tm := range tables {
+		if err = compatible(tm, "table "+table); err != nil {
+			return err
+		}
+		if err = validLayout(tm); err != nil {
+			return fmt.Errorf("%w: table %s %s", api.ErrFormat, table, err)
+		}
+		if conf := confLayout(table); *conf != *currentFormat() && *conf != *tm {
+			return fmt.Errorf("%w: table %s block sizes %d/%d/%d/%d are fixed at creation, conf has %d/%d/%d/%d", api.ErrFormat, table,
+				tm.RidxSize, tm.IdxSize, tm.ObjSize, tm.FileSize, conf.RidxSize, conf.IdxSize, conf.ObjSize, conf.FileSize)
+		}
+	}
+	for table := range gConf.Tables {
+		if _, ok := tables[table]; !ok {
+			if err = validLayout(confLayout(table)); err != nil {
+				return fmt.Errorf("table %s:%w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tableBucket 新建table的bucket时按配置写入格式记录
+func tableBucket(tx *bolt.Tx, table string) (*bolt.Bucket, error) {
+	return createTable(tx, table, confLayout(table))
+}
+
+func createTable(tx *bolt.Tx, table string, m *FormatMeta) (*bolt.Bucket, error) {
+	if buck := tx.Bucket([]byte(table)); buck != nil {
+		return buck, nil
+	}
+	if err := validLayout(m); err != nil {
+		return nil, err
+	}
+	buck, err := tx.CreateBucket([]byte(table))
+	if err != nil {
+		return nil, err
+	}
+	buf, _ := m.MarshalBinary()
+	return buck, buck.Put([]byte(gFormat_Key), buf)
+}
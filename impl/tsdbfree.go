@@ -0,0 +1,194 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 空闲block按segment记在bolt的位图里, key为tsdb.<type>.free.<segNo>, 一位对应一个block;
+// 整个segment都空闲时删掉segment文件和位图
+
+func freePrefix(datype string) []byte {
+	return []byte(fmt.Sprintf("tsdb.%s.free.", datype))
+}
+
+func freeKey(datype string, segNo uint32) []byte {
+	return []byte(fmt.Sprintf("tsdb.%s.free.%08d", datype, segNo))
+}
+
+func getAloc(buck *bolt.Bucket, datype string) (*BlockAloc, error) {
+	ba := &BlockAloc{}
+	if value := buck.Get([]byte(fmt.Sprintf("tsdb.%s.spb", datype))); value != nil {
+		if err := ba.UnmarshalBinary(value); err != nil {
+			return nil, err
+		}
+	}
+	return ba, nil
+}
+
+// allocFree 从位图里取最多n个block, 低地址优先
+func allocFree(buck *bolt.Bucket, datype string, n uint32) ([]*BlockAddr, error) {
+	out := make([]*BlockAddr, 0, n)
+	prefix := freePrefix(datype)
+	size := bucketLayout(buck).blockSize(datype)
+	updates := make(map[string][]byte)
+	c := buck.Cursor()
+	for k, v := c.Seek(prefix); (k != nil) && bytes.HasPrefix(k, prefix) && (uint32(len(out)) < n); k, v = c.Next() {
+		segNo, err := strconv.ParseUint(string(k[len(prefix):]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		bits := append([]byte(nil), v...)
+		empty := true
+		for i := uint32(0); i < uint32(len(bits))*8; i++ {
+			if bits[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			if uint32(len(out)) >= n {
+				empty = false
+				break
+			}
+			bits[i/8] &^= 1 << (i % 8)
+			out = append(out, &BlockAddr{SegNo: uint32(segNo), SegOffset: i * size})
+		}
+		if empty {
+			updates[string(k)] = nil
+		} else {
+			updates[string(k)] = bits
+		}
+	}
+	// cursor遍历时不能改bucket
+	for k, bits := range updates {
+		var err error
+		if bits == nil {
+			err = buck.Delete([]byte(k))
+		} else {
+			err = buck.Put([]byte(k), bits)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// freeInBucket 返回全部空闲的segment, 正在分配的segment除外
+func freeInBucket(buck *bolt.Bucket, datype string, addrs []*BlockAddr) ([]uint32, error) {
+	ba, err := getAloc(buck, datype)
+	if err != nil {
+		return nil, err
+	}
+	lay := bucketLayout(buck)
+	size := lay.blockSize(datype)
+	segs := make(map[uint32][]byte)
+	for _, addr := range addrs {
+		bits, ok := segs[addr.SegNo]
+		if !ok {
+			bits = make([]byte, lay.segBlocks(datype)/8)
+			copy(bits, buck.Get(freeKey(datype, addr.SegNo)))
+			segs[addr.SegNo] = bits
+		}
+		i := addr.SegOffset / size
+		if bits[i/8]&(1<<(i%8)) != 0 {
+			common.Logger.Warnf("double free %s seg=%d,off=%d", datype, addr.SegNo, addr.SegOffset)
+			continue
+		}
+		bits[i/8] |= 1 << (i % 8)
+	}
+	full := make([]uint32, 0)
+	for segNo, bits := range segs {
+		if segNo != ba.SegNo && bytes.Count(bits, []byte{0xff}) == len(bits) {
+			full = append(full, segNo)
+			if err = buck.Delete(freeKey(datype, segNo)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err = buck.Put(freeKey(datype, segNo), bits); err != nil {
+			return nil, err
+		}
+	}
+	return full, nil
+}
+
+// freeBlocks 回收不再被引用的block, 调用前引用它们的链和topRef必须已经落盘
+func freeBlocks(dir, table string, addrs map[string][]*BlockAddr) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	for datype, list := range addrs {
+		if err := clearHeaders(dir, table, datype, list); err != nil {
+			return err
+		}
+	}
+	gAlocLock.Lock()
+	defer gAlocLock.Unlock()
+	full := make(map[string][]uint32)
+	err := blotDb.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		for datype, list := range addrs {
+			segs, err := freeInBucket(buck, datype, list)
+			if err != nil {
+				return err
+			}
+			full[datype] = segs
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	common.Logger.Debugf("free table=%s, ridx=%d, idx=%d, leaf=%d", table, len(addrs[gData_RIDX]), len(addrs[gData_IDX]), len(addrs[gData_VAL]))
+	for datype, segs := range full {
+		for _, segNo := range segs {
+			name := fmt.Sprintf(gSeg_Fmt, dir, table, segNo, datype)
+			dropSeg(name)
+			if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			common.Logger.Infof("free segment %s", name)
+		}
+	}
+	return nil
+}
+
+// clearHeaders 回收前把block头换成空头, 重新分配后没写盘就崩溃时读出来是空block
+func clearHeaders(dir, table, datype string, addrs []*BlockAddr) error {
+	empty := emptyHeader()
+	files := make(map[uint32]*segFile)
+	defer func() {
+		for _, f := range files {
+			f.release()
+		}
+	}()
+	for _, addr := range addrs {
+		f, ok := files[addr.SegNo]
+		if !ok {
+			name := fmt.Sprintf(gSeg_Fmt, dir, table, addr.SegNo, datype)
+			var err error
+			if f, err = openSeg(name); err != nil {
+				return err
+			}
+			files[addr.SegNo] = f
+		}
+		_, err := f.WriteAt(empty, int64(addr.SegOffset))
+		gBlockCache.invalidate(cacheKey(addr, dir, table, datype))
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := durableSync(f.File, table, f.name, gDur_Block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package impl
+
+import (
+	"testing"
+
+	"github.com/tao/faststore/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+func freeBits(t *testing.T, table, datype string, segNo uint32) []byte {
+	t.Helper()
+	var bits []byte
+	if err := blotDb.View(func(tx *bolt.Tx) error {
+		bits = append(bits, tx.Bucket([]byte(table)).Get(freeKey(datype, segNo))...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return bits
+}
+
+func TestFreeListReuse(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	addrs, err := allocBlocks(dir, "t", map[string]uint32{gData_VAL: 4}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := addrs[gData_VAL]
+	// 释放后面三个, 再分配时低地址优先
+	if err = freeBlocks(dir, "t", map[string][]*BlockAddr{gData_VAL: got[1:]}); err != nil {
+		t.Fatal(err)
+	}
+	if bits := freeBits(t, "t", gData_VAL, got[0].SegNo); len(bits) == 0 || bits[0] != 0x0e {
+		t.Fatal("bits", bits)
+	}
+	again, err := allocBlocks(dir, "t", map[string]uint32{gData_VAL: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *again[gData_VAL][0] != *got[1] || *again[gData_VAL][1] != *got[2] {
+		t.Fatal("reuse", again[gData_VAL])
+	}
+	if bits := freeBits(t, "t", gData_VAL, got[0].SegNo); len(bits) == 0 || bits[0] != 0x08 {
+		t.Fatal("bits", bits)
+	}
+	// 重复释放只记一次, 不会把同一个block分配两次
+	twice := []*BlockAddr{got[0], got[0]}
+	if err = freeBlocks(dir, "t", map[string][]*BlockAddr{gData_VAL: twice}); err != nil {
+		t.Fatal(err)
+	}
+	if err = freeBlocks(dir, "t", map[string][]*BlockAddr{gData_VAL: {got[3]}}); err != nil {
+		t.Fatal(err)
+	}
+	if bits := freeBits(t, "t", gData_VAL, got[0].SegNo); len(bits) == 0 || bits[0] != 0x09 {
+		t.Fatal("bits", bits)
+	}
+	last, err := allocBlocks(dir, "t", map[string]uint32{gData_VAL: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := last[gData_VAL]
+	if *l[0] != *got[0] || *l[1] != *got[3] || *l[2] == *got[0] || *l[2] == *got[3] {
+		t.Fatal("alloc", l[0], l[1], l[2])
+	}
+}
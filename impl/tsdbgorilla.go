@@ -0,0 +1,293 @@
+package impl
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// 数值序列的chunk: [1 kind][2 count][bit流], 第一个时间戳在leaf数据头里;
+// 时间戳存delta-of-delta, float存和前一个值的XOR, int和时间戳一样存delta-of-delta
+var (
+	gNUM_FLOAT        = uint8(1)
+	gNUM_INT          = uint8(2)
+	gNUM_CHUNK_POINTS = 240
+	gNUM_CHUNK_H_LEN  = 3
+	// 一个点编码后最多的字节数, 放不下时换新chunk
+	gNUM_POINT_MAX = uint32(20)
+)
+
+var errBadChunk = errors.New("bad numeric chunk")
+
+// dod的分段: 前缀位数, 数据位数
+var gDodBuckets = []struct {
+	prefix, prefixLen, bits int
+}{
+	{0b10, 2, 7},
+	{0b110, 3, 9},
+	{0b1110, 4, 12},
+}
+
+type bitWriter struct {
+	buf  []byte
+	free uint8
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		if w.free == 0 {
+			w.buf = append(w.buf, 0)
+			w.free = 8
+		}
+		m := n
+		if m > int(w.free) {
+			m = int(w.free)
+		}
+		chunk := byte((v >> uint(n-m)) & (1<<uint(m) - 1))
+		w.buf[len(w.buf)-1] |= chunk << (w.free - uint8(m))
+		w.free -= uint8(m)
+		n -= m
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	if r.pos+n > len(r.buf)*8 {
+		return 0, errBadChunk
+	}
+	v := uint64(0)
+	for n > 0 {
+		used := r.pos % 8
+		m := 8 - used
+		if m > n {
+			m = n
+		}
+		b := (r.buf[r.pos/8] >> uint(8-used-m)) & (1<<uint(m) - 1)
+		v = v<<uint(m) | uint64(b)
+		r.pos += m
+		n -= m
+	}
+	return v, nil
+}
+
+func writeDod(w *bitWriter, dod int64) {
+	if dod == 0 {
+		w.writeBits(0, 1)
+		return
+	}
+	for _, b := range gDodBuckets {
+		if dod >= -(1<<(b.bits-1)) && dod < (1<<(b.bits-1)) {
+			w.writeBits(uint64(b.prefix), b.prefixLen)
+			w.writeBits(uint64(dod), b.bits)
+			return
+		}
+	}
+	w.writeBits(0b1111, 4)
+	w.writeBits(uint64(dod), 64)
+}
+
+func readDod(r *bitReader) (int64, error) {
+	n := 0
+	for ; n < 4; n++ {
+		bit, err := r.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			break
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if n == 4 {
+		v, err := r.readBits(64)
+		return int64(v), err
+	}
+	size := gDodBuckets[n-1].bits
+	v, err := r.readBits(size)
+	if err != nil {
+		return 0, err
+	}
+	// 符号扩展
+	return int64(v<<(64-uint(size))) >> (64 - uint(size)), nil
+}
+
+// gorillaEnc 追加点并维护编码状态, bytes()是当前完整的chunk
+type gorillaEnc struct {
+	kind     uint8
+	count    int
+	w        bitWriter
+	ts       int64
+	delta    int64
+	val      uint64
+	vDelta   int64
+	leading  int
+	trailing int
+}
+
+func newGorillaEnc(kind uint8) *gorillaEnc {
+	enc := &gorillaEnc{kind: kind, leading: -1}
+	enc.w.buf = make([]byte, gNUM_CHUNK_H_LEN, 64)
+	enc.w.buf[0] = kind
+	return enc
+}
+
+func (enc *gorillaEnc) add(ts int64, v uint64) {
+	if enc.count == 0 {
+		enc.w.writeBits(v, 64)
+	} else {
+		delta := ts - enc.ts
+		writeDod(&enc.w, delta-enc.delta)
+		enc.delta = delta
+		if enc.kind == gNUM_INT {
+			vDelta := int64(v) - int64(enc.val)
+			writeDod(&enc.w, vDelta-enc.vDelta)
+			enc.vDelta = vDelta
+		} else {
+			enc.writeXor(v ^ enc.val)
+		}
+	}
+	enc.ts = ts
+	enc.val = v
+	enc.count++
+	binary.LittleEndian.PutUint16(enc.w.buf[1:], uint16(enc.count))
+}
+
+func (enc *gorillaEnc) writeXor(xor uint64) {
+	if xor == 0 {
+		enc.w.writeBits(0, 1)
+		return
+	}
+	leading := bits.LeadingZeros64(xor)
+	trailing := bits.TrailingZeros64(xor)
+	if leading > 31 {
+		leading = 31
+	}
+	if enc.leading >= 0 && leading >= enc.leading && trailing >= enc.trailing {
+		// 落在上一个窗口里
+		enc.w.writeBits(0b10, 2)
+		enc.w.writeBits(xor>>uint(enc.trailing), 64-enc.leading-enc.trailing)
+		return
+	}
+	sig := 64 - leading - trailing
+	enc.w.writeBits(0b11, 2)
+	enc.w.writeBits(uint64(leading), 5)
+	// 64位有效位存成0
+	enc.w.writeBits(uint64(sig&63), 6)
+	enc.w.writeBits(xor>>uint(trailing), sig)
+	enc.leading = leading
+	enc.trailing = trailing
+}
+
+func (enc *gorillaEnc) bytes() []byte {
+	return enc.w.buf
+}
+
+// numPoint bits是float64的位或者int64
+type numPoint struct {
+	ts   int64
+	bits uint64
+}
+
+// decodeChunk first是leaf数据头里的时间戳
+func decodeChunk(first int64, data []byte) (uint8, []numPoint, error) {
+	return decodeChunkTo(nil, first, data)
+}
+
+// decodeChunkTo 点追加到points[:0], 容量够时不分配
+func decodeChunkTo(points []numPoint, first int64, data []byte) (uint8, []numPoint, error) {
+	if len(data) < gNUM_CHUNK_H_LEN+8 {
+		return 0, nil, errBadChunk
+	}
+	kind := data[0]
+	if kind != gNUM_FLOAT && kind != gNUM_INT {
+		return 0, nil, errBadChunk
+	}
+	count := int(binary.LittleEndian.Uint16(data[1:]))
+	r := &bitReader{buf: data[gNUM_CHUNK_H_LEN:]}
+	if cap(points) < count {
+		points = make([]numPoint, 0, count)
+	}
+	points = points[:0]
+	var ts, delta, vDelta int64
+	var val uint64
+	leading, trailing := 0, 0
+	for i := 0; i < count; i++ {
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return 0, nil, err
+			}
+			ts, val = first, v
+			points = append(points, numPoint{ts: ts, bits: val})
+			continue
+		}
+		dod, err := readDod(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		delta += dod
+		ts += delta
+		if kind == gNUM_INT {
+			if dod, err = readDod(r); err != nil {
+				return 0, nil, err
+			}
+			vDelta += dod
+			val = uint64(int64(val) + vDelta)
+		} else {
+			if val, leading, trailing, err = readXor(r, val, leading, trailing); err != nil {
+				return 0, nil, err
+			}
+		}
+		points = append(points, numPoint{ts: ts, bits: val})
+	}
+	return kind, points, nil
+}
+
+func readXor(r *bitReader, val uint64, leading, trailing int) (uint64, int, int, error) {
+	bit, err := r.readBits(1)
+	if err != nil || bit == 0 {
+		return val, leading, trailing, err
+	}
+	if bit, err = r.readBits(1); err != nil {
+		return 0, 0, 0, err
+	}
+	if bit == 1 {
+		l, err := r.readBits(5)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		sig, err := r.readBits(6)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if sig == 0 {
+			sig = 64
+		}
+		leading = int(l)
+		trailing = 64 - leading - int(sig)
+	}
+	xor, err := r.readBits(64 - leading - trailing)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return val ^ (xor << uint(trailing)), leading, trailing, nil
+}
+
+// loadGorillaEnc 重新编码一遍已有的点, 继续往这个chunk里追加
+func loadGorillaEnc(first int64, data []byte) (*gorillaEnc, error) {
+	kind, points, err := decodeChunk(first, data)
+	if err != nil {
+		return nil, err
+	}
+	enc := newGorillaEnc(kind)
+	for _, p := range points {
+		enc.add(p.ts, p.bits)
+	}
+	return enc, nil
+}
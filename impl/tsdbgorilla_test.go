@@ -0,0 +1,81 @@
+package impl
+
+import (
+	"math"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+// gorillaPoints NaN, ±Inf, 相同的值和时间间隔, 以及很大的时间差和值的跳变
+func gorillaPoints() []numPoint {
+	ts := int64(1)
+	floats := []float64{0, math.NaN(), math.Inf(1), math.Inf(-1), 1.5, 1.5, 1.5, -0.0,
+		math.MaxFloat64, math.SmallestNonzeroFloat64, -math.MaxFloat64, math.NaN(), 3}
+	deltas := []int64{1, 1, 1, 1 << 40, 5, 3, 1000, math.MaxInt32, 1, 1 << 50, 2, 2, 2}
+	points := make([]numPoint, 0, len(floats))
+	for i, v := range floats {
+		ts += deltas[i]
+		points = append(points, numPoint{ts, math.Float64bits(v)})
+	}
+	return points
+}
+
+func TestGorillaSpecialValues(t *testing.T) {
+	ints := []int64{0, 0, 0, math.MaxInt64, math.MinInt64, -1, 1, math.MaxInt64, 5}
+	for _, kind := range []uint8{gNUM_FLOAT, gNUM_INT} {
+		want := gorillaPoints()
+		if kind == gNUM_INT {
+			want = want[:len(ints)]
+			for i, v := range ints {
+				want[i].bits = uint64(v)
+			}
+		}
+		enc := newGorillaEnc(kind)
+		for _, p := range want {
+			enc.add(p.ts, p.bits)
+		}
+		k, got, err := decodeChunk(want[0].ts, enc.bytes())
+		if err != nil || k != kind || len(got) != len(want) {
+			t.Fatal(err, k, len(got))
+		}
+		for i := range want {
+			// 按位比较, NaN也要原样读回来
+			if got[i] != want[i] {
+				t.Fatal(kind, i, got[i], want[i])
+			}
+		}
+		// 接着最后一个chunk继续写
+		enc, err = loadGorillaEnc(want[0].ts, enc.bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.add(want[len(want)-1].ts+1, want[0].bits)
+		if _, got, err = decodeChunk(want[0].ts, enc.bytes()); err != nil || len(got) != len(want)+1 || got[len(want)].bits != want[0].bits {
+			t.Fatal("reload", err, len(got))
+		}
+	}
+}
+
+func TestGorillaFloats(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	want := gorillaPoints()
+	db := NewTsdb(dir, "t", "f")
+	for _, p := range want {
+		if err := db.AppendFloat(p.ts, math.Float64frombits(p.bits)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	db = NewTsdb(dir, "t", "f")
+	defer db.Close()
+	got, err := db.GetFloats(math.MinInt64, math.MaxInt64, 0)
+	if err != nil || len(got) != len(want) {
+		t.Fatal(err, len(got))
+	}
+	for i, p := range want {
+		if got[i].Timestamp != p.ts || math.Float64bits(got[i].Value) != p.bits {
+			t.Fatal(i, got[i], p)
+		}
+	}
+}
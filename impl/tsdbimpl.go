@@ -2,6 +2,7 @@ package impl
 
 import (
 	"container/list"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
@@ -9,126 +10,185 @@ import (
 
 	"github.com/tao/faststore/api"
 	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
 )
 
 var gAlocLock sync.Mutex
-var gRidxPool = sync.Pool{
-	New: func() any {
-		buf := make([]byte, gBLK_RIDX_SIZE)
-		return buf
-	},
-}
 
-var gIdxPool = sync.Pool{
-	New: func() any {
-		buf := make([]byte, gBLK_IDX_SIZE)
-		return buf
-	},
-}
-
-var gObjPool = sync.Pool{
-	New: func() any {
-		buf := make([]byte, gBLK_OBJ_SIZE)
-		return buf
-	},
-}
+// 读block的buffer按大小分池, 各table的block大小可以不同
+var gBlockPools sync.Map
 
 var (
 	gData_RIDX  = "ridx"
 	gData_IDX   = "idx"
 	gData_VAL   = "leaf"
+	gData_OVF   = "ovf"
+	gDlog_Dir   = "dlog"
+	gWal_Dir    = "wal"
 	gCache_RIDX = 1
 	gCache_IDX  = 2
 	gCache_VAL  = 3
-	gErr_Eof    = ftsdbEoff{}
-	gErr_Empty  = ftsdbEmpty{}
 	gTbl_Fmt    = "%s/%s"
 	gSeg_Fmt    = "%s/%s/seg_%d.%s"
 )
 
-func isError(e, t error) bool {
-	if e == nil {
-		return false
-	}
-	return (e == t)
+// lateAllowed 打开乱序写或者是K线序列的重算
+func (ta *tsdbAppender) lateAllowed() bool {
+	return ta.impl.rewrite || ((gConf != nil) && gConf.OutOfOrder)
 }
 
 // appender
 func (ta *tsdbAppender) append(value *api.FstTsdbValue) error {
+	// 空数据和只有时间戳的坏数据分不开
+	if len(value.Data) == 0 {
+		return api.ErrEmptyValue
+	}
 	err := ta.getTailRIdx()
 	if err != nil {
 		common.Logger.Infof("value=%d, failed:%s", value.Timestamp, err)
 		return err
 	}
-	// 只支持追加写
 	if ta.lastRidx != nil && value.Timestamp < int64(ta.lastRidx.High) {
-		return nil
+		if !ta.lateAllowed() {
+			// 只支持追加写
+			if value.Timestamp == int64(ta.lastRidx.High-1) {
+				return api.ErrDuplicateTimestamp
+			}
+			return api.ErrOutOfOrder
+		}
+		if err = ta.checkFloor(value.Timestamp); err != nil {
+			return err
+		}
+		if err = ta.impl.logWal([]api.FstTsdbValue{*value}); err != nil {
+			return err
+		}
+		if err = ta.stage(value); err != nil {
+			return err
+		}
+		return markRollupDirty(ta.impl.table, ta.impl.symbol, value.Timestamp)
+	}
+	if err = ta.impl.logWal([]api.FstTsdbValue{*value}); err != nil {
+		return err
 	}
 	return ta.appendData(value)
 }
 
-func (ta *tsdbAppender) close() {
+func (ta *tsdbAppender) close() error {
+	if err := ta.merge(); err != nil {
+		common.Logger.Infof("merge failed:%s", err)
+		return err
+	}
+	if err := ta.flush(); err != nil {
+		common.Logger.Infof("flush failed:%s", err)
+		return err
+	}
+	return nil
+}
+
+func (ta *tsdbAppender) flush() error {
+	if err := ta.writeCaches(); err != nil {
+		return err
+	}
+	if ta.topRef != nil {
+		err := saveTsData(ta.impl.table, ta.impl.symbol, ta.topRef)
+		if err != nil {
+			common.Logger.Infof("saveTsData failed:%s", err)
+			return err
+		}
+	}
+	return ta.freeSpare()
+}
+
+// writeCaches 把三条链的尾block写盘, 不改topRef
+func (ta *tsdbAppender) writeCaches() error {
 	if ta.lastRidx != nil {
 		err := ta.ridxCache.updateTail(ta.lastRidx)
 		if err != nil {
 			common.Logger.Infof("updateTail failed:%s", err)
-			return
+			return err
 		}
 	}
 	if ta.datCache != nil {
 		err := ta.datCache.close()
 		if err != nil {
 			common.Logger.Infof("datCache close failed:%s", err)
-			return
+			return err
 		}
 	}
 	if ta.idxCache != nil {
 		err := ta.idxCache.close()
 		if err != nil {
 			common.Logger.Infof("idxCache close failed:%s", err)
-			return
+			return err
 		}
 	}
 	if ta.ridxCache != nil {
 		err := ta.ridxCache.close()
 		if err != nil {
 			common.Logger.Infof("ridxCache close failed:%s", err)
-			return
+			return err
 		}
 	}
-	if ta.topRef != nil {
-		err := saveTsData(ta.impl.table, ta.impl.symbol, ta.topRef)
-		if err != nil {
-			common.Logger.Infof("saveTsData failed:%s", err)
-			return
+	return nil
+}
+
+// freeSpare 预分配没用完的block还没被引用, 直接回收; 之后的写入再单独分配
+func (ta *tsdbAppender) freeSpare() error {
+	spare := map[string][]*BlockAddr{}
+	for _, ca := range []*tsdbWRCache{ta.datCache, ta.idxCache, ta.ridxCache} {
+		if ca != nil && len(ca.spare) > 0 {
+			spare[ca.dataType] = ca.spare
+			ca.spare = nil
 		}
 	}
+	if err := freeBlocks(ta.impl.dataDir, ta.impl.table, spare); err != nil {
+		common.Logger.Infof("free spare blocks failed:%s", err)
+		return err
+	}
+	return nil
 }
 
 func (ta *tsdbAppender) appendData(value *api.FstTsdbValue) error {
+	kind, err := ta.impl.getKind()
+	if err != nil {
+		return err
+	}
+	if kind != 0 {
+		return ta.appendPoint(value, kind)
+	}
+	return ta.appendEntry(value)
+}
+
+func (ta *tsdbAppender) appendEntry(value *api.FstTsdbValue) error {
 	err := ta.getDataCache()
 	if err != nil {
 		return err
 	}
 
 	//append data
-	tsValue := &TsdbValue{Timestamp: value.Timestamp, Data: value.Data}
-	addr, err := ta.datCache.append(tsValue)
+	addr, err := ta.datCache.appendValue(value.Timestamp, value.Data)
 	if err != nil {
 		return err
 	}
 	// append idx
-	tidx := &TsdbIndex{Key: uint64(value.Timestamp), Addr: BlockAddr{SegNo: addr.SegNo, SegOffset: addr.SegOffset}}
-	addr, err = ta.idxCache.append(tidx)
+	addr, err = ta.idxCache.appendIndex(uint64(value.Timestamp), addr)
 	if err != nil {
 		return err
 	}
+	idxSize := ta.idxCache.blkSize
 	if ta.lastRidx == nil {
-		segOff := getIdxSegOff(addr.SegOffset)
-		tRidx := &TsdbRangIndex{Low: uint64(value.Timestamp), High: uint64(value.Timestamp + 1), Off: 0, Addr: BlockAddr{SegNo: addr.SegNo, SegOffset: segOff}}
+		segOff := getIdxSegOff(addr.SegOffset, idxSize)
+		low := uint64(value.Timestamp)
+		if ta.headLow != nil {
+			if int64(*ta.headLow) < value.Timestamp {
+				low = *ta.headLow
+			}
+			ta.headLow = nil
+		}
+		tRidx := &TsdbRangIndex{Low: low, High: uint64(value.Timestamp + 1), Off: 0, Addr: BlockAddr{SegNo: addr.SegNo, SegOffset: segOff}}
 		ta.lastRidx = tRidx
 	} else {
-		segOff := getIdxSegOff(addr.SegOffset)
+		segOff := getIdxSegOff(addr.SegOffset, idxSize)
 		if (ta.lastRidx.Addr.SegNo == addr.SegNo) && (segOff == ta.lastRidx.Addr.SegOffset) {
 			/**没有换新的idxBlock**/
 			ta.lastRidx.High = uint64(value.Timestamp + 1)
@@ -169,28 +229,54 @@ func (ta *tsdbAppender) getDataCache() error {
 		return err
 	}
 	idxAdr := &BlockAddr{SegNo: ta.lastRidx.Addr.SegNo, SegOffset: ta.lastRidx.Addr.SegOffset}
-	ta.idxCache = allocWrCache(gData_IDX, ta.impl, idxAdr, blk)
 	idxItem := &TsdbIndex{}
-	err = idxItem.UnmarshalBinary(blk.Data[(blk.BH.Len - uint32(gTSDB_IDX_LEN)):])
-	if err != nil {
-		return err
+	// 崩溃恢复: 去掉range index之后才写盘的idx
+	cnt := blk.BH.Len / gTSDB_IDX_LEN
+	for ; cnt > 0; cnt-- {
+		err = idxItem.UnmarshalBinary(blk.Data[(cnt-1)*gTSDB_IDX_LEN:])
+		if err != nil {
+			return err
+		}
+		if idxItem.Key < ta.lastRidx.High {
+			break
+		}
+	}
+	if cnt == 0 {
+		common.Logger.Warnf("symbol=%s, idx block=%+v is empty", ta.impl.symbol, idxAdr)
+		return fmt.Errorf("idx block seg=%d,off=%d is empty", idxAdr.SegNo, idxAdr.SegOffset)
 	}
-	datAddr := &BlockAddr{SegNo: idxItem.Addr.SegNo, SegOffset: getValueSegOff(idxItem.Addr.SegOffset)}
+	blk.BH.Len = cnt * gTSDB_IDX_LEN
+	blk.BH.Next = BlockAddr{}
+	ta.idxCache = allocWrCache(gData_IDX, ta.impl, idxAdr, blk)
+	objSize := ta.impl.layout().ObjSize
+	datAddr := &BlockAddr{SegNo: idxItem.Addr.SegNo, SegOffset: getValueSegOff(idxItem.Addr.SegOffset, objSize)}
 	datBlk := &Block{}
 	err = loadBlock(datAddr, ta.impl.dataDir, ta.impl.table, gData_VAL, datBlk)
 	if err != nil {
 		return err
 	}
+	// 同样去掉最后一个idx之后的数据
+	vOff := getValueBlkOff(idxItem.Addr.SegOffset, objSize)
+	vLen, _ := valueLen(datBlk.Data[vOff:])
+	datBlk.BH.Len = vOff + gBLK_V_H_LEN + vLen
+	datBlk.BH.Next = BlockAddr{}
 	ta.datCache = allocWrCache(gData_VAL, ta.impl, datAddr, datBlk)
-	return nil
+	if kind, err := ta.impl.getKind(); err != nil || kind == 0 {
+		return err
+	}
+	return ta.loadChunk(datBlk, vOff)
 }
 
 func (ta *tsdbAppender) getTailRIdx() error {
-	if ta.lastRidx != nil {
+	if ta.ridxCache != nil {
 		return nil
 	}
 	isNew := false
 	if ta.topRef == nil {
+		// 上次合并提交后没改完前驱
+		if err := redoMerge(ta.impl.dataDir, ta.impl.table, ta.impl.symbol); err != nil {
+			return err
+		}
 		ta.topRef = &BlockAddr{}
 		err := getTsData(ta.impl.table, ta.impl.symbol, ta.topRef)
 		if err != nil {
@@ -209,31 +295,38 @@ func (ta *tsdbAppender) getTailRIdx() error {
 	} else {
 		block := &Block{}
 		addr := &BlockAddr{SegNo: ta.topRef.SegNo, SegOffset: ta.topRef.SegOffset}
-		for {
-			err := loadBlock(addr, ta.impl.dataDir, ta.impl.table, gData_RIDX, block)
+		err := loadBlock(addr, ta.impl.dataDir, ta.impl.table, gData_RIDX, block)
+		if err != nil {
+			common.Logger.Infof("getBlock failed:%s", err)
+			return err
+		}
+		for block.BH.Next.SegNo != 0 {
+			next := &Block{}
+			nAddr := &BlockAddr{SegNo: block.BH.Next.SegNo, SegOffset: block.BH.Next.SegOffset}
+			err = loadBlock(nAddr, ta.impl.dataDir, ta.impl.table, gData_RIDX, next)
 			if err != nil {
 				common.Logger.Infof("getBlock failed:%s", err)
 				return err
 			}
-			if block.BH.Next.SegNo != 0 {
-				addr.SegNo = block.BH.Next.SegNo
-				addr.SegOffset = block.BH.Next.SegOffset
-				continue
-			}
-			buf := make([]byte, gTSDB_RIDX_LEN)
-			bh := &block.BH
-			tailAdr := &BlockAddr{SegNo: addr.SegNo, SegOffset: addr.SegOffset}
-			ta.ridxCache = allocWrCache(gData_RIDX, ta.impl, tailAdr, block)
-			bcopy(buf, block.Data, 0, bh.Len-gTSDB_RIDX_LEN, gTSDB_RIDX_LEN)
-			ridx := &TsdbRangIndex{}
-			err = ridx.UnmarshalBinary(buf)
-			if err != nil {
-				common.Logger.Infof("UnmarshalBinary failed:%s", err)
-				return err
+			if next.BH.Len == 0 {
+				// 崩溃时后面的block还没写盘
+				block.BH.Next = BlockAddr{}
+				break
 			}
-			ta.lastRidx = ridx
-			break
+			addr = nAddr
+			block = next
+		}
+		ta.ridxCache = allocWrCache(gData_RIDX, ta.impl, addr, block)
+		if block.BH.Len < gTSDB_RIDX_LEN {
+			return nil
+		}
+		ridx := &TsdbRangIndex{}
+		err = ridx.UnmarshalBinary(block.Data[block.BH.Len-gTSDB_RIDX_LEN:])
+		if err != nil {
+			common.Logger.Infof("UnmarshalBinary failed:%s", err)
+			return err
 		}
+		ta.lastRidx = ridx
 	}
 	return nil
 }
@@ -256,6 +349,12 @@ func (tq *tsdbQuery) getLastN(key int64, limit int) (*list.List, error) {
 				break
 			}
 			tv := b.Value.(*TsdbValue)
+			if tv.Timestamp < tq.floor {
+				if itemList.Len() == 0 {
+					return nil, api.ErrEmpty
+				}
+				return itemList, nil
+			}
 			itemList.PushFront(&api.FstTsdbValue{Timestamp: tv.Timestamp, Data: tv.Data})
 		}
 		left := limit - itemList.Len()
@@ -264,7 +363,7 @@ func (tq *tsdbQuery) getLastN(key int64, limit int) (*list.List, error) {
 		}
 		err = tq.datCache.toPre()
 		if err != nil {
-			if isError(err, gErr_Eof) {
+			if errors.Is(err, api.ErrEOF) {
 				break
 			}
 			return nil, err
@@ -272,45 +371,6 @@ func (tq *tsdbQuery) getLastN(key int64, limit int) (*list.List, error) {
 	}
 	return itemList, nil
 }
-func (tq *tsdbQuery) getBetween(low, high int64, offset int) (*list.List, error) {
-	if tq.offset > offset {
-		common.Logger.Infof("offset = %d < lastOffset =%d", offset, tq.offset)
-		return nil, errors.New("offset error")
-	}
-	err := tq.findTidOff(low)
-	if err != nil {
-		return nil, err
-	}
-	itemList := list.New()
-	tv := &TsdbValue{}
-	for itemList.Len() < api.DEF_LIMIT {
-		err = tq.datCache.forward(tv)
-		if isError(err, gErr_Eof) {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		if tv.Timestamp < low {
-			continue
-		}
-		if tq.offset < offset {
-			tq.offset++
-			continue
-		}
-		if tv.Timestamp > high {
-			break
-		}
-		fv := &api.FstTsdbValue{Timestamp: tv.Timestamp, Data: tv.Data}
-		itemList.PushBack(fv)
-	}
-	if itemList.Len() == 0 {
-		common.Logger.Infof("low=%d, high=%d is empty", low, high)
-		return nil, gErr_Empty
-	}
-	return itemList, nil
-}
-
 func (tq *tsdbQuery) findTidOff(key int64) error {
 	if err := tq.findBlkRidx(key); err != nil {
 		return err
@@ -323,14 +383,15 @@ func (tq *tsdbQuery) findTidOff(key int64) error {
 	if tq.datCache != nil {
 		return nil
 	}
-	off := getValueBlkOff(tq.tIdx.Addr.SegOffset)
-	addr := BlockAddr{SegNo: tq.tIdx.Addr.SegNo, SegOffset: getValueSegOff(tq.tIdx.Addr.SegOffset)}
+	objSize := tq.impl.layout().ObjSize
+	off := getValueBlkOff(tq.tIdx.Addr.SegOffset, objSize)
+	addr := BlockAddr{SegNo: tq.tIdx.Addr.SegNo, SegOffset: getValueSegOff(tq.tIdx.Addr.SegOffset, objSize)}
 	blk := &Block{}
-	err := loadBlock(&addr, tq.impl.dataDir, tq.impl.table, gData_VAL, blk)
+	err := tq.impl.readBlock(&addr, gData_VAL, blk)
 	if err != nil {
 		return err
 	}
-	tq.datCache = &tsdbRDCache{blkSize: gBLK_OBJ_SIZE, readOff: off, dataType: gData_VAL, impl: tq.impl, block: blk}
+	tq.datCache = &tsdbRDCache{blkSize: objSize, readOff: off, dataType: gData_VAL, impl: tq.impl, addr: addr, block: blk}
 	return nil
 }
 
@@ -339,13 +400,13 @@ func (tq *tsdbQuery) findBlkIdx(key int64) error {
 		return nil
 	}
 	blk := &Block{}
-	err := loadBlock(&tq.tRidx.Addr, tq.impl.dataDir, tq.impl.table, gData_IDX, blk)
+	err := tq.impl.readBlock(&tq.tRidx.Addr, gData_IDX, blk)
 	if err != nil {
 		return err
 	}
 	off := findIdxOff(blk, uint64(key))
 	if off < 0 {
-		return gErr_Empty
+		return api.ErrEmpty
 	}
 	tq.tIdx = &TsdbIndex{}
 	err = tq.tIdx.UnmarshalBinary(blk.Data[off:])
@@ -360,22 +421,33 @@ func (tq *tsdbQuery) findBlkRidx(key int64) error {
 		return nil
 	}
 	topRef := &BlockAddr{}
-	err := getTsData(tq.impl.table, tq.impl.symbol, topRef)
+	err := tq.impl.getTopRef(topRef)
 	if err != nil {
 		common.Logger.Infof("Get tsdata table=%s,symbol=%s failed:%s", tq.impl.table, tq.impl.symbol, err)
 		return err
 	}
 	block := &Block{}
 	addr := BlockAddr{SegNo: topRef.SegNo, SegOffset: topRef.SegOffset}
+	var pre BlockAddr
 	for {
 		if addr.SegNo == 0 {
 			break
 		}
-		err := loadBlock(&addr, tq.impl.dataDir, tq.impl.table, gData_RIDX, block)
+		err := tq.impl.readBlock(&addr, gData_RIDX, block)
 		if err != nil {
 			common.Logger.Infof("getBlock failed:%s", err)
 			return err
 		}
+		if addr != *topRef && block.BH.Pre != pre {
+			// 写句柄换了ridx block, 新的还没落盘
+			break
+		}
+		pre = addr
+		if addr == *topRef {
+			if tq.floor, err = blockFloor(block); err != nil {
+				return err
+			}
+		}
 		buf := make([]byte, gTSDB_RIDX_LEN)
 		first := &TsdbRangIndex{}
 		bcopy(buf, block.Data, 0, 0, gTSDB_RIDX_LEN)
@@ -393,7 +465,7 @@ func (tq *tsdbQuery) findBlkRidx(key int64) error {
 		}
 		// 半开闭
 		if key < int64(first.Low) {
-			return gErr_Empty
+			return api.ErrEmpty
 		}
 		if key >= int64(tail.High) {
 			addr.SegNo = block.BH.Next.SegNo
@@ -402,7 +474,7 @@ func (tq *tsdbQuery) findBlkRidx(key int64) error {
 		}
 		off := findRidxOff(block, uint64(key))
 		if off < 0 {
-			return gErr_Empty
+			return api.ErrEmpty
 		}
 		tq.tRidx = &TsdbRangIndex{}
 		err = tq.tRidx.UnmarshalBinary(block.Data[off:])
@@ -412,14 +484,13 @@ func (tq *tsdbQuery) findBlkRidx(key int64) error {
 		common.Logger.Debugf("Key:%d, range:[%d,%d), off:%d", key, tq.tRidx.Low, tq.tRidx.High, tq.tRidx.Off)
 		return nil
 	}
-	return gErr_Empty
+	return api.ErrEmpty
 }
 
 func (tq *tsdbQuery) close() {
 	tq.datCache = nil
 	tq.tIdx = nil
 	tq.tRidx = nil
-	tq.offset = 0
 }
 
 // tsdbRDCache
@@ -430,11 +501,11 @@ func (ca *tsdbRDCache) bachReadTo(start uint32, key uint64, item *list.List) err
 			break
 		}
 
-		bLen := getIntFromB(ca.block.Data[off:])
+		bLen, ovf := valueLen(ca.block.Data[off:])
 		off += gBLK_V_H_LEN
 		if (bLen + off) > ca.block.BH.Len {
 			common.Logger.Infof("bLen=%d + readOf=%d > Len=%d", bLen, off, ca.block.BH.Len)
-			return errors.New("bachReadTo len error")
+			return ca.lenError(off, bLen)
 		}
 		tv := &TsdbValue{}
 		err := tv.unmarshal(ca.block.Data[off:], int(bLen))
@@ -443,6 +514,10 @@ func (ca *tsdbRDCache) bachReadTo(start uint32, key uint64, item *list.List) err
 			return err
 		}
 		if tv.Timestamp <= int64(key) {
+			ca.ovf = ovf
+			if _, err = ca.resolve(tv); err != nil {
+				return err
+			}
 			item.PushBack(tv)
 		}
 		if tv.Timestamp >= int64(key) {
@@ -454,52 +529,98 @@ func (ca *tsdbRDCache) bachReadTo(start uint32, key uint64, item *list.List) err
 
 func (ca *tsdbRDCache) toPre() error {
 	if ca.block.BH.Pre.SegNo == 0 {
-		return gErr_Eof
+		return api.ErrEOF
 	}
 	blk := &Block{}
-	err := loadBlock(&ca.block.BH.Pre, ca.impl.dataDir, ca.impl.table, gData_VAL, blk)
+	err := ca.impl.readBlockAs(&ca.block.BH.Pre, gData_VAL, blk, ca.noCopy)
 	if err != nil {
 		return err
 	}
+	ca.addr = ca.block.BH.Pre
 	ca.block = blk
 	ca.readOff = blk.BH.Len
+	ca.scanned = false
 	return nil
 }
 
 func (ca *tsdbRDCache) forward(data *TsdbValue) error {
-	if (ca.readOff + gBLK_V_H_LEN) < ca.block.BH.Len {
-		bLen := getIntFromB(ca.block.Data[ca.readOff:])
-		ca.readOff += gBLK_V_H_LEN
-		if (bLen + ca.readOff) > ca.block.BH.Len {
-			common.Logger.Infof("bLen=%d + readOf=%d > Len=%d", bLen, ca.readOff, ca.block.BH.Len)
-			return errors.New("read len error")
+	for (ca.readOff + gBLK_V_H_LEN) >= ca.block.BH.Len {
+		//read next
+		if ca.block.BH.Next.SegNo == 0 {
+			return api.ErrEOF
 		}
-		err := data.unmarshal(ca.block.Data[ca.readOff:], int(bLen))
-		ca.readOff += bLen
-		return err
-	}
-	//read next
-	if ca.block.BH.Next.SegNo == 0 {
-		return gErr_Eof
-	}
-	blk := &Block{}
-	err := loadBlock(&ca.block.BH.Next, ca.impl.dataDir, ca.impl.table, gData_VAL, blk)
-	if err != nil {
-		return err
+		blk := &Block{}
+		next := ca.block.BH.Next
+		ok, err := ca.impl.readNext(ca.addr, &next, gData_VAL, blk, ca.noCopy)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return api.ErrEOF
+		}
+		ca.addr = next
+		ca.block = blk
+		ca.readOff = 0
 	}
-	ca.block = blk
-	ca.readOff = 0
-	bLen := getIntFromB(ca.block.Data[ca.readOff:])
+	bLen, ovf := valueLen(ca.block.Data[ca.readOff:])
+	ca.ovf = ovf
 	ca.readOff += gBLK_V_H_LEN
 	if (bLen + ca.readOff) > ca.block.BH.Len {
 		common.Logger.Infof("bLen=%d + readOf=%d > Len=%d", bLen, ca.readOff, ca.block.BH.Len)
-		return errors.New("read len error")
+		return ca.lenError(ca.readOff, bLen)
 	}
-	err = data.unmarshal(ca.block.Data[ca.readOff:], int(bLen))
+	err := ca.value(data, ca.block.Data[ca.readOff:], bLen)
 	ca.readOff += bLen
 	return err
 }
 
+// backward 读readOff之前的一个数据, block内没有反向指针, 先从块头扫一遍记下每个数据的偏移
+func (ca *tsdbRDCache) backward(data *TsdbValue) error {
+	if !ca.scanned {
+		ca.scanOffs()
+	}
+	for len(ca.offs) == 0 {
+		if err := ca.toPre(); err != nil {
+			return err
+		}
+		ca.scanOffs()
+	}
+	off := ca.offs[len(ca.offs)-1]
+	ca.offs = ca.offs[:len(ca.offs)-1]
+	ca.readOff = off
+	bLen, ovf := valueLen(ca.block.Data[off:])
+	ca.ovf = ovf
+	if (bLen + off + gBLK_V_H_LEN) > ca.block.BH.Len {
+		common.Logger.Infof("bLen=%d + readOf=%d > Len=%d", bLen, off, ca.block.BH.Len)
+		return ca.lenError(off+gBLK_V_H_LEN, bLen)
+	}
+	return ca.value(data, ca.block.Data[off+gBLK_V_H_LEN:], bLen)
+}
+
+// lenError 数据长度超出了block, Offset是block的地址
+func (ca *tsdbRDCache) lenError(off, bLen uint32) error {
+	return &api.CorruptError{Table: ca.impl.table, Type: ca.dataType, Segment: ca.addr.SegNo, Offset: int64(ca.addr.SegOffset),
+		Reason: fmt.Sprintf("value len=%d at %d past block len=%d", bLen, off, ca.block.BH.Len)}
+}
+
+func (ca *tsdbRDCache) value(data *TsdbValue, buf []byte, bLen uint32) error {
+	if ca.noCopy {
+		return data.view(buf, int(bLen))
+	}
+	return data.unmarshal(buf, int(bLen))
+}
+
+func (ca *tsdbRDCache) scanOffs() {
+	ca.offs = ca.offs[:0]
+	off := uint32(0)
+	for (off < ca.readOff) && ((off + gBLK_V_H_LEN) < ca.block.BH.Len) {
+		ca.offs = append(ca.offs, off)
+		vLen, _ := valueLen(ca.block.Data[off:])
+		off += gBLK_V_H_LEN + vLen
+	}
+	ca.scanned = true
+}
+
 // tsdbWRCache
 func (ca *tsdbWRCache) updateTail(data *TsdbRangIndex) error {
 	totalLen := gTSDB_RIDX_LEN + ca.block.BH.Len + gBH_LEN
@@ -526,47 +647,71 @@ func (ca *tsdbWRCache) updateTail(data *TsdbRangIndex) error {
 	return nil
 }
 
-func (ca *tsdbWRCache) append(data FsData) (*BlockAddr, error) {
-	out, err := data.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	dLen := uint32(len(out))
-	outLen := dLen
-	if ca.cacheType == gCache_VAL {
-		outLen += gBLK_V_H_LEN
-	}
-
-	newLen := outLen + gBH_LEN
-	if newLen >= ca.blkSize {
-		return nil, errors.New("too long data")
-	}
-
-	if (ca.block.BH.Len + newLen) <= ca.blkSize {
-		addr := ca.toCache(dLen, out)
-		return addr, nil
-	}
-
-	err = ca.changeCache()
-	if err != nil {
-		return nil, err
+// appendValue 直接按 len+timestamp+data 写进block,不经过MarshalBinary; 放不下的数据先写ovf链, 这里只写引用
+func (ca *tsdbWRCache) appendValue(ts int64, data []byte) (BlockAddr, error) {
+	flag := uint32(0)
+	var ovf map[string][]*BlockAddr
+	if needOverflow(len(data), ca.blkSize) {
+		ref, addrs, err := writeOverflow(ca.impl, data)
+		if err != nil {
+			return BlockAddr{}, err
+		}
+		data, _ = ref.MarshalBinary()
+		flag = gOVF_FLAG
+		ovf = addrs
+	}
+	dLen := uint32(gBLK_K_LEN + len(data))
+	newLen := dLen + gBLK_V_H_LEN + gBH_LEN
+	if (ca.block.BH.Len + newLen) > ca.blkSize {
+		if err := ca.changeCache(); err != nil {
+			// ovf链还没被引用
+			return BlockAddr{}, errors.Join(err, freeBlocks(ca.impl.dataDir, ca.impl.table, ovf))
+		}
 	}
+	off := ca.block.BH.Len
+	putIntToB(ca.block.Data[off:], dLen|flag)
+	binary.LittleEndian.PutUint64(ca.block.Data[off+gBLK_V_H_LEN:], uint64(ts))
+	copy(ca.block.Data[off+gBLK_V_H_LEN+uint32(gBLK_K_LEN):], data)
+	ca.block.BH.Len += dLen + gBLK_V_H_LEN
+	/**要加上头部长度**/
+	return BlockAddr{SegNo: ca.addr.SegNo, SegOffset: (ca.addr.SegOffset + gBH_LEN) + off}, nil
+}
 
-	if (ca.block.BH.Len + newLen) <= ca.blkSize {
-		addr := ca.toCache(dLen, out)
-		return addr, nil
+func (ca *tsdbWRCache) appendIndex(key uint64, vAddr BlockAddr) (BlockAddr, error) {
+	if (ca.block.BH.Len + gTSDB_IDX_LEN + gBH_LEN) > ca.blkSize {
+		if err := ca.changeCache(); err != nil {
+			return BlockAddr{}, err
+		}
 	}
-	return nil, errors.New("len error")
+	off := ca.block.BH.Len
+	lwd := binary.LittleEndian
+	lwd.PutUint64(ca.block.Data[off:], key)
+	lwd.PutUint32(ca.block.Data[off+8:], vAddr.SegNo)
+	lwd.PutUint32(ca.block.Data[off+12:], vAddr.SegOffset)
+	ca.block.BH.Len += gTSDB_IDX_LEN
+	return BlockAddr{SegNo: ca.addr.SegNo, SegOffset: (ca.addr.SegOffset + gBH_LEN) + off}, nil
 }
 
 func (ca *tsdbWRCache) changeCache() error {
-	newCache, err := allocBlockByType(ca.dataType, ca.addr, ca.impl)
-	if err != nil {
-		return err
+	var newCache *tsdbWRCache
+	if len(ca.spare) > 0 {
+		//批量写时预分配的block
+		newCache = newBlockCache(ca.dataType, ca.addr, ca.spare[0], ca.impl)
+		ca.spare = ca.spare[1:]
+	} else {
+		cache, err := allocBlockByType(ca.dataType, ca.addr, ca.impl)
+		if err != nil {
+			return err
+		}
+		newCache = cache
 	}
 	ca.block.BH.Next.SegNo = newCache.addr.SegNo
 	ca.block.BH.Next.SegOffset = newCache.addr.SegOffset
-	err = saveBlock(ca.addr, ca.impl.dataDir, ca.impl.table, ca.dataType, ca.block)
+	if ca.cacheType == gCache_VAL {
+		// 写满的leaf block不会再改, 按table的配置压缩
+		ca.block.BH.Codec = tableCodec(ca.impl.table)
+	}
+	err := saveBlock(ca.addr, ca.impl.dataDir, ca.impl.table, ca.dataType, ca.block)
 	if err != nil {
 		return err
 	}
@@ -602,13 +747,11 @@ func findIdxOff(blk *Block, key uint64) int {
 	high := blk.BH.Len / gTSDB_IDX_LEN
 	low := uint32(0)
 	oHigh := high
-	itemBuf := make([]byte, gTSDB_IDX_LEN)
 	idx := &TsdbIndex{}
 	for low < high {
 		mid := (low + high) / 2
 		offset := mid * gTSDB_IDX_LEN
-		bcopy(itemBuf, blk.Data, 0, offset, gTSDB_IDX_LEN)
-		err := idx.UnmarshalBinary(itemBuf)
+		err := idx.UnmarshalBinary(blk.Data[offset : offset+gTSDB_IDX_LEN])
 		if err != nil {
 			common.Logger.Infof("UnmarshalBinary failed:%s", err)
 			return -1
@@ -638,13 +781,11 @@ func findRidxOff(blk *Block, key uint64) int {
 	}
 	low := uint32(0)
 	oHigh := high
-	itemBuf := make([]byte, gTSDB_RIDX_LEN)
 	ridx := &TsdbRangIndex{}
 	for low < high {
 		mid := (low + high) / 2
 		offset := mid * gTSDB_RIDX_LEN
-		bcopy(itemBuf, blk.Data, 0, offset, gTSDB_RIDX_LEN)
-		err := ridx.UnmarshalBinary(itemBuf)
+		err := ridx.UnmarshalBinary(blk.Data[offset : offset+gTSDB_RIDX_LEN])
 		if err != nil {
 			common.Logger.Infof("UnmarshalBinary failed:%s", err)
 			return -1
@@ -679,7 +820,7 @@ func allocBlockByType(datype string, pre *BlockAddr, impl *fstTsdbImpl) (*tsdbWR
 }
 
 func newBlockCache(datype string, pre, newRef *BlockAddr, impl *fstTsdbImpl) *tsdbWRCache {
-	dataSize := getTypeSize(datype)
+	dataSize := impl.layout().blockSize(datype)
 	cache := &tsdbWRCache{blkSize: dataSize, dataType: datype, cacheType: getCacheType(datype), impl: impl}
 	blk := &Block{BH: BlockHeader{}, Data: make([]byte, (dataSize - gBH_LEN))}
 	cache.block = blk
@@ -697,56 +838,106 @@ func newBlockCache(datype string, pre, newRef *BlockAddr, impl *fstTsdbImpl) *ts
 }
 
 func alloc(dir, table, datype string) (*BlockAddr, error) {
+	addrs, err := allocBlocks(dir, table, map[string]uint32{datype: 1}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[datype][0], nil
+}
+
+// allocBlocks 在一次bolt更新里按类型分配多个block, more可以在同一个事务里写入其它key
+func allocBlocks(dir, table string, need map[string]uint32, more func(buck *bolt.Bucket) error) (map[string][]*BlockAddr, error) {
+	return allocBy(dir, table, need, allocInBucket, more)
+}
+
+// allocRun 只从segment尾部分配, 同一个segment里的block是连续的
+func allocRun(dir, table string, need map[string]uint32) (map[string][]*BlockAddr, error) {
+	return allocBy(dir, table, need, allocTail, nil)
+}
+
+func allocBy(dir, table string, need map[string]uint32, fn func(buck *bolt.Bucket, dir, table, datype string, n uint32) ([]*BlockAddr, error), more func(buck *bolt.Bucket) error) (map[string][]*BlockAddr, error) {
 	gAlocLock.Lock()
-	ba := &BlockAloc{SegNo: 0, AlocLen: 0}
-	newBa := &BlockAddr{}
-	err := getTsData(table, fmt.Sprintf("tsdb.%s.spb", datype), ba)
-	datSize := getTypeSize(datype)
-	if err == nil {
-		if (ba.AlocLen + datSize) <= gBLK_FILE_SZ {
-			newBa.SegNo = ba.SegNo
-			newBa.SegOffset = ba.AlocLen
-			//update bLen
-			ba.AlocLen += uint32(datSize)
-			err = saveTsData(table, fmt.Sprintf("tsdb.%s.spb", datype), ba)
-			gAlocLock.Unlock()
+	defer gAlocLock.Unlock()
+	addrs := make(map[string][]*BlockAddr, len(need))
+	err := blotDb.Update(func(tx *bolt.Tx) error {
+		buck, err := tableBucket(tx, table)
+		if err != nil {
+			common.Logger.Infof("create bucket %s failed:%s", table, err)
+			return err
+		}
+		for datype, n := range need {
+			if n == 0 {
+				continue
+			}
+			out, err := fn(buck, dir, table, datype, n)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			common.Logger.Debugf("Alloc segment=%d, offset=%d", newBa.SegNo, newBa.SegOffset)
-			return newBa, nil
-		} else {
-			//需要重新分配(segment)
-			ba.SegNo = ba.SegNo + 1
-			ba.AlocLen = uint32(datSize)
-			newBa.SegNo = ba.SegNo
-			newBa.SegOffset = 0
-			common.Logger.Infof("Alloc segment=%d, offset=%d", newBa.SegNo, newBa.SegOffset)
+			addrs[datype] = out
 		}
-	} else {
-		//第一块(segment)
-		ba.SegNo = uint32(1)
-		newBa.SegNo = ba.SegNo
-		newBa.SegOffset = 0
-		ba.AlocLen = uint32(datSize)
-		common.Logger.Infof("Datatype=%s, Alloc segment=%d, offset=%d", datype, newBa.SegNo, newBa.SegOffset)
-	}
-	err = newSegment(ba.SegNo, dir, table, datype)
+		if more != nil {
+			return more(buck)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+func allocInBucket(buck *bolt.Bucket, dir, table, datype string, n uint32) ([]*BlockAddr, error) {
+	// 先用回收的block
+	out, err := allocFree(buck, datype, n)
 	if err != nil {
-		gAlocLock.Unlock()
 		return nil, err
 	}
-	err = saveTsData(table, fmt.Sprintf("tsdb.%s.spb", datype), ba)
-	gAlocLock.Unlock()
+	if uint32(len(out)) == n {
+		return out, nil
+	}
+	tail, err := allocTail(buck, dir, table, datype, n-uint32(len(out)))
 	if err != nil {
 		return nil, err
 	}
-	return newBa, nil
+	return append(out, tail...), nil
+}
+
+func allocTail(buck *bolt.Bucket, dir, table, datype string, n uint32) ([]*BlockAddr, error) {
+	key := []byte(fmt.Sprintf("tsdb.%s.spb", datype))
+	ba, err := getAloc(buck, datype)
+	if err != nil {
+		return nil, err
+	}
+	lay := bucketLayout(buck)
+	datSize := lay.blockSize(datype)
+	out := make([]*BlockAddr, 0, n)
+	for i := uint32(0); i < n; i++ {
+		if (ba.SegNo == 0) || ((ba.AlocLen + datSize) > lay.FileSize) {
+			//需要重新分配(segment)
+			ba.SegNo = ba.SegNo + 1
+			ba.AlocLen = 0
+			common.Logger.Infof("Datatype=%s, Alloc segment=%d, offset=%d", datype, ba.SegNo, ba.AlocLen)
+			if err := newSegment(ba.SegNo, dir, table, datype); err != nil {
+				return nil, err
+			}
+			setSegTail(table, datype, ba.SegNo)
+		}
+		out = append(out, &BlockAddr{SegNo: ba.SegNo, SegOffset: ba.AlocLen})
+		ba.AlocLen += datSize
+	}
+	common.Logger.Debugf("Alloc datatype=%s, n=%d, segment=%d, offset=%d", datype, n, ba.SegNo, ba.AlocLen)
+	buf, err := ba.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return out, buck.Put(key, buf)
 }
 
 func allocWrCache(dataType string, impl *fstTsdbImpl, addr *BlockAddr, block *Block) *tsdbWRCache {
+	// 尾block还要继续写, 不压缩
+	block.BH.Codec = api.CODEC_ID_NONE
 	cache := &tsdbWRCache{dataType: dataType, impl: impl, addr: addr, block: block}
-	cache.blkSize = getTypeSize(dataType)
+	cache.blkSize = impl.layout().blockSize(dataType)
 	cache.cacheType = getCacheType(dataType)
 	return cache
 }
@@ -754,12 +945,13 @@ func allocWrCache(dataType string, impl *fstTsdbImpl, addr *BlockAddr, block *Bl
 func newSegment(blockNo uint32, dir, table, datype string) error {
 	os.MkdirAll(fmt.Sprintf(gTbl_Fmt, dir, table), 0755)
 	name := fmt.Sprintf(gSeg_Fmt, dir, table, blockNo, datype)
+	dropSeg(name)
 	fout, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
 		common.Logger.Infof("newSegment name=%s open failed:%s", name, err)
 		return err
 	}
-	err = fout.Truncate(int64(gBLK_FILE_SZ))
+	err = fout.Truncate(int64(tableLayout(table).FileSize))
 	fout.Close()
 	if err != nil {
 		common.Logger.Infof("newSegment name=%s truncate failed:%s", name, err)
@@ -769,89 +961,135 @@ func newSegment(blockNo uint32, dir, table, datype string) error {
 }
 
 func loadBlock(addr *BlockAddr, dir, table, datype string, data *Block) error {
-	dsize := getTypeSize(datype)
+	return loadBlockAs(addr, dir, table, datype, data, false)
+}
+
+// loadBlockAs shared时Data可能和块缓存或者映射共用, 调用者只能读
+func loadBlockAs(addr *BlockAddr, dir, table, datype string, data *Block, shared bool) error {
+	dsize := tableLayout(table).blockSize(datype)
 	if (addr.SegOffset % dsize) != 0 {
 		common.Logger.Infof("loadBlock data=%s, segment=%d, segOff=%d", datype, addr.SegNo, addr.SegOffset)
 		return fmt.Errorf("offset=%d mod block size=%d =%d", addr.SegOffset, dsize, (addr.SegOffset % dsize))
 	}
+	key := cacheKey(addr, dir, table, datype)
+	gen, hit := gBlockCache.get(key, data, shared)
+	if hit {
+		return nil
+	}
 	name := fmt.Sprintf(gSeg_Fmt, dir, table, addr.SegNo, datype)
-	fout, err := os.OpenFile(name, os.O_RDONLY, 0755)
+	fout, err := openSeg(name)
 	if err != nil {
 		common.Logger.Infof("getBlock name=%s open failed:%s", name, err)
 		return err
 	}
-	buf := getBlockBuffer(datype)
+	if raw := fout.mapped(addr, dsize, table, datype); raw != nil {
+		err = mapBlock(raw, addr, table, datype, data, shared)
+		if err == nil && shared && data.BH.Codec == api.CODEC_ID_NONE {
+			// Data引用映射, 不放进块缓存, 文件等读结束再release
+			holdSeg(table, fout)
+			return nil
+		}
+		fout.release()
+		if err != nil {
+			common.Logger.Warnf("loadBlock name=%s: %s", name, err)
+			return err
+		}
+		gBlockCache.put(key, gen, data, shared)
+		return nil
+	}
+	buf := getBlockBuffer(dsize)
 	n, err := fout.ReadAt(buf, int64(addr.SegOffset))
-	fout.Close()
+	fout.release()
 	if err != nil {
 		common.Logger.Infof("ReadAt name=%s open failed:%s", name, err)
-		putBlockBuff(datype, buf)
+		putBlockBuff(buf)
 		return err
 	}
 	common.Logger.Debugf("ReadAt name=%s Off:=%d, Len:%d:%d", name, addr.SegOffset, n, dsize)
+	if err = verifyBlock(buf, addr, table, datype); err != nil {
+		putBlockBuff(buf)
+		common.Logger.Warnf("loadBlock name=%s: %s", name, err)
+		return err
+	}
 	err = data.UnmarshalBinary(buf)
-	putBlockBuff(datype, buf)
+	putBlockBuff(buf)
 	if err != nil {
 		common.Logger.Infof("UnmarshalBinary name=%s open failed:%s", name, err)
 		return err
 	}
+	if err = decodeBlock(data); err != nil {
+		common.Logger.Warnf("decode name=%s, off=%d failed:%s", name, addr.SegOffset, err)
+		return err
+	}
+	gBlockCache.put(key, gen, data, shared)
+	return nil
+}
+
+// mapBlock 直接在映射上校验和解压. 没压缩的block在shared时Data是映射的只读切片,
+// 调用者要pin住table: leaf block Len以内的数据不会在原地改写, 回收重用要等pin结束
+func mapBlock(raw []byte, addr *BlockAddr, table, datype string, data *Block, shared bool) error {
+	if err := verifyBlock(raw, addr, table, datype); err != nil {
+		return err
+	}
+	if err := data.unmarshalHeader(raw); err != nil {
+		return err
+	}
+	data.Data = raw[gBH_LEN:len(raw):len(raw)]
+	if data.BH.Codec == api.CODEC_ID_NONE {
+		if !shared {
+			data.Data = make([]byte, len(raw)-int(gBH_LEN))
+			copy(data.Data, raw[gBH_LEN:])
+		}
+		return nil
+	}
+	// 解压总是写到新的buffer
+	if err := decodeBlock(data); err != nil {
+		data.Data = nil
+		return err
+	}
 	return nil
 }
 
 func saveBlock(addr *BlockAddr, dir, table, datype string, data *Block) error {
-	dsize := getTypeSize(datype)
+	dsize := tableLayout(table).blockSize(datype)
 	if (addr.SegOffset % dsize) != 0 {
 		common.Logger.Infof("saveBlock data=%s, segment=%d, segOff=%d", datype, addr.SegNo, addr.SegOffset)
 		return fmt.Errorf("offset=%d mod block size=%d =%d", addr.SegOffset, dsize, (addr.SegOffset % dsize))
 	}
 	name := fmt.Sprintf(gSeg_Fmt, dir, table, addr.SegNo, datype)
-	fout, err := os.OpenFile(name, os.O_WRONLY, 0755)
+	buf, err := encodeBlock(data)
 	if err != nil {
-		common.Logger.Infof("saveBlock name=%s open failed:%s", name, err)
+		common.Logger.Infof("saveBlock name=%s MarshalBinary failed:%s", name, err)
 		return err
 	}
-	buf, err := data.MarshalBinary()
+	fout, err := openSeg(name)
 	if err != nil {
-		common.Logger.Infof("saveBlock name=%s MarshalBinary failed:%s", name, err)
-		fout.Close()
+		common.Logger.Infof("saveBlock name=%s open failed:%s", name, err)
 		return err
 	}
+	defer fout.release()
 	_, err = fout.WriteAt(buf, int64(addr.SegOffset))
-	fout.Close()
+	gBlockCache.invalidate(cacheKey(addr, dir, table, datype))
 	if err != nil {
 		common.Logger.Infof("saveBlock name=%s WriteAt failed:%s", name, err)
 		return err
 	}
-	return nil
-}
-
-func getBlockBuffer(datype string) []byte {
-	if datype == gData_RIDX {
-		return gRidxPool.Get().([]byte)
-	} else if datype == gData_IDX {
-		return gIdxPool.Get().([]byte)
-	} else {
-		return gObjPool.Get().([]byte)
-	}
+	return durableSync(fout.File, table, name, gDur_Block)
 }
 
-func putBlockBuff(datype string, buf any) {
-	if datype == gData_RIDX {
-		gRidxPool.Put(buf)
-	} else if datype == gData_IDX {
-		gIdxPool.Put(buf)
-	} else {
-		gObjPool.Put(buf)
-	}
+func getBlockBuffer(size uint32) []byte {
+	pool, ok := gBlockPools.Load(size)
+	if !ok {
+		pool, _ = gBlockPools.LoadOrStore(size, &sync.Pool{New: func() any {
+			return make([]byte, size)
+		}})
+	}
+	return pool.(*sync.Pool).Get().([]byte)
 }
 
-func getTypeSize(datype string) uint32 {
-	if datype == gData_RIDX {
-		return gBLK_RIDX_SIZE
-	} else if datype == gData_IDX {
-		return gBLK_IDX_SIZE
-	} else {
-		return gBLK_OBJ_SIZE
+func putBlockBuff(buf []byte) {
+	if pool, ok := gBlockPools.Load(uint32(len(buf))); ok {
+		pool.(*sync.Pool).Put(buf)
 	}
 }
 
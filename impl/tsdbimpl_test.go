@@ -0,0 +1,24 @@
+package impl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func TestAppendEmptyValue(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 10)
+	if err := db.Append(&api.FstTsdbValue{Timestamp: 11}); !errors.Is(err, api.ErrEmptyValue) {
+		t.Fatal(err)
+	}
+	appendValues(t, db, 11, 20)
+	if err := NewLogger(dir, "t").Append("k", &api.FstTsdbValue{Timestamp: 1}); !errors.Is(err, api.ErrEmptyValue) {
+		t.Fatal(err)
+	}
+	db.Close()
+	crashDb(t)
+	checkValues(t, dir, "t", "s", 20)
+}
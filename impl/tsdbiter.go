@@ -0,0 +1,374 @@
+package impl
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+// tsdbIter 只持有当前的leaf block, 多个迭代器之间没有共享状态
+type tsdbIter struct {
+	api.FstTsdbIter
+	impl    *fstTsdbImpl
+	low     int64
+	high    int64
+	reverse bool
+	done    bool
+	err     error
+	rd      *tsdbRDCache
+	tv      TsdbValue
+	value   api.FstTsdbValue
+	pinned  bool
+	epoch   uint64
+	kind    uint8
+	raw     bool
+	points  []TsdbValue
+	noCopy  bool // Value().Data引用block或者chunkBuf, 下一次Next之后失效
+	chunks  *chunkBuf
+	late    []*api.FstTsdbValue // 快照里还没合并的迟到数据, 按时间戳排序
+	lateOff int
+	pend    bool // tv里读出来的数据还没返回
+	ended   bool // 链上的数据读完了
+}
+
+func (tsdb *fstTsdbImpl) Range(low, high int64) api.FstTsdbIter {
+	return tsdb.newIter(low, high, false)
+}
+
+func (tsdb *fstTsdbImpl) RangeReverse(low, high int64) api.FstTsdbIter {
+	return tsdb.newIter(low, high, true)
+}
+
+func (tsdb *fstTsdbImpl) RangeNoCopy(low, high int64) api.FstTsdbIter {
+	return tsdb.newNoCopyIter(low, high, false)
+}
+
+func (tsdb *fstTsdbImpl) RangeReverseNoCopy(low, high int64) api.FstTsdbIter {
+	return tsdb.newNoCopyIter(low, high, true)
+}
+
+// Scan 正序遍历不为每个数据分配内存, 超过leaf block的大数据除外
+func (tsdb *fstTsdbImpl) Scan(low, high int64, call func(ts int64, data []byte) error) error {
+	it := tsdb.newNoCopyIter(low, high, false)
+	defer it.Close()
+	for it.Next() {
+		if err := call(it.value.Timestamp, it.value.Data); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (tsdb *fstTsdbImpl) newNoCopyIter(low, high int64, reverse bool) *tsdbIter {
+	it := tsdb.newIter(low, high, reverse)
+	it.noCopy = true
+	it.chunks = &chunkBuf{}
+	return it
+}
+
+func (tsdb *fstTsdbImpl) newIter(low, high int64, reverse bool) *tsdbIter {
+	it := &tsdbIter{impl: tsdb, low: low, high: high, reverse: reverse}
+	if low > high {
+		it.done = true
+	}
+	if kind, err := tsdb.getKind(); err != nil {
+		it.err = err
+		it.done = true
+	} else {
+		it.kind = kind
+	}
+	if it.done {
+		return it
+	}
+	// 先pin再复制尾block, 快照里引用的block不会被回收
+	it.epoch = pinTable(tsdb.table)
+	it.pinned = true
+	v, err := tsdb.view()
+	if err != nil {
+		it.err = err
+		it.stop()
+		return it
+	}
+	it.impl = v
+	if v.snap != nil {
+		it.late = v.snap.late
+	}
+	return it
+}
+
+func (it *tsdbIter) Next() bool {
+	if it.done {
+		return false
+	}
+	if !it.pend && !it.ended {
+		it.pend = it.nextBase()
+		if it.err != nil {
+			it.stop()
+			return false
+		}
+		it.ended = !it.pend
+	}
+	// 暂存区的迟到数据和链上的数据按时间戳归并, 相同时间戳以暂存区为准
+	if v := it.nextLate(); v != nil && (!it.pend || v.Timestamp == it.tv.Timestamp || (v.Timestamp < it.tv.Timestamp) != it.reverse) {
+		if it.pend && v.Timestamp == it.tv.Timestamp {
+			it.pend = false
+		}
+		it.skipLate(v.Timestamp)
+		it.value.Timestamp = v.Timestamp
+		it.value.Data = v.Data
+		return true
+	}
+	if !it.pend {
+		it.stop()
+		return false
+	}
+	it.pend = false
+	it.value.Timestamp = it.tv.Timestamp
+	it.value.Data = it.tv.Data
+	return true
+}
+
+// nextBase 读链上的下一个数据到tv, 读完或者出错时返回false
+func (it *tsdbIter) nextBase() bool {
+	if it.rd == nil {
+		key := it.low
+		if it.reverse {
+			key = it.high
+			if key < math.MaxInt64 {
+				key++
+			}
+		}
+		rd, err := seekLeaf(it.impl, key)
+		if err != nil {
+			if !errors.Is(err, api.ErrEmpty) {
+				it.err = err
+			}
+			return false
+		}
+		it.rd = rd
+		rd.noCopy = it.noCopy
+		if it.kind != 0 && !it.reverse {
+			// key可能落在前一个chunk里
+			if err = rd.backward(&it.tv); err != nil && !errors.Is(err, api.ErrEOF) {
+				it.err = err
+				return false
+			}
+		}
+	}
+	// 链上floor之前的数据已经删掉, block可能已经回收; 暂存区的迟到数据不受影响
+	low := it.low
+	if low < it.rd.floor {
+		low = it.rd.floor
+	}
+	for {
+		if err := it.read(); err != nil {
+			if !errors.Is(err, api.ErrEOF) {
+				it.err = err
+			}
+			return false
+		}
+		if (it.tv.Timestamp > it.high && !it.reverse) || (it.tv.Timestamp < low && it.reverse) {
+			return false
+		}
+		if it.tv.Timestamp >= low && it.tv.Timestamp <= it.high {
+			break
+		}
+	}
+	if !it.raw {
+		if _, err := it.rd.resolve(&it.tv); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// nextLate 下一个还没返回的迟到数据, 相同时间戳取最后到的
+func (it *tsdbIter) nextLate() *api.FstTsdbValue {
+	for ; it.lateOff < len(it.late); it.lateOff++ {
+		i := it.lateOff
+		if it.reverse {
+			i = len(it.late) - 1 - i
+		}
+		v := it.late[i]
+		if (v.Timestamp < it.low && !it.reverse) || (v.Timestamp > it.high && it.reverse) {
+			continue
+		}
+		if v.Timestamp < it.low || v.Timestamp > it.high {
+			return nil
+		}
+		for !it.reverse && i+1 < len(it.late) && it.late[i+1].Timestamp == v.Timestamp {
+			i++
+			v = it.late[i]
+		}
+		return v
+	}
+	return nil
+}
+
+func (it *tsdbIter) skipLate(ts int64) {
+	for it.lateOff < len(it.late) {
+		i := it.lateOff
+		if it.reverse {
+			i = len(it.late) - 1 - i
+		}
+		if it.late[i].Timestamp != ts {
+			return
+		}
+		it.lateOff++
+	}
+}
+
+// read 读下一个数据, 数值序列逐个返回chunk里的点
+func (it *tsdbIter) read() error {
+	if it.kind == 0 || it.raw {
+		if it.reverse {
+			return it.rd.backward(&it.tv)
+		}
+		return it.rd.forward(&it.tv)
+	}
+	for len(it.points) == 0 {
+		var err error
+		if it.reverse {
+			err = it.rd.backward(&it.tv)
+		} else {
+			err = it.rd.forward(&it.tv)
+		}
+		if err != nil {
+			return err
+		}
+		if it.noCopy {
+			it.points, err = it.chunks.expand(&it.tv, it.reverse)
+		} else {
+			it.points, err = expandChunk(&it.tv, it.reverse)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	it.tv = it.points[0]
+	it.points = it.points[1:]
+	return nil
+}
+
+func (it *tsdbIter) Value() *api.FstTsdbValue {
+	return &it.value
+}
+
+func (it *tsdbIter) Err() error {
+	return it.err
+}
+
+func (it *tsdbIter) Close() {
+	it.stop()
+	it.rd = nil
+}
+
+// stop 结束后就不再读block, 可以放开pin
+func (it *tsdbIter) stop() {
+	it.done = true
+	if it.pinned {
+		it.pinned = false
+		unpinTable(it.impl.dataDir, it.impl.table, it.epoch)
+	}
+}
+
+// seekLeaf 定位到第一个时间戳>=key的数据; 都比key小时定位到最后一个数据之后
+func seekLeaf(impl *fstTsdbImpl, key int64) (*tsdbRDCache, error) {
+	topRef := &BlockAddr{}
+	if err := impl.getTopRef(topRef); err != nil {
+		return nil, api.ErrEmpty
+	}
+	// range index
+	rBlk := &Block{}
+	if err := impl.readBlock(topRef, gData_RIDX, rBlk); err != nil {
+		return nil, err
+	}
+	floor, err := blockFloor(rBlk)
+	if err != nil {
+		return nil, err
+	}
+	// 已删除的数据所在的block可能已经回收
+	if key < floor {
+		key = floor
+	}
+	ridx := &TsdbRangIndex{}
+	rAddr := *topRef
+	for {
+		if rBlk.BH.Len < gTSDB_RIDX_LEN {
+			return nil, api.ErrEmpty
+		}
+		if err := ridx.UnmarshalBinary(rBlk.Data[rBlk.BH.Len-gTSDB_RIDX_LEN:]); err != nil {
+			return nil, err
+		}
+		if key < int64(ridx.High) || rBlk.BH.Next.SegNo == 0 {
+			break
+		}
+		next := &Block{}
+		nAddr := rBlk.BH.Next
+		ok, err := impl.readNext(rAddr, &nAddr, gData_RIDX, next, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || next.BH.Len < gTSDB_RIDX_LEN {
+			break
+		}
+		rAddr = nAddr
+		rBlk = next
+	}
+	past := key >= int64(ridx.High)
+	if !past {
+		cnt := int(rBlk.BH.Len / gTSDB_RIDX_LEN)
+		k := sort.Search(cnt, func(i int) bool {
+			_ = ridx.UnmarshalBinary(rBlk.Data[uint32(i)*gTSDB_RIDX_LEN:])
+			return int64(ridx.High) > key
+		})
+		if err := ridx.UnmarshalBinary(rBlk.Data[uint32(k)*gTSDB_RIDX_LEN:]); err != nil {
+			return nil, err
+		}
+	}
+	// index
+	iBlk := &Block{}
+	if err := impl.readBlock(&ridx.Addr, gData_IDX, iBlk); err != nil {
+		return nil, err
+	}
+	tidx := &TsdbIndex{}
+	// 崩溃后idx block里可能有range index之外的数据
+	cnt := sort.Search(int(iBlk.BH.Len/gTSDB_IDX_LEN), func(i int) bool {
+		_ = tidx.UnmarshalBinary(iBlk.Data[uint32(i)*gTSDB_IDX_LEN:])
+		return tidx.Key >= ridx.High
+	})
+	if cnt == 0 {
+		common.Logger.Infof("symbol=%s idx block is empty", impl.symbol)
+		return nil, api.ErrEmpty
+	}
+	e := sort.Search(cnt, func(i int) bool {
+		_ = tidx.UnmarshalBinary(iBlk.Data[uint32(i)*gTSDB_IDX_LEN:])
+		return int64(tidx.Key) >= key
+	})
+	if e >= cnt {
+		past = true
+		e = cnt - 1
+	}
+	if err := tidx.UnmarshalBinary(iBlk.Data[uint32(e)*gTSDB_IDX_LEN:]); err != nil {
+		return nil, err
+	}
+	// leaf
+	objSize := impl.layout().ObjSize
+	addr := &BlockAddr{SegNo: tidx.Addr.SegNo, SegOffset: getValueSegOff(tidx.Addr.SegOffset, objSize)}
+	blk := &Block{}
+	if err := impl.readBlock(addr, gData_VAL, blk); err != nil {
+		return nil, err
+	}
+	off := getValueBlkOff(tidx.Addr.SegOffset, objSize)
+	if past {
+		vLen, _ := valueLen(blk.Data[off:])
+		off += gBLK_V_H_LEN + vLen
+		blk.BH.Len = off
+		blk.BH.Next = BlockAddr{}
+	}
+	return &tsdbRDCache{blkSize: objSize, readOff: off, dataType: gData_VAL, impl: impl, addr: *addr, block: blk, floor: floor}, nil
+}
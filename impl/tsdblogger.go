@@ -1,8 +1,8 @@
 package impl
 
 import (
-	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -12,43 +12,75 @@ import (
 	"github.com/tao/faststore/common"
 )
 
+// Append append模式下每次都写入文件并fsync, 其它模式攒满一帧再写
 func (lg *fstLoggerImpl) Append(key string, value *api.FstTsdbValue) error {
+	if err := lg.append(key, value); err != nil {
+		return err
+	}
+	if getDurability(lg.table).level != gDur_Append {
+		return nil
+	}
+	if err := lg.flush(); err != nil {
+		return err
+	}
+	return lg.sync(gDur_Append)
+}
+
+// append 写进cache, cache满了才写文件
+func (lg *fstLoggerImpl) append(key string, value *api.FstTsdbValue) error {
 	if err := lg.openForWr(); err != nil {
 		return err
 	}
 	tlv := TsdbLogValue{Key: key, Timestamp: value.Timestamp, Data: value.Data}
 	out, err := tlv.MarshalBinary()
 	if err != nil {
-		return nil
+		return err
 	}
 	outLen := uint32(len(out))
+	if uint32(len(value.Data)) > gVAL_MAX_SIZE {
+		return api.ErrValueTooLarge
+	}
+	if len(value.Data) == 0 {
+		return api.ErrEmptyValue
+	}
 	err = lg.checkAndFlush(outLen)
 	if err != nil {
-		return nil
+		return err
+	}
+	size := len(lg.cache)
+	if (outLen + gBLK_V_H_LEN + gLOG_H_LEN) > uint32(size) {
+		// 放不进cache的单独一帧, 写完恢复原来的cache
+		lg.cache = make([]byte, outLen+gBLK_V_H_LEN+gLOG_H_LEN)
+		defer func() {
+			lg.cache = make([]byte, size)
+		}()
 	}
 	putIntToB(lg.cache[lg.cacheOff:], outLen)
 	lg.cacheOff += gBLK_V_H_LEN
 	bcopy(lg.cache, out, lg.cacheOff, 0, outLen)
 	lg.cacheOff += outLen
+	if len(lg.cache) != size {
+		return lg.flush()
+	}
 	return nil
 }
 func (lg *fstLoggerImpl) ForEach(call func(key string, value *api.FstTsdbValue) error) error {
-	dir := fmt.Sprintf("%s/%s/dlog", lg.dir, lg.table)
-	tailFile, _ := findTailFile(dir, lg.table)
-	if tailFile == "" {
-		common.Logger.Infof("tailFile=%s is empty", tailFile)
-		return errors.New("dlog is empty")
+	dir := lg.logDir()
+	head, number, _ := findLogFiles(dir, lg.table)
+	if number == 0 {
+		common.Logger.Infof("dir=%s has no log file", dir)
+		return api.ErrEmpty
 	}
-	number, _ := getTailNumber(tailFile)
-	common.Logger.Infof("tail=%s,number=%d", tailFile, number)
-	if number <= 0 {
-		return errors.New("format error")
+	common.Logger.Infof("head=%d,tail=%d", head, number)
+	cache := make([]byte, tableLayout(lg.table).ObjSize)
+	hLen := gLOG_H_LEN
+	if lg.legacy {
+		hLen = gLEGACY_LOG_H_LEN
 	}
-	cache := make([]byte, gBLK_OBJ_SIZE)
-	lenBuf := make([]byte, gBLK_V_H_LEN)
-	tail := 1
+	lenBuf := make([]byte, hLen)
+	tail := head
 	for tail <= number {
-		fileName := fmt.Sprintf("%s/%s/dlog/%s-%04d.log", lg.dir, lg.table, lg.table, tail)
+		fileName := fmt.Sprintf("%s/%s-%04d.log", dir, lg.table, tail)
 		tail += 1
 		in, err := os.OpenFile(fileName, os.O_RDONLY, 0755)
 		if err != nil {
@@ -64,25 +96,51 @@ func (lg *fstLoggerImpl) ForEach(call func(key string, value *api.FstTsdbValue)
 		readOff := 0
 		common.Logger.Infof("Proccess file=%s, fileOff=%d", fileName, fileOff)
 		for readOff < fileOff {
-			_, err = in.Read(lenBuf)
+			// 最后一个文件末尾的帧可能没写完, 之后没有别的数据
+			last := (tail > number)
+			corrupt := &api.CorruptError{Table: lg.table, Type: "log", Segment: uint32(tail - 1), Offset: int64(readOff)}
+			if readOff+int(hLen) > fileOff {
+				in.Close()
+				corrupt.Reason, corrupt.Tail = "short frame header", last
+				return corrupt
+			}
+			_, err = io.ReadFull(in, lenBuf)
 			if err != nil {
 				common.Logger.Warnf("file:%s, read:%s", fileName, err)
 				in.Close()
 				return err
 			}
 			rLen := getIntFromB(lenBuf)
-			if rLen >= gBLK_OBJ_SIZE {
+			end := readOff + int(hLen) + int(rLen)
+			if end > fileOff {
+				common.Logger.Warnf("file:%s, frame at %d len=%d past end=%d", fileName, readOff, rLen, fileOff)
+				in.Close()
+				corrupt.Reason, corrupt.Tail = "short frame", last
+				return corrupt
+			}
+			if rLen > gVAL_MAX_SIZE+uint32(len(cache)) {
 				common.Logger.Warnf("file:%s, getIntFromB:%d is error", fileName, rLen)
 				in.Close()
-				return errors.New("rLen error")
+				corrupt.Reason = "frame length"
+				return corrupt
+			}
+			if rLen > uint32(len(cache)) {
+				// 大数据单独的一帧
+				cache = make([]byte, rLen)
 			}
 			s := cache[0:rLen]
-			_, err := in.Read(s)
+			_, err := io.ReadFull(in, s)
 			if err != nil {
 				common.Logger.Warnf("file:%s, read:%s", fileName, err)
 				in.Close()
 				return err
 			}
+			if !lg.legacy && checksum(s) != getIntFromB(lenBuf[gBLK_V_H_LEN:]) {
+				common.Logger.Warnf("file:%s, frame at %d checksum mismatch", fileName, readOff)
+				in.Close()
+				corrupt.Reason, corrupt.Tail = "checksum mismatch", last && end == fileOff
+				return corrupt
+			}
 			off := uint32(0)
 			tslv := TsdbLogValue{}
 			fsv := api.FstTsdbValue{}
@@ -92,14 +150,16 @@ func (lg *fstLoggerImpl) ForEach(call func(key string, value *api.FstTsdbValue)
 				if (off + vL) > rLen {
 					common.Logger.Warnf("file:%s, getIntFromB:%d at off=%d,rLen=%d failed", fileName, rLen, (off - gBLK_V_H_LEN), rLen)
 					in.Close()
-					return errors.New("vL error")
+					corrupt.Reason = "value length"
+					return corrupt
 				}
 				err = tslv.unmarshal(s[off:], int(vL))
 				off += vL
 				if err != nil {
-					common.Logger.Warnf("file:%s, unmarshal failed:%s", fileName, rLen)
+					common.Logger.Warnf("file:%s, unmarshal failed:%s", fileName, err)
 					in.Close()
-					return err
+					corrupt.Reason = err.Error()
+					return corrupt
 				}
 				fsv.Timestamp = tslv.Timestamp
 				fsv.Data = tslv.Data
@@ -110,7 +170,7 @@ func (lg *fstLoggerImpl) ForEach(call func(key string, value *api.FstTsdbValue)
 					return err
 				}
 			} //end proccess a buffer
-			readOff += int(rLen + gBLK_V_H_LEN)
+			readOff += int(rLen + hLen)
 		} // end read a file
 		in.Close()
 	}
@@ -121,28 +181,26 @@ func (lg *fstLoggerImpl) Close() {
 	if lg.ios == nil {
 		return
 	}
-	if lg.cacheOff > gBLK_V_H_LEN {
-		putIntToB(lg.cache, lg.cacheOff-gBLK_V_H_LEN)
-		n, err := lg.ios.Write(lg.cache[0:lg.cacheOff])
-		if err != nil {
-			common.Logger.Warnf("put file=%s, fileOff=%d, readOff=%d,len=%d,error:%s", lg.tailName, lg.fileOff, lg.cacheOff, n, err)
-		}
+	if lg.cacheOff > gLOG_H_LEN {
+		_ = lg.flush()
 		lg.cache = nil
 	}
+	_ = lg.sync(gDur_Block)
 	lg.ios.Close()
 	lg.ios = nil
 	lg.fileOff = 0
-	lg.cacheOff = gBLK_V_H_LEN
+	lg.cacheOff = gLOG_H_LEN
 }
 
 func (lg *fstLoggerImpl) openForWr() error {
 	if lg.ios != nil {
 		return nil
 	}
-	dir := fmt.Sprintf("%s/%s/dlog", lg.dir, lg.table)
+	dir := lg.logDir()
 	os.MkdirAll(dir, 0755)
-	lg.cache = make([]byte, gBLK_OBJ_SIZE)
-	lg.cacheOff = gBLK_V_H_LEN
+	// 帧的大小和table的leaf block一样
+	lg.cache = make([]byte, tableLayout(lg.table).ObjSize)
+	lg.cacheOff = gLOG_H_LEN
 	tailFile, err := findTailFile(dir, lg.table)
 	if err != nil {
 		return err
@@ -167,52 +225,96 @@ func (lg *fstLoggerImpl) openForWr() error {
 
 func (lg *fstLoggerImpl) checkAndFlush(outLen uint32) error {
 	dLen := outLen + gBLK_V_H_LEN
-	if dLen+lg.cacheOff <= gBLK_OBJ_SIZE {
+	if dLen+lg.cacheOff <= uint32(len(lg.cache)) {
 		return nil
 	}
-	if (lg.fileOff + lg.cacheOff + dLen) > gBLK_FILE_SZ {
-		lg.ios.Close()
-		number, _ := getTailNumber(lg.tailName)
-		if number <= 0 {
-			return errors.New("tail number error")
+	if (lg.fileOff + lg.cacheOff + dLen) > tableLayout(lg.table).FileSize {
+		if _, err := lg.roll(); err != nil {
+			return err
 		}
-		lg.tailName = fmt.Sprintf("%s-%04d.log", lg.table, (number + 1))
-		common.Logger.Infof("open new file:%s", lg.tailName)
-		fileName := fmt.Sprintf("%s/%s/dlog/%s", lg.dir, lg.table, lg.tailName)
-		out, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
-		if err != nil {
+	}
+	if err := lg.flush(); err != nil {
+		return err
+	}
+	return lg.sync(gDur_Block)
+}
+
+// roll 之后的帧写到下一个文件, 返回换下来的文件编号; 缓存里的帧也写到新文件
+func (lg *fstLoggerImpl) roll() (int, error) {
+	if err := lg.openForWr(); err != nil {
+		return 0, err
+	}
+	number, _ := getTailNumber(lg.tailName)
+	if number <= 0 {
+		return 0, fmt.Errorf("%w: log name=%s", api.ErrCorrupt, lg.tailName)
+	}
+	_ = lg.sync(gDur_Block)
+	lg.ios.Close()
+	lg.tailName = fmt.Sprintf("%s-%04d.log", lg.table, (number + 1))
+	common.Logger.Infof("open new file:%s", lg.tailName)
+	fileName := fmt.Sprintf("%s/%s", lg.logDir(), lg.tailName)
+	out, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+	if err != nil {
+		lg.ios = nil
+		return 0, err
+	}
+	lg.ios = out
+	lg.fileOff = 0
+	return number, nil
+}
+
+// removeTo 删掉编号不大于number的日志文件
+func (lg *fstLoggerImpl) removeTo(number int) error {
+	head, _, err := findLogFiles(lg.logDir(), lg.table)
+	if err != nil || head == 0 {
+		return err
+	}
+	for n := head; n <= number; n++ {
+		fileName := fmt.Sprintf("%s/%s-%04d.log", lg.logDir(), lg.table, n)
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
 			return err
 		}
-		lg.ios = out
-		lg.fileOff = 0
+	}
+	return nil
+}
+
+// flush 把cache作为一帧写入文件, 帧头是长度和校验和
+func (lg *fstLoggerImpl) flush() error {
+	if lg.cacheOff <= gLOG_H_LEN {
+		return nil
 	}
 	common.Logger.Debugf("file:%s, flush off=%d and off=%d", lg.tailName, lg.cacheOff, lg.fileOff)
-	putIntToB(lg.cache, (lg.cacheOff - gBLK_V_H_LEN))
+	putIntToB(lg.cache, (lg.cacheOff - gLOG_H_LEN))
+	putIntToB(lg.cache[gBLK_V_H_LEN:], checksum(lg.cache[gLOG_H_LEN:lg.cacheOff]))
 	n, err := lg.ios.Write(lg.cache[0:lg.cacheOff])
 	if err != nil {
 		common.Logger.Warnf("put file=%s, fileOff=%d, readOff=%d,len=%d,error:%s", lg.tailName, lg.fileOff, lg.cacheOff, n, err)
 		return err
 	}
 	lg.fileOff += lg.cacheOff
-	lg.cacheOff = gBLK_V_H_LEN
+	lg.cacheOff = gLOG_H_LEN
 	return nil
 }
 
+func (lg *fstLoggerImpl) sync(event int) error {
+	name := fmt.Sprintf("%s/%s", lg.logDir(), lg.tailName)
+	return durableSync(lg.ios, lg.table, name, event)
+}
+
+func (lg *fstLoggerImpl) logDir() string {
+	return fmt.Sprintf("%s/%s/%s", lg.dir, lg.table, lg.sub)
+}
+
 func getTailNumber(name string) (int, error) {
-	start := 0
-	for {
-		if name[start] >= '1' && name[start] <= '9' {
-			break
-		}
-		start++
-	}
+	// name: table-0001.log
+	start := strings.LastIndexByte(name, '-') + 1
 	sLen := len(name)
-	if start >= sLen {
-		return -1, errors.New("format error")
+	if start <= 0 || start >= sLen {
+		return -1, fmt.Errorf("%w: log name=%s", api.ErrCorrupt, name)
 	}
 	number := 0
 	for start < sLen {
-		if name[start] < '1' || name[start] > '9' {
+		if name[start] < '0' || name[start] > '9' {
 			break
 		}
 		number = number*10 + int(name[start]-'0')
@@ -222,25 +324,36 @@ func getTailNumber(name string) (int, error) {
 }
 
 func findTailFile(dir string, sufix string) (string, error) {
-	tailFile := ""
+	_, tail, err := findLogFiles(dir, sufix)
+	if err != nil || tail == 0 {
+		return "", err
+	}
+	tailFile := fmt.Sprintf("%s-%04d.log", sufix, tail)
+	common.Logger.Infof("Find dir=%s, sufix=%s, tail=%s", dir, sufix, tailFile)
+	return tailFile, nil
+}
+
+// findLogFiles 按编号找第一个和最后一个日志文件, checkpoint会删掉前面的文件; 没有文件时都是0
+func findLogFiles(dir string, sufix string) (int, int, error) {
+	head, tail := 0, 0
 	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if d.IsDir() {
+		if d.IsDir() || !strings.HasPrefix(d.Name(), sufix+"-") {
 			return nil
 		}
-		if !strings.HasPrefix(d.Name(), sufix) {
+		number, err := getTailNumber(d.Name())
+		if err != nil || number <= 0 {
 			return nil
 		}
-		if tailFile == "" || strings.Compare(d.Name(), tailFile) > 0 {
-			tailFile = d.Name()
+		if head == 0 || number < head {
+			head = number
+		}
+		if number > tail {
+			tail = number
 		}
 		return nil
 	})
-	if err != nil {
-		return tailFile, err
-	}
-	common.Logger.Infof("Find dir=%s, sufix=%s, tail=%s", dir, sufix, tailFile)
-	return tailFile, nil
+	return head, tail, err
 }
@@ -0,0 +1,46 @@
+package impl
+
+import (
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+// countLog 用另一个句柄从文件里读, 不经过写句柄的cache
+func countLog(t *testing.T, dir, table string) int64 {
+	t.Helper()
+	n := int64(0)
+	if err := NewLogger(dir, table).ForEach(func(key string, v *api.FstTsdbValue) error {
+		if n++; key != "k" || v.Timestamp != n || string(v.Data) != string(testValue(n)) {
+			t.Fatal("log", key, v.Timestamp)
+		}
+		return nil
+	}); err != nil && err != api.ErrEmpty {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestLoggerAppendDurable(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{Tables: map[string]api.TableConf{"a": {Durability: api.DURABILITY_APPEND}}})
+	for _, table := range []string{"a", "t"} {
+		lg := NewLogger(dir, table)
+		for ts := int64(1); ts <= 10; ts++ {
+			if err := lg.Append("k", &api.FstTsdbValue{Timestamp: ts, Data: testValue(ts)}); err != nil {
+				t.Fatal(err)
+			}
+			// append模式下每条返回时已经在文件里, 其它模式攒在cache里
+			want := int64(0)
+			if table == "a" {
+				want = ts
+			}
+			if n := countLog(t, dir, table); n != want {
+				t.Fatal(table, n, want)
+			}
+		}
+		lg.Close()
+		if n := countLog(t, dir, table); n != 10 {
+			t.Fatal(table, n)
+		}
+	}
+}
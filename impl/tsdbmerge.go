@@ -0,0 +1,479 @@
+package impl
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 暂存区超过该数量就合并到数据链
+var gOOO_MERGE_LIMIT = 4096
+
+// mergeLate 共用的写句柄上调用, 持有series的写锁
+func (tsdb *fstTsdbImpl) mergeLate() error {
+	if tsdb.appender == nil || len(tsdb.appender.late) == 0 {
+		return nil
+	}
+	if err := tsdb.appender.merge(); err != nil {
+		return err
+	}
+	return tsdb.appender.flush()
+}
+
+// stage 迟到的数据先按时间排序放到暂存区,相同时间戳后到的覆盖先到的
+func (ta *tsdbAppender) stage(value *api.FstTsdbValue) error {
+	tv := &api.FstTsdbValue{Timestamp: value.Timestamp, Data: duplicate(value.Data)}
+	pos := sort.Search(len(ta.late), func(i int) bool {
+		return ta.late[i].Timestamp > tv.Timestamp
+	})
+	ta.late = append(ta.late, nil)
+	copy(ta.late[pos+1:], ta.late[pos:])
+	ta.late[pos] = tv
+	if len(ta.late) >= gOOO_MERGE_LIMIT {
+		return ta.merge()
+	}
+	return nil
+}
+
+// lateUpTo 暂存区里时间戳<=key的数据, 相同时间戳只留最后到的
+func lateUpTo(late []*api.FstTsdbValue, key int64) []*api.FstTsdbValue {
+	out := make([]*api.FstTsdbValue, 0)
+	for i, v := range late {
+		if v.Timestamp > key {
+			break
+		}
+		if i+1 < len(late) && late[i+1].Timestamp == v.Timestamp {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// overlayLast 把迟到数据叠加到GetLastN从链上读出来的数据上, 返回最后limit个
+func overlayLast(base *list.List, late []*api.FstTsdbValue, limit int) (*list.List, error) {
+	out := list.New()
+	var b *list.Element
+	if base != nil {
+		b = base.Back()
+	}
+	j := len(late) - 1
+	for out.Len() < limit && (b != nil || j >= 0) {
+		if j >= 0 && (b == nil || late[j].Timestamp >= b.Value.(*api.FstTsdbValue).Timestamp) {
+			if b != nil && late[j].Timestamp == b.Value.(*api.FstTsdbValue).Timestamp {
+				b = b.Prev()
+			}
+			out.PushFront(&api.FstTsdbValue{Timestamp: late[j].Timestamp, Data: late[j].Data})
+			j--
+			continue
+		}
+		out.PushFront(b.Value)
+		b = b.Prev()
+	}
+	if out.Len() == 0 {
+		return nil, api.ErrEmpty
+	}
+	return out, nil
+}
+
+// merge 从最早的迟到点开始, 把旧数据和暂存区边读边归并写到新分配的block链.
+// 旧链在新链落盘之前不改; 新链写完后topRef和前驱block头的改动在一个bolt事务里提交, 再改前驱, 截下来的旧链等读完后回收
+func (ta *tsdbAppender) merge() error {
+	if len(ta.late) == 0 {
+		return nil
+	}
+	late := ta.late
+	if err := ta.flush(); err != nil {
+		return err
+	}
+	src, mlog, err := ta.cutTail(late[0].Timestamp)
+	if err != nil {
+		common.Logger.Infof("cut symbol=%s at %d failed:%s", ta.impl.symbol, late[0].Timestamp, err)
+		ta.reset()
+		return err
+	}
+	common.Logger.Debugf("merge symbol=%s, late=%d", ta.impl.symbol, len(late))
+	ta.late = nil
+	if err = ta.mergeTo(src, late); err == nil {
+		err = ta.writeCaches()
+	}
+	if err != nil {
+		// 旧链没有改过, 迟到的数据留在暂存区; 新链上已经分配的block由CheckTable回收
+		common.Logger.Warnf("merge symbol=%s failed:%s", ta.impl.symbol, err)
+		ta.late = late
+		ta.reset()
+		return err
+	}
+	mlog.Freed = src.freed
+	if err = commitMerge(ta.impl.table, ta.impl.symbol, ta.topRef, mlog); err != nil {
+		ta.late = late
+		ta.reset()
+		return err
+	}
+	if err = finishMerge(ta.impl.dataDir, ta.impl.table, ta.impl.symbol, mlog); err != nil {
+		// 已经提交, 下次加载写句柄或者启动时重做
+		ta.reset()
+		return err
+	}
+	return nil
+}
+
+// mergeTo 归并旧数据和暂存区, 相同时间戳以最后到的为准
+func (ta *tsdbAppender) mergeTo(src *mergeSrc, late []*api.FstTsdbValue) error {
+	j := 0
+	for {
+		older, err := src.peek()
+		if err != nil {
+			return err
+		}
+		var v *api.FstTsdbValue
+		if j < len(late) && (older == nil || late[j].Timestamp <= older.Timestamp) {
+			for (j+1) < len(late) && late[j+1].Timestamp == late[j].Timestamp {
+				j++
+			}
+			v = late[j]
+			j++
+			if older != nil && older.Timestamp == v.Timestamp {
+				src.skip()
+			}
+		} else if older != nil {
+			v = older
+			src.skip()
+		} else {
+			return nil
+		}
+		if err = ta.appendData(v); err != nil {
+			return err
+		}
+	}
+}
+
+// reset 丢掉内存里的尾block, 下次写入时从bolt和磁盘重新加载
+func (ta *tsdbAppender) reset() {
+	ta.topRef = nil
+	ta.lastRidx = nil
+	ta.ridxCache = nil
+	ta.idxCache = nil
+	ta.datCache = nil
+	ta.chunk = nil
+	ta.headLow = nil
+}
+
+func mergeKey(symbol string) string {
+	return fmt.Sprintf("tsdb.merge.%s", symbol)
+}
+
+// commitMerge 新链已经落盘, topRef和合并记录一起提交
+func commitMerge(table, symbol string, topRef *BlockAddr, mlog *MergeLog) error {
+	ref, _ := topRef.MarshalBinary()
+	buf, _ := mlog.MarshalBinary()
+	return blotDb.Update(func(tx *bolt.Tx) error {
+		buck, err := tableBucket(tx, table)
+		if err != nil {
+			return err
+		}
+		if err = buck.Put([]byte(symbol), ref); err != nil {
+			return err
+		}
+		return buck.Put([]byte(mergeKey(symbol)), buf)
+	})
+}
+
+// finishMerge 把新链接到前驱后面, 删掉合并记录后回收截下来的旧链; 改前驱可以重复执行
+func finishMerge(dir, table, symbol string, mlog *MergeLog) error {
+	for _, p := range mlog.Patches {
+		datype := gData_Types[p.Type]
+		blk := &Block{}
+		if err := loadBlock(&p.Addr, dir, table, datype, blk); err != nil {
+			return err
+		}
+		if p.Len != gKEEP_LEN {
+			blk.BH.Len = p.Len
+		}
+		blk.BH.Next = p.Next
+		if err := saveBlock(&p.Addr, dir, table, datype, blk); err != nil {
+			return err
+		}
+	}
+	// 先删记录再回收, 回收过的block不会被重做时再回收一次
+	if err := delBValue(table, mergeKey(symbol)); err != nil {
+		return err
+	}
+	return retireBlocks(dir, table, mlog.Freed)
+}
+
+// redoMerge 提交了但没改完前驱的合并, 调用时没有别的写句柄
+func redoMerge(dir, table, symbol string) error {
+	buf, err := getBValue(table, mergeKey(symbol))
+	if errors.Is(err, api.ErrEmpty) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mlog := &MergeLog{}
+	if err = mlog.UnmarshalBinary(buf); err != nil {
+		return err
+	}
+	common.Logger.Infof("redo merge table=%s, symbol=%s, patches=%d", table, symbol, len(mlog.Patches))
+	return finishMerge(dir, table, symbol, mlog)
+}
+
+// redoMerges 启动时重做所有没做完的合并
+func redoMerges(dir string) error {
+	pending := make(map[string][]string)
+	err := blotDb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, buck *bolt.Bucket) error {
+			prefix := []byte(mergeKey(""))
+			c := buck.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				pending[string(name)] = append(pending[string(name)], string(k[len(prefix):]))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for table, symbols := range pending {
+		for _, symbol := range symbols {
+			if err = redoMerge(dir, table, symbol); err != nil {
+				return fmt.Errorf("table %s symbol %s:%w", table, symbol, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeSrc 顺序读截下来的旧数据, 只持有当前的leaf block; 读过的leaf和ovf block等新的链落盘后回收
+type mergeSrc struct {
+	rd     *tsdbRDCache
+	kind   uint8
+	cur    *api.FstTsdbValue
+	points []TsdbValue
+	done   bool
+	freed  map[string][]*BlockAddr
+}
+
+// peek 返回下一个旧数据, 读完时返回nil
+func (m *mergeSrc) peek() (*api.FstTsdbValue, error) {
+	if m.cur != nil || m.done {
+		return m.cur, nil
+	}
+	for len(m.points) == 0 {
+		tv := &TsdbValue{}
+		addr := m.rd.addr
+		err := m.rd.forward(tv)
+		if errors.Is(err, api.ErrEOF) {
+			m.done = true
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.rd.addr != addr {
+			m.freed[gData_VAL] = append(m.freed[gData_VAL], &BlockAddr{SegNo: m.rd.addr.SegNo, SegOffset: m.rd.addr.SegOffset})
+		}
+		// 重新追加时会写新的ovf链
+		ovf, err := m.rd.resolve(tv)
+		if err != nil {
+			return nil, err
+		}
+		m.freed[gData_OVF] = append(m.freed[gData_OVF], ovf...)
+		if m.kind == 0 {
+			m.cur = &api.FstTsdbValue{Timestamp: tv.Timestamp, Data: tv.Data}
+			return m.cur, nil
+		}
+		if m.points, err = expandChunk(tv, false); err != nil {
+			return nil, err
+		}
+	}
+	m.cur = &api.FstTsdbValue{Timestamp: m.points[0].Timestamp, Data: m.points[0].Data}
+	m.points = m.points[1:]
+	return m.cur, nil
+}
+
+func (m *mergeSrc) skip() {
+	m.cur = nil
+}
+
+// cutTail 定位截断点, 返回从截断点开始读旧数据的mergeSrc和要改的前驱.
+// 截断点所在的leaf和idx block保留前半段, 改短之后接上新链; ridx block复制前半段到新block, 它的前驱或者topRef指向新block.
+// 写缓存换成新分配的block, 截下来的旧block在合并提交之后回收
+func (ta *tsdbAppender) cutTail(key int64) (*mergeSrc, *MergeLog, error) {
+	impl := ta.impl
+	rAddr := &BlockAddr{SegNo: ta.topRef.SegNo, SegOffset: ta.topRef.SegOffset}
+	rBlk := &Block{}
+	ridx := &TsdbRangIndex{}
+	k := uint32(0)
+	for {
+		err := loadBlock(rAddr, impl.dataDir, impl.table, gData_RIDX, rBlk)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := false
+		for k = 0; (k * gTSDB_RIDX_LEN) < rBlk.BH.Len; k++ {
+			if err = ridx.UnmarshalBinary(rBlk.Data[k*gTSDB_RIDX_LEN:]); err != nil {
+				return nil, nil, err
+			}
+			if int64(ridx.High) > key {
+				found = true
+				break
+			}
+		}
+		if found {
+			break
+		}
+		if rBlk.BH.Next.SegNo == 0 {
+			return nil, nil, api.ErrEmpty
+		}
+		rAddr = &BlockAddr{SegNo: rBlk.BH.Next.SegNo, SegOffset: rBlk.BH.Next.SegOffset}
+	}
+
+	iAddr := &BlockAddr{SegNo: ridx.Addr.SegNo, SegOffset: ridx.Addr.SegOffset}
+	iBlk := &Block{}
+	if err := loadBlock(iAddr, impl.dataDir, impl.table, gData_IDX, iBlk); err != nil {
+		return nil, nil, err
+	}
+	tidx := &TsdbIndex{}
+	cnt := int(iBlk.BH.Len / gTSDB_IDX_LEN)
+	e := uint32(sort.Search(cnt, func(i int) bool {
+		_ = tidx.UnmarshalBinary(iBlk.Data[uint32(i)*gTSDB_IDX_LEN:])
+		return int64(tidx.Key) >= key
+	}))
+	kind, err := impl.getKind()
+	if err != nil {
+		return nil, nil, err
+	}
+	if kind != 0 && e > 0 {
+		// 从包含key的chunk开始截断
+		if int(e) >= cnt {
+			e--
+		} else if _ = tidx.UnmarshalBinary(iBlk.Data[e*gTSDB_IDX_LEN:]); int64(tidx.Key) > key {
+			e--
+		}
+	}
+	if int(e) >= cnt {
+		return nil, nil, api.ErrEmpty
+	}
+	if err := tidx.UnmarshalBinary(iBlk.Data[e*gTSDB_IDX_LEN:]); err != nil {
+		return nil, nil, err
+	}
+
+	objSize := impl.layout().ObjSize
+	lAddr := &BlockAddr{SegNo: tidx.Addr.SegNo, SegOffset: getValueSegOff(tidx.Addr.SegOffset, objSize)}
+	lBlk := &Block{}
+	if err := loadBlock(lAddr, impl.dataDir, impl.table, gData_VAL, lBlk); err != nil {
+		return nil, nil, err
+	}
+	lOff := getValueBlkOff(tidx.Addr.SegOffset, objSize)
+	rd := &tsdbRDCache{blkSize: objSize, readOff: lOff, dataType: gData_VAL, impl: impl, addr: *lAddr, block: lBlk}
+	freed := map[string][]*BlockAddr{gData_RIDX: {rAddr}}
+	src := &mergeSrc{rd: rd, kind: kind, freed: freed}
+	// 截下来的idx/ridx block
+	for _, c := range []struct {
+		datype string
+		next   BlockAddr
+	}{{gData_IDX, iBlk.BH.Next}, {gData_RIDX, rBlk.BH.Next}} {
+		for next := c.next; next.SegNo != 0; {
+			blk := &Block{}
+			if err := loadBlock(&next, impl.dataDir, impl.table, c.datype, blk); err != nil {
+				return nil, nil, err
+			}
+			freed[c.datype] = append(freed[c.datype], &BlockAddr{SegNo: next.SegNo, SegOffset: next.SegOffset})
+			next = blk.BH.Next
+		}
+	}
+
+	mlog := &MergeLog{}
+	// 截断点在block开头时整个block回收, 新链接在它的前驱后面
+	tail := func(datype string, addr *BlockAddr, blk *Block, keep uint32) *BlockAddr {
+		if keep > 0 {
+			mlog.Patches = append(mlog.Patches, MergePatch{Type: dataTypeNo(datype), Addr: *addr, Len: keep})
+			return addr
+		}
+		freed[datype] = append(freed[datype], addr)
+		if blk.BH.Pre.SegNo == 0 {
+			return nil
+		}
+		pre := blk.BH.Pre
+		mlog.Patches = append(mlog.Patches, MergePatch{Type: dataTypeNo(datype), Addr: pre, Len: gKEEP_LEN})
+		return &pre
+	}
+	lPre := tail(gData_VAL, lAddr, lBlk, lOff)
+	iPre := tail(gData_IDX, iAddr, iBlk, e*gTSDB_IDX_LEN)
+	var rPre *BlockAddr
+	if rBlk.BH.Pre.SegNo != 0 {
+		pre := rBlk.BH.Pre
+		rPre = &pre
+		mlog.Patches = append(mlog.Patches, MergePatch{Type: dataTypeNo(gData_RIDX), Addr: pre, Len: gKEEP_LEN})
+	}
+
+	caches := make([]*tsdbWRCache, 3)
+	for i, c := range []struct {
+		datype string
+		pre    *BlockAddr
+	}{{gData_RIDX, rPre}, {gData_IDX, iPre}, {gData_VAL, lPre}} {
+		if caches[i], err = allocBlockByType(c.datype, c.pre, impl); err != nil {
+			for _, ca := range caches[:i] {
+				freeBlocks(impl.dataDir, impl.table, map[string][]*BlockAddr{ca.dataType: {ca.addr}})
+			}
+			return nil, nil, err
+		}
+	}
+	// 前驱的Next指向新block, 没有前驱的ridx block由topRef指向
+	for i := range mlog.Patches {
+		p := &mlog.Patches[i]
+		for _, ca := range caches {
+			if gData_Types[p.Type] == ca.dataType {
+				p.Next = *ca.addr
+			}
+		}
+	}
+	head := rPre == nil
+	if head {
+		ta.topRef = &BlockAddr{SegNo: caches[0].addr.SegNo, SegOffset: caches[0].addr.SegOffset}
+	}
+	ta.ridxCache, ta.idxCache, ta.datCache = caches[0], caches[1], caches[2]
+
+	rNew := ta.ridxCache.block
+	if e == 0 {
+		if k == 0 && head {
+			// 保留DeleteBefore设置的下界
+			low := ridx.Low
+			ta.headLow = &low
+		}
+		copy(rNew.Data, rBlk.Data[:k*gTSDB_RIDX_LEN])
+		rNew.BH.Len = k * gTSDB_RIDX_LEN
+		ta.lastRidx = nil
+	} else {
+		pre := &TsdbIndex{}
+		if err := pre.UnmarshalBinary(iBlk.Data[(e-1)*gTSDB_IDX_LEN:]); err != nil {
+			return nil, nil, err
+		}
+		ridx.High = pre.Key + 1
+		ridx.Off = k + 1
+		copy(rNew.Data, rBlk.Data[:k*gTSDB_RIDX_LEN])
+		out, _ := ridx.MarshalBinary()
+		bcopy(rNew.Data, out, k*gTSDB_RIDX_LEN, 0, gTSDB_RIDX_LEN)
+		rNew.BH.Len = (k + 1) * gTSDB_RIDX_LEN
+		ta.lastRidx = ridx
+	}
+	ta.chunk = nil
+	return src, mlog, nil
+}
+
+func dataTypeNo(datype string) uint8 {
+	for i, t := range gData_Types {
+		if t == datype {
+			return uint8(i)
+		}
+	}
+	return 0
+}
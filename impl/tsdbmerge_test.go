@@ -0,0 +1,156 @@
+package impl
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func checkTable(t *testing.T, dir, table string) {
+	t.Helper()
+	r, err := CheckTable(dir, table, false)
+	if err != nil || r.Leaked != 0 || r.Conflict != 0 || r.Missing != 0 {
+		t.Fatal(err, r)
+	}
+}
+
+// appendLate 先写偶数, 落盘后再写奇数, 奇数都进暂存区
+func appendLate(t *testing.T, dir string, n int64) *fstTsdbImpl {
+	t.Helper()
+	db := NewTsdb(dir, "t", "s")
+	for ts := int64(2); ts <= n; ts += 2 {
+		appendValues(t, db, ts, ts)
+	}
+	db.Close()
+	db = NewTsdb(dir, "t", "s")
+	for ts := int64(1); ts <= n; ts += 2 {
+		appendValues(t, db, ts, ts)
+	}
+	return db
+}
+
+func stagedLen(db *fstTsdbImpl) int {
+	db.series.lock.RLock()
+	defer db.series.lock.RUnlock()
+	if w := db.series.writer; w != nil && w.appender != nil {
+		return len(w.appender.late)
+	}
+	return 0
+}
+
+func TestMergeLateVisible(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{OutOfOrder: true})
+	db := appendLate(t, dir, 4000)
+	defer db.Close()
+	checkValues(t, dir, "t", "s", 4000)
+	it := db.RangeReverse(math.MinInt64, math.MaxInt64)
+	for ts := int64(4000); it.Next(); ts-- {
+		if it.Value().Timestamp != ts || string(it.Value().Data) != string(testValue(ts)) {
+			t.Fatal("reverse", it.Value().Timestamp, ts)
+		}
+	}
+	it.Close()
+	l, err := db.GetLastN(1001, 5)
+	if err != nil || l.Len() != 5 || l.Front().Value.(*api.FstTsdbValue).Timestamp != 997 || l.Back().Value.(*api.FstTsdbValue).Timestamp != 1001 {
+		t.Fatal(err, l)
+	}
+	ts, cursor := int64(1), ""
+	for {
+		p, err := db.GetPage(0, math.MaxInt64, cursor, 333)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range p.Values {
+			if v.Timestamp != ts {
+				t.Fatal("page", v.Timestamp, ts)
+			}
+			ts++
+		}
+		if cursor = p.Cursor; cursor == "" {
+			break
+		}
+	}
+	if ts != 4001 {
+		t.Fatal("pages end at", ts)
+	}
+	// 读不会触发合并
+	if n := stagedLen(db); n != 2000 {
+		t.Fatal("staged", n)
+	}
+	// 迟到的数据覆盖已经写的
+	if err = db.Append(&api.FstTsdbValue{Timestamp: 10, Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = db.GetLastN(10, 1); err != nil || string(l.Front().Value.(*api.FstTsdbValue).Data) != "x" {
+		t.Fatal(err, l)
+	}
+	if err = db.Append(&api.FstTsdbValue{Timestamp: 10, Data: testValue(10)}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	checkValues(t, dir, "t", "s", 4000)
+	checkTable(t, dir, "t")
+}
+
+// stepMerge 按merge的步骤做到新链落盘, commit时再提交合并记录, 但不改前驱
+func stepMerge(t *testing.T, db *fstTsdbImpl, commit bool) {
+	t.Helper()
+	db.series.lock.Lock()
+	defer db.series.lock.Unlock()
+	ta := db.series.writer.appender
+	late := ta.late
+	if err := ta.flush(); err != nil {
+		t.Fatal(err)
+	}
+	src, mlog, err := ta.cutTail(late[0].Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.late = nil
+	if err = ta.mergeTo(src, late); err != nil {
+		t.Fatal(err)
+	}
+	if err = ta.writeCaches(); err != nil {
+		t.Fatal(err)
+	}
+	if !commit {
+		return
+	}
+	mlog.Freed = src.freed
+	if err = commitMerge(db.table, db.symbol, ta.topRef, mlog); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeCrashBeforeCommit(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{OutOfOrder: true})
+	db := appendLate(t, dir, 20000)
+	stepMerge(t, db, false)
+	// 旧链没改过, 迟到的数据从wal重放
+	crashDb(t)
+	checkValues(t, dir, "t", "s", 20000)
+	r, err := CheckTable(dir, "t", false)
+	if err != nil || r.Conflict != 0 || r.Missing != 0 {
+		t.Fatal(err, r)
+	}
+}
+
+func TestMergeCrashAfterCommit(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{OutOfOrder: true})
+	db := appendLate(t, dir, 20000)
+	stepMerge(t, db, true)
+	// 去掉wal, 只靠合并记录在启动时把新链接到前驱后面
+	closeWals()
+	if err := os.RemoveAll(dir + "/t/" + gWal_Dir); err != nil {
+		t.Fatal(err)
+	}
+	crashDb(t)
+	if _, err := getBValue("t", mergeKey("s")); !errors.Is(err, api.ErrEmpty) {
+		t.Fatal("merge log is left", err)
+	}
+	checkValues(t, dir, "t", "s", 20000)
+	checkTable(t, dir, "t")
+}
@@ -0,0 +1,443 @@
+package impl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 迁移按逻辑数据重写到新目录: 序列从旧的leaf链读出来重新追加, 对象按内容重写, wal和dlog按记录重写;
+// 空闲表和分配位置在新目录里重新生成. 原地升级先写到<dir>.migrate, 成功后再替换原目录
+
+var gMIGRATE_BATCH = 4096
+var gMIGRATE_BYTES = 16 << 20
+
+// MigrateDir 离线把c.DataDir升级到当前格式, dst为空时原地升级, 否则写到dst(不存在或是空目录).
+// 必须在StartDb之前或StopDb之后调用; 旧数据用到的codec要先注册
+func MigrateDir(c *api.TsdbConf, dst string) error {
+	if blotDb != nil {
+		return api.ErrBusy
+	}
+	src := c.DataDir
+	inPlace := (dst == "") || (filepath.Clean(dst) == filepath.Clean(src))
+	out := dst
+	if inPlace {
+		out = src + ".migrate"
+		if err := os.RemoveAll(out); err != nil {
+			return err
+		}
+	} else if entries, err := os.ReadDir(dst); err == nil && len(entries) > 0 {
+		return fmt.Errorf("migrate dst=%s is not empty", dst)
+	}
+	if err := loadCodecs(c); err != nil {
+		return err
+	}
+	err := migrateTo(src, out, inPlace)
+	if errors.Is(err, errUpToDate) {
+		common.Logger.Infof("migrate dir=%s is up to date", src)
+		return nil
+	}
+	if err != nil {
+		common.Logger.Warnf("migrate dir=%s to %s failed:%s", src, out, err)
+		if inPlace {
+			os.RemoveAll(out)
+		}
+		return err
+	}
+	if !inPlace {
+		return nil
+	}
+	old := src + ".old"
+	if err = os.Rename(src, old); err != nil {
+		return err
+	}
+	if err = os.Rename(out, src); err != nil {
+		return err
+	}
+	common.Logger.Infof("migrate dir=%s done", src)
+	return os.RemoveAll(old)
+}
+
+var errUpToDate = errors.New("format is up to date")
+
+func migrateTo(src, dst string, inPlace bool) error {
+	srcDb, err := bolt.Open(fmt.Sprintf("%s/blot/blot.db", src), 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer srcDb.Close()
+	m, tables, err := detectFormat(src, srcDb)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("migrate dir=%s: no data", src)
+	}
+	if inPlace && compatible(m, src) == nil {
+		current := true
+		for table, tm := range tables {
+			current = current && (compatible(tm, table) == nil)
+		}
+		if current {
+			return errUpToDate
+		}
+	}
+	common.Logger.Infof("migrate dir=%s, version=%d to %s, version=%d", src, m.Version, dst, gFORMAT_VER)
+
+	if err = os.MkdirAll(fmt.Sprintf("%s/blot", dst), 0755); err != nil {
+		return err
+	}
+	dstDb, err := bolt.Open(fmt.Sprintf("%s/blot/blot.db", dst), 0600, nil)
+	if err != nil {
+		return err
+	}
+	blotDb = dstDb
+	resetLayouts()
+	defer func() {
+		dstDb.Close()
+		blotDb = nil
+		resetLayouts()
+		resetBlockCache()
+		closeSegs()
+	}()
+	if err = writeSuper(dst, currentFormat()); err != nil {
+		return err
+	}
+	for table, tm := range tables {
+		mr := &migrateReader{db: srcDb, dir: src, table: table, format: tm}
+		// 新table沿用原来的block大小
+		lay := *tm
+		lay.Version, lay.BhLen = gFORMAT_VER, gBH_LEN
+		if err = dstDb.Update(func(tx *bolt.Tx) error {
+			_, err := createTable(tx, table, &lay)
+			return err
+		}); err != nil {
+			return fmt.Errorf("table %s:%w", table, err)
+		}
+		if err = mr.copyTable(dst); err != nil {
+			return fmt.Errorf("table %s:%w", table, err)
+		}
+	}
+	if err = copyLogs(src, dst, m); err != nil {
+		return err
+	}
+	return syncTree(dst)
+}
+
+// migrateReader 按源table的格式读block, 不依赖当前的block头长度
+type migrateReader struct {
+	db     *bolt.DB
+	dir    string
+	table  string
+	format *FormatMeta
+}
+
+func (mr *migrateReader) loadBlock(addr *BlockAddr, datype string) (*Block, error) {
+	blk := &Block{}
+	buf := make([]byte, mr.format.blockSize(datype))
+	name := fmt.Sprintf(gSeg_Fmt, mr.dir, mr.table, addr.SegNo, datype)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.ReadAt(buf, int64(addr.SegOffset))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if mr.format.Version == gFORMAT_VER {
+		if err = verifyBlock(buf, addr, mr.table, datype); err != nil {
+			return nil, err
+		}
+		if err = blk.UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+		return blk, decodeBlock(blk)
+	}
+	bhLen := mr.format.BhLen
+	lwd := binary.LittleEndian
+	blk.BH.Pre.SegNo = lwd.Uint32(buf)
+	blk.BH.Pre.SegOffset = lwd.Uint32(buf[4:])
+	blk.BH.Next.SegNo = lwd.Uint32(buf[8:])
+	blk.BH.Next.SegOffset = lwd.Uint32(buf[12:])
+	blk.BH.Len = lwd.Uint32(buf[16:]) & gCODEC_MASK
+	blk.BH.Codec = uint8(lwd.Uint32(buf[16:]) >> gCODEC_SHIFT)
+	blk.Data = buf[bhLen:]
+	if blk.BH.Len > uint32(len(blk.Data)) {
+		return nil, &api.CorruptError{Table: mr.table, Type: datype, Segment: addr.SegNo, Offset: int64(addr.SegOffset), Reason: "length out of block"}
+	}
+	return blk, decodeBlock(blk)
+}
+
+// readOverflow 按源table的格式读ovf链
+func (mr *migrateReader) readOverflow(buf []byte) ([]byte, error) {
+	ref := &OvfRef{}
+	if err := ref.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, ref.Size)
+	for addr := ref.Head; addr.SegNo != 0; {
+		blk, err := mr.loadBlock(&addr, gData_OVF)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(out))+blk.BH.Len > ref.Size {
+			return nil, &api.CorruptError{Table: mr.table, Type: gData_OVF, Segment: addr.SegNo, Offset: int64(addr.SegOffset), Reason: "overflow size"}
+		}
+		out = append(out, blk.Data[:blk.BH.Len]...)
+		addr = blk.BH.Next
+	}
+	if uint32(len(out)) != ref.Size {
+		return nil, &api.CorruptError{Table: mr.table, Type: gData_OVF, Segment: ref.Head.SegNo, Offset: int64(ref.Head.SegOffset), Reason: "overflow chain is short"}
+	}
+	return out, nil
+}
+
+func (mr *migrateReader) copyTable(dst string) error {
+	refs := make(map[string]*BlockAddr)
+	objs := make(map[string]*ObjRef)
+	kinds := make(map[string]uint8)
+	floors := make(map[string]int64)
+	err := mr.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(mr.table)).ForEach(func(k, v []byte) error {
+			key := string(k)
+			switch {
+			case strings.HasPrefix(key, "tsdb.num."):
+				if len(v) > 0 {
+					kinds[strings.TrimPrefix(key, "tsdb.num.")] = v[0]
+				}
+			case strings.HasPrefix(key, "tsdb.del."):
+				if len(v) >= 8 {
+					floors[strings.TrimPrefix(key, "tsdb.del.")] = int64(binary.LittleEndian.Uint64(v))
+				}
+			case strings.HasPrefix(key, "tsdb."):
+				// 分配位置, 空闲表和格式记录在新目录里重新生成
+			case strings.HasPrefix(key, "fobj."):
+				ref := &ObjRef{}
+				if err := ref.UnmarshalBinary(v); err != nil {
+					return err
+				}
+				objs[strings.TrimPrefix(key, "fobj.")] = ref
+			default:
+				ref := &BlockAddr{}
+				if err := ref.UnmarshalBinary(v); err != nil {
+					return err
+				}
+				refs[key] = ref
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for symbol, ref := range refs {
+		floor, ok := floors[symbol]
+		if !ok {
+			floor = math.MinInt64
+		}
+		if err = mr.copySeries(dst, symbol, ref, kinds[symbol], floor); err != nil {
+			return fmt.Errorf("symbol %s:%w", symbol, err)
+		}
+	}
+	for key, ref := range objs {
+		if err = mr.copyObject(dst, key, ref); err != nil {
+			return fmt.Errorf("object %s:%w", key, err)
+		}
+	}
+	common.Logger.Infof("migrate table=%s, series=%d, objects=%d", mr.table, len(refs), len(objs))
+	return nil
+}
+
+// firstLeaf 第一个range index指向的第一个数据
+func (mr *migrateReader) firstLeaf(topRef *BlockAddr) (*BlockAddr, uint32, error) {
+	rBlk, err := mr.loadBlock(topRef, gData_RIDX)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rBlk.BH.Len < mr.format.RidxLen {
+		return nil, 0, api.ErrEmpty
+	}
+	ridx := &TsdbRangIndex{}
+	if err = ridx.UnmarshalBinary(rBlk.Data); err != nil {
+		return nil, 0, err
+	}
+	iBlk, err := mr.loadBlock(&ridx.Addr, gData_IDX)
+	if err != nil {
+		return nil, 0, err
+	}
+	if iBlk.BH.Len < mr.format.IdxLen {
+		return nil, 0, api.ErrEmpty
+	}
+	tidx := &TsdbIndex{}
+	if err = tidx.UnmarshalBinary(iBlk.Data); err != nil {
+		return nil, 0, err
+	}
+	size := mr.format.ObjSize
+	addr := &BlockAddr{SegNo: tidx.Addr.SegNo, SegOffset: (tidx.Addr.SegOffset / size) * size}
+	return addr, (tidx.Addr.SegOffset % size) - mr.format.BhLen, nil
+}
+
+// copySeries 顺着leaf链读出全部数据, 数值序列展开成点后按当前格式重新编码
+func (mr *migrateReader) copySeries(dst, symbol string, topRef *BlockAddr, kind uint8, floor int64) error {
+	addr, off, err := mr.firstLeaf(topRef)
+	if errors.Is(err, api.ErrEmpty) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db := NewTsdb(dst, mr.table, symbol)
+	db.noWal = true
+	defer db.Close()
+	if kind != 0 {
+		if err = db.setKind(kind); err != nil {
+			return err
+		}
+	}
+	batch := make([]api.FstTsdbValue, 0, gMIGRATE_BATCH)
+	size := 0
+	add := func(ts int64, data []byte) error {
+		if ts < floor {
+			return nil
+		}
+		batch = append(batch, api.FstTsdbValue{Timestamp: ts, Data: data})
+		// 大数据按字节数限制一批的大小
+		if size += len(data); len(batch) < gMIGRATE_BATCH && size < gMIGRATE_BYTES {
+			return nil
+		}
+		err := db.AppendBatch(batch)
+		batch, size = batch[:0], 0
+		return err
+	}
+	blk, err := mr.loadBlock(addr, gData_VAL)
+	for err == nil {
+		if off >= blk.BH.Len {
+			if blk.BH.Next.SegNo == 0 {
+				break
+			}
+			addr = &BlockAddr{SegNo: blk.BH.Next.SegNo, SegOffset: blk.BH.Next.SegOffset}
+			blk, err = mr.loadBlock(addr, gData_VAL)
+			off = 0
+			continue
+		}
+		vLen, ovf := valueLen(blk.Data[off:])
+		off += gBLK_V_H_LEN
+		if vLen <= uint32(gBLK_K_LEN) || off+vLen > blk.BH.Len {
+			return &api.CorruptError{Table: mr.table, Type: gData_VAL, Segment: addr.SegNo, Offset: int64(addr.SegOffset), Reason: "value length"}
+		}
+		tv := &TsdbValue{}
+		if err = tv.unmarshal(blk.Data[off:], int(vLen)); err != nil {
+			return err
+		}
+		off += vLen
+		if ovf && mr.format.Version == gFORMAT_VER {
+			if tv.Data, err = mr.readOverflow(tv.Data); err != nil {
+				return err
+			}
+		}
+		if kind == 0 {
+			err = add(tv.Timestamp, tv.Data)
+			continue
+		}
+		points, perr := expandChunk(tv, false)
+		if perr != nil {
+			return perr
+		}
+		for i := 0; i < len(points) && err == nil; i++ {
+			err = add(points[i].Timestamp, points[i].Data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		if err = db.AppendBatch(batch); err != nil {
+			return err
+		}
+	}
+	if floor != math.MinInt64 {
+		if err = db.DeleteBefore(floor); err != nil && !errors.Is(err, api.ErrEmpty) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr *migrateReader) copyObject(dst, key string, ref *ObjRef) error {
+	obj := NewObject(dst, mr.table, key)
+	defer obj.Close()
+	if err := obj.Save(nil); err != nil {
+		return err
+	}
+	size := uint64(0)
+	for next := ref.Head; next.SegNo != 0 && size < ref.Size; {
+		blk, err := mr.loadBlock(&next, gData_VAL)
+		if err != nil {
+			return err
+		}
+		if err = obj.Append(blk.Data[:blk.BH.Len]); err != nil {
+			return err
+		}
+		size += uint64(blk.BH.Len)
+		next = blk.BH.Next
+	}
+	if size != ref.Size {
+		return fmt.Errorf("object size=%d, want %d", size, ref.Size)
+	}
+	return nil
+}
+
+// copyLogs 按记录重写每个table的wal和dlog, wal等下次StartDb时重放
+func copyLogs(src, dst string, m *FormatMeta) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == "blot" {
+			continue
+		}
+		for _, sub := range []string{gWal_Dir, gDlog_Dir} {
+			in := &fstLoggerImpl{dir: src, table: e.Name(), sub: sub, legacy: m.Version == gFORMAT_LEGACY}
+			if _, err := os.Stat(in.logDir()); err != nil {
+				continue
+			}
+			out := &fstLoggerImpl{dir: dst, table: e.Name(), sub: sub}
+			number := 0
+			err := in.ForEach(func(key string, value *api.FstTsdbValue) error {
+				number++
+				return out.Append(key, value)
+			})
+			out.Close()
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				// 最后一帧可能只写了一半
+				common.Logger.Warnf("migrate %s table=%s stop at:%s", sub, e.Name(), err)
+			} else if err != nil && !errors.Is(err, api.ErrEmpty) {
+				return fmt.Errorf("%s table %s:%w", sub, e.Name(), err)
+			}
+			common.Logger.Infof("migrate %s table=%s, values=%d", sub, e.Name(), number)
+		}
+	}
+	return nil
+}
+
+// syncTree 迁移时没有按表的持久化策略同步, 最后统一落盘
+func syncTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return syncFileByName(p)
+	})
+}
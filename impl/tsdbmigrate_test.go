@@ -0,0 +1,206 @@
+package impl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tao/faststore/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+var gTestObj = bytes.Repeat([]byte("Hello world"), 10000)
+
+func bigValue(ts int64) []byte {
+	return bytes.Repeat(testValue(ts), 8<<10)
+}
+
+// writeLegacy 按当前格式写一份数据, 再降成版本1: block头去掉版本和校验和,
+// 索引里的数据偏移跟着减少, 日志帧头去掉校验和, 删掉superblock和格式记录
+func writeLegacy(t *testing.T, c *api.TsdbConf) {
+	t.Helper()
+	dir := c.DataDir
+	if err := StartDb(c); err != nil {
+		t.Fatal(err)
+	}
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 20000)
+	db.Close()
+	big := NewTsdb(dir, "t", "b")
+	for ts := int64(1); ts <= 20; ts++ {
+		if err := big.Append(&api.FstTsdbValue{Timestamp: ts, Data: bigValue(ts)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big.Close()
+	obj := NewObject(dir, "t", "o")
+	if err := obj.Save(gTestObj); err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+	lg := NewLogger(dir, "t")
+	for ts := int64(1); ts <= 1000; ts++ {
+		if err := lg.Append("s", &api.FstTsdbValue{Timestamp: ts, Data: testValue(ts)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lg.Close()
+	StopDb()
+
+	shift := gBH_LEN - gLEGACY_BH_LEN
+	m := currentFormat()
+	for _, datype := range []string{gData_RIDX, gData_IDX, gData_VAL, gData_OVF} {
+		names, _ := filepath.Glob(fmt.Sprintf("%s/t/seg_*.%s", dir, datype))
+		size := m.blockSize(datype)
+		for _, name := range names {
+			f, err := os.OpenFile(name, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, size)
+			for off := int64(0); ; off += int64(size) {
+				if _, err = f.ReadAt(buf, off); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if buf[gBH_VER_OFF] != gBH_VER {
+					continue
+				}
+				out := make([]byte, size)
+				copy(out, buf[:gLEGACY_BH_LEN])
+				copy(out[gLEGACY_BH_LEN:], buf[gBH_LEN:])
+				if datype == gData_IDX {
+					bLen := binary.LittleEndian.Uint32(buf[16:]) & gCODEC_MASK
+					for i := uint32(0); i+gTSDB_IDX_LEN <= bLen; i += gTSDB_IDX_LEN {
+						p := out[gLEGACY_BH_LEN+i+12:]
+						binary.LittleEndian.PutUint32(p, binary.LittleEndian.Uint32(p)-shift)
+					}
+				}
+				if _, err = f.WriteAt(out, off); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f.Close()
+		}
+	}
+	names, _ := filepath.Glob(fmt.Sprintf("%s/t/%s/*.log", dir, gDlog_Dir))
+	for _, name := range names {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]byte, 0, len(buf))
+		for off := uint32(0); off < uint32(len(buf)); {
+			rLen := getIntFromB(buf[off:])
+			out = append(out, buf[off:off+gLEGACY_LOG_H_LEN]...)
+			out = append(out, buf[off+gLOG_H_LEN:off+gLOG_H_LEN+rLen]...)
+			off += gLOG_H_LEN + rLen
+		}
+		if err = os.WriteFile(name, out, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blot, err := bolt.Open(dir+"/blot/blot.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blot.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("t")).Delete([]byte(gFormat_Key))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	blot.Close()
+	if err = os.Remove(fmt.Sprintf(gFormat_File, dir)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkMigrated(t *testing.T, c *api.TsdbConf) {
+	t.Helper()
+	if err := StartDb(c); err != nil {
+		t.Fatal(err)
+	}
+	defer StopDb()
+	dir := c.DataDir
+	checkValues(t, dir, "t", "s", 20000)
+	big := NewTsdb(dir, "t", "b")
+	l, err := big.GetBetween(0, 100, 0)
+	if err != nil || l.Len() != 20 {
+		t.Fatal(err)
+	}
+	for e := l.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*api.FstTsdbValue)
+		if !bytes.Equal(v.Data, bigValue(v.Timestamp)) {
+			t.Fatal("big value", v.Timestamp)
+		}
+	}
+	big.Close()
+	obj := NewObject(dir, "t", "o")
+	out := bytes.NewBuffer(nil)
+	buf := make([]byte, 4096)
+	for {
+		n, err := obj.Read(buf)
+		if err != nil {
+			break
+		}
+		out.Write(buf[:n])
+	}
+	obj.Close()
+	if !bytes.Equal(out.Bytes(), gTestObj) {
+		t.Fatal("object", out.Len())
+	}
+	n := int64(0)
+	if err = NewLogger(dir, "t").ForEach(func(key string, v *api.FstTsdbValue) error {
+		if n++; v.Timestamp != n || string(v.Data) != string(testValue(n)) {
+			return fmt.Errorf("log ts=%d", v.Timestamp)
+		}
+		return nil
+	}); err != nil || n != 1000 {
+		t.Fatal(err, n)
+	}
+	if rep, err := CheckTable(dir, "t", false); err != nil || rep.Leaked != 0 || rep.Conflict != 0 || rep.Missing != 0 {
+		t.Fatal(err, rep)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	base := t.TempDir()
+	c := &api.TsdbConf{DataDir: base + "/data"}
+	startTestDb(t, c)
+	StopDb()
+	writeLegacy(t, c)
+	if err := StartDb(c); !errors.Is(err, api.ErrFormat) {
+		t.Fatal(err)
+	}
+	// 写到新目录, 原目录不变
+	c2 := *c
+	c2.DataDir = base + "/new"
+	if err := MigrateDir(c, c2.DataDir); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, &c2)
+	if err := StartDb(c); !errors.Is(err, api.ErrFormat) {
+		t.Fatal(err)
+	}
+	// 原地升级
+	if err := MigrateDir(c, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{c.DataDir + ".old", c.DataDir + ".migrate"} {
+		if _, err := os.Stat(name); err == nil {
+			t.Fatal(name, "is left")
+		}
+	}
+	checkMigrated(t, c)
+	// 已经是新格式的不用再迁移
+	if err := MigrateDir(c, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, c)
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package impl
+
+import (
+	"errors"
+	"os"
+)
+
+var gMmapOk = false
+
+func mmapSeg(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func munmapSeg(mm []byte) error {
+	return nil
+}
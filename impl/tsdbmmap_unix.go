@@ -0,0 +1,19 @@
+//go:build unix
+
+package impl
+
+import (
+	"os"
+	"syscall"
+)
+
+var gMmapOk = true
+
+// mmapSeg 只读共享映射, WriteAt写进去的数据映射里马上能看到
+func mmapSeg(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapSeg(mm []byte) error {
+	return syscall.Munmap(mm)
+}
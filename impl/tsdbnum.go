@@ -0,0 +1,233 @@
+package impl
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/tao/faststore/api"
+)
+
+// numChunk 正在写的chunk, 总是datCache block里最后一个数据
+type numChunk struct {
+	off uint32
+	enc *gorillaEnc
+}
+
+func kindKey(symbol string) string {
+	return fmt.Sprintf("tsdb.num.%s", symbol)
+}
+
+// getKind 0是普通序列, 同一symbol的句柄共用缓存
+func (tsdb *fstTsdbImpl) getKind() (uint8, error) {
+	s := tsdb.getSeries()
+	s.kindLock.Lock()
+	defer s.kindLock.Unlock()
+	if s.kind != nil {
+		return *s.kind, nil
+	}
+	kind := uint8(0)
+	buf, err := getBValue(tsdb.table, kindKey(tsdb.symbol))
+	if err == nil && len(buf) > 0 {
+		kind = buf[0]
+	} else if err != nil && !errors.Is(err, api.ErrEmpty) {
+		return 0, err
+	}
+	s.kind = &kind
+	return kind, nil
+}
+
+// setKind 只有还没有数据的序列能变成数值序列, 在共用的写句柄上调用
+func (tsdb *fstTsdbImpl) setKind(kind uint8) error {
+	cur, err := tsdb.getKind()
+	if err != nil {
+		return err
+	}
+	if cur == kind {
+		return nil
+	}
+	if cur != 0 {
+		return api.ErrSeriesType
+	}
+	if tsdb.appender != nil && tsdb.appender.lastRidx != nil {
+		return api.ErrSeriesType
+	}
+	if _, err = getBValue(tsdb.table, tsdb.symbol); err == nil {
+		return api.ErrSeriesType
+	} else if !errors.Is(err, api.ErrEmpty) {
+		return err
+	}
+	if err = setBValue(tsdb.table, kindKey(tsdb.symbol), []byte{kind}); err != nil {
+		return err
+	}
+	tsdb.getSeries().cacheKind(&kind)
+	return nil
+}
+
+func (tsdb *fstTsdbImpl) AppendFloat(ts int64, v float64) error {
+	w := tsdb.lockWriter()
+	defer tsdb.series.lock.Unlock()
+	if err := w.setKind(gNUM_FLOAT); err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, math.Float64bits(v))
+	return w.append(&api.FstTsdbValue{Timestamp: ts, Data: data})
+}
+
+func (tsdb *fstTsdbImpl) AppendInt(ts int64, v int64) error {
+	w := tsdb.lockWriter()
+	defer tsdb.series.lock.Unlock()
+	if err := w.setKind(gNUM_INT); err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(v))
+	return w.append(&api.FstTsdbValue{Timestamp: ts, Data: data})
+}
+
+func (tsdb *fstTsdbImpl) GetFloats(low, high int64, limit int) ([]api.FstFloatPoint, error) {
+	points := make([]api.FstFloatPoint, 0)
+	err := tsdb.getPoints(gNUM_FLOAT, low, high, limit, func(ts int64, v uint64) {
+		points = append(points, api.FstFloatPoint{Timestamp: ts, Value: math.Float64frombits(v)})
+	})
+	return points, err
+}
+
+func (tsdb *fstTsdbImpl) GetInts(low, high int64, limit int) ([]api.FstIntPoint, error) {
+	points := make([]api.FstIntPoint, 0)
+	err := tsdb.getPoints(gNUM_INT, low, high, limit, func(ts int64, v uint64) {
+		points = append(points, api.FstIntPoint{Timestamp: ts, Value: int64(v)})
+	})
+	return points, err
+}
+
+func (tsdb *fstTsdbImpl) getPoints(kind uint8, low, high int64, limit int, add func(ts int64, v uint64)) error {
+	cur, err := tsdb.getKind()
+	if err != nil {
+		return err
+	}
+	if cur != kind {
+		return api.ErrSeriesType
+	}
+	if limit <= 0 {
+		limit = api.DEF_LIMIT
+	}
+	it := tsdb.Range(low, high)
+	defer it.Close()
+	n := 0
+	for n < limit && it.Next() {
+		v := it.Value()
+		add(v.Timestamp, binary.LittleEndian.Uint64(v.Data))
+		n++
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	if n == 0 {
+		return api.ErrEmpty
+	}
+	return nil
+}
+
+// appendPoint 能放下时直接改写最后一个chunk, 否则开一个新chunk
+func (ta *tsdbAppender) appendPoint(value *api.FstTsdbValue, kind uint8) error {
+	if len(value.Data) != 8 {
+		return api.ErrSeriesType
+	}
+	if err := ta.getDataCache(); err != nil {
+		return err
+	}
+	v := binary.LittleEndian.Uint64(value.Data)
+	blk := ta.datCache.block
+	if c := ta.chunk; c != nil && c.enc.count < gNUM_CHUNK_POINTS &&
+		uint32(len(c.enc.bytes()))+c.off+gBLK_V_H_LEN+uint32(gBLK_K_LEN)+gNUM_POINT_MAX+gBH_LEN <= ta.datCache.blkSize {
+		c.enc.add(value.Timestamp, v)
+		data := c.enc.bytes()
+		putIntToB(blk.Data[c.off:], uint32(gBLK_K_LEN+len(data)))
+		copy(blk.Data[c.off+gBLK_V_H_LEN+uint32(gBLK_K_LEN):], data)
+		blk.BH.Len = c.off + gBLK_V_H_LEN + uint32(gBLK_K_LEN+len(data))
+		ta.lastRidx.High = uint64(value.Timestamp + 1)
+		return nil
+	}
+	enc := newGorillaEnc(kind)
+	enc.add(value.Timestamp, v)
+	data := enc.bytes()
+	if err := ta.appendEntry(&api.FstTsdbValue{Timestamp: value.Timestamp, Data: data}); err != nil {
+		return err
+	}
+	blk = ta.datCache.block
+	ta.chunk = &numChunk{off: blk.BH.Len - gBLK_V_H_LEN - uint32(gBLK_K_LEN+len(data)), enc: enc}
+	return nil
+}
+
+// loadChunk 重新打开时接着写尾block里最后一个chunk
+func (ta *tsdbAppender) loadChunk(blk *Block, off uint32) error {
+	dLen := getIntFromB(blk.Data[off:])
+	tv := &TsdbValue{}
+	if err := tv.unmarshal(blk.Data[off+gBLK_V_H_LEN:], int(dLen)); err != nil {
+		return err
+	}
+	enc, err := loadGorillaEnc(tv.Timestamp, tv.Data)
+	if err != nil {
+		return err
+	}
+	ta.chunk = &numChunk{off: off, enc: enc}
+	return nil
+}
+
+// expandChunk 把一个chunk展开成点, Data是8字节小端
+func expandChunk(tv *TsdbValue, reverse bool) ([]TsdbValue, error) {
+	return new(chunkBuf).expand(tv, reverse)
+}
+
+// chunkBuf 零复制遍历时复用, 展开下一个chunk会覆盖上一个的点
+type chunkBuf struct {
+	points []numPoint
+	out    []TsdbValue
+	buf    []byte
+}
+
+func (cb *chunkBuf) expand(tv *TsdbValue, reverse bool) ([]TsdbValue, error) {
+	_, points, err := decodeChunkTo(cb.points, tv.Timestamp, tv.Data)
+	if err != nil {
+		return nil, err
+	}
+	cb.points = points
+	if cap(cb.out) < len(points) {
+		cb.out = make([]TsdbValue, len(points))
+		cb.buf = make([]byte, 8*len(points))
+	}
+	out := cb.out[:len(points)]
+	buf := cb.buf[:8*len(points)]
+	for i, p := range points {
+		j := i
+		if reverse {
+			j = len(points) - 1 - i
+		}
+		data := buf[8*i : 8*i+8]
+		binary.LittleEndian.PutUint64(data, p.bits)
+		out[j] = TsdbValue{Timestamp: p.ts, Data: data}
+	}
+	return out, nil
+}
+
+// getLastPoints 数值序列的GetLastN, 反向遍历
+func (tsdb *fstTsdbImpl) getLastPoints(key int64, limit int) (*list.List, error) {
+	it := tsdb.RangeReverse(math.MinInt64, key)
+	defer it.Close()
+	itemList := list.New()
+	for itemList.Len() < limit && it.Next() {
+		v := it.Value()
+		itemList.PushFront(&api.FstTsdbValue{Timestamp: v.Timestamp, Data: v.Data})
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+	if itemList.Len() == 0 {
+		return nil, api.ErrEmpty
+	}
+	return itemList, nil
+}
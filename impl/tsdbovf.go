@@ -0,0 +1,160 @@
+package impl
+
+import (
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+// 放不进leaf block的数据写到单独的ovf block链, leaf里只留时间戳和OvfRef, 长度的最高位标记是引用.
+// ovf block用BH.Next串起来, Len是block里的数据长度; leaf block回收时一起回收
+var (
+	gOVF_FLAG     = uint32(1 << 31)
+	gVAL_MAX_SIZE = uint32(64 << 20)
+)
+
+// valueLen leaf里数据的长度, 以及是不是ovf引用
+func valueLen(buf []byte) (uint32, bool) {
+	n := getIntFromB(buf)
+	return n &^ gOVF_FLAG, (n & gOVF_FLAG) != 0
+}
+
+// needOverflow 数据加上头放不进一个leaf block
+func needOverflow(dLen int, blkSize uint32) bool {
+	return (gBLK_V_H_LEN + uint32(gBLK_K_LEN+dLen) + gBH_LEN) >= blkSize
+}
+
+// writeOverflow 一次分配整条链, 写完之后才在leaf里引用; 中途失败时回收已分配的block.
+// 返回的block在leaf里引用之前失败时由调用者回收
+func writeOverflow(impl *fstTsdbImpl, data []byte) (*OvfRef, map[string][]*BlockAddr, error) {
+	size := uint32(len(data))
+	if size > gVAL_MAX_SIZE {
+		return nil, nil, api.ErrValueTooLarge
+	}
+	blkCap := impl.layout().blockSize(gData_OVF) - gBH_LEN
+	n := (size + blkCap - 1) / blkCap
+	addrs, err := allocBlocks(impl.dataDir, impl.table, map[string]uint32{gData_OVF: n}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	list := addrs[gData_OVF]
+	codec := tableCodec(impl.table)
+	for i, addr := range list {
+		off := uint32(i) * blkCap
+		end := off + blkCap
+		if end > size {
+			end = size
+		}
+		blk := &Block{Data: data[off:end]}
+		blk.BH.Len = end - off
+		blk.BH.Codec = codec
+		if i > 0 {
+			blk.BH.Pre = *list[i-1]
+		}
+		if i+1 < len(list) {
+			blk.BH.Next = *list[i+1]
+		}
+		if err = saveBlock(addr, impl.dataDir, impl.table, gData_OVF, blk); err != nil {
+			common.Logger.Warnf("write overflow symbol=%s, size=%d failed:%s", impl.symbol, size, err)
+			_ = freeBlocks(impl.dataDir, impl.table, addrs)
+			return nil, nil, err
+		}
+	}
+	return &OvfRef{Head: *list[0], Size: size}, addrs, nil
+}
+
+// walkOverflow 按顺序访问链上的block
+func walkOverflow(dir, table string, ref *OvfRef, visit func(addr BlockAddr, blk *Block) error) error {
+	addr := ref.Head
+	for addr.SegNo != 0 {
+		blk := &Block{}
+		if err := loadBlock(&addr, dir, table, gData_OVF, blk); err != nil {
+			return err
+		}
+		if err := visit(addr, blk); err != nil {
+			return err
+		}
+		addr = blk.BH.Next
+	}
+	return nil
+}
+
+// readOverflow 读出引用的数据, 同时返回链上的block
+func readOverflow(dir, table string, ref *OvfRef) ([]byte, []*BlockAddr, error) {
+	out := make([]byte, 0, ref.Size)
+	addrs := make([]*BlockAddr, 0)
+	err := walkOverflow(dir, table, ref, func(addr BlockAddr, blk *Block) error {
+		if uint32(len(out))+blk.BH.Len > ref.Size {
+			return &api.CorruptError{Table: table, Type: gData_OVF, Segment: addr.SegNo, Offset: int64(addr.SegOffset), Reason: "overflow size"}
+		}
+		out = append(out, blk.Data[:blk.BH.Len]...)
+		addrs = append(addrs, &BlockAddr{SegNo: addr.SegNo, SegOffset: addr.SegOffset})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint32(len(out)) != ref.Size {
+		return nil, nil, &api.CorruptError{Table: table, Type: gData_OVF, Segment: ref.Head.SegNo, Offset: int64(ref.Head.SegOffset), Reason: "overflow chain is short"}
+	}
+	return out, addrs, nil
+}
+
+// blockOverflow leaf block从off开始的数据引用的ovf block
+func blockOverflow(dir, table string, blk *Block, off uint32, visit func(datype string, addr BlockAddr)) error {
+	for (off + gBLK_V_H_LEN) <= blk.BH.Len {
+		vLen, ovf := valueLen(blk.Data[off:])
+		off += gBLK_V_H_LEN
+		if (off + vLen) > blk.BH.Len {
+			return &api.CorruptError{Table: table, Type: gData_VAL, Offset: int64(off), Reason: "value length"}
+		}
+		if ovf {
+			ref := &OvfRef{}
+			if err := ref.UnmarshalBinary(blk.Data[off+uint32(gBLK_K_LEN) : off+vLen]); err != nil {
+				return err
+			}
+			err := walkOverflow(dir, table, ref, func(addr BlockAddr, _ *Block) error {
+				visit(gData_OVF, addr)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		off += vLen
+	}
+	return nil
+}
+
+// leafOverflow 整个leaf block引用的ovf block
+func leafOverflow(dir, table string, leaf BlockAddr, visit func(datype string, addr BlockAddr)) error {
+	blk := &Block{}
+	if err := loadBlock(&leaf, dir, table, gData_VAL, blk); err != nil {
+		return err
+	}
+	return blockOverflow(dir, table, blk, 0, visit)
+}
+
+// collectTo 把访问到的block记到addrs里
+func collectTo(addrs map[string][]*BlockAddr) func(datype string, addr BlockAddr) {
+	return func(datype string, addr BlockAddr) {
+		addrs[datype] = append(addrs[datype], &BlockAddr{SegNo: addr.SegNo, SegOffset: addr.SegOffset})
+	}
+}
+
+// resolve 上一次读到的是ovf引用时换成实际的数据
+func (ca *tsdbRDCache) resolve(data *TsdbValue) ([]*BlockAddr, error) {
+	if !ca.ovf {
+		return nil, nil
+	}
+	ref := &OvfRef{}
+	if err := ref.UnmarshalBinary(data.Data); err != nil {
+		return nil, err
+	}
+	out, addrs, err := readOverflow(ca.impl.dataDir, ca.impl.table, ref)
+	if err != nil {
+		return nil, err
+	}
+	data.Data = out
+	ca.ovf = false
+	return addrs, nil
+}
@@ -0,0 +1,59 @@
+package impl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+var errEncode = errors.New("encode failed")
+
+// failCodec 不压缩, 第fail次Encode返回错误, 用来让ovf链写到一半失败
+type failCodec struct {
+	calls int
+	fail  int
+}
+
+func (c *failCodec) Id() uint8    { return 250 }
+func (c *failCodec) Name() string { return "fail" }
+func (c *failCodec) Encode(dst, src []byte) ([]byte, error) {
+	if c.calls++; c.calls == c.fail {
+		return nil, errEncode
+	}
+	return append(dst, src...), nil
+}
+func (c *failCodec) Decode(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func TestOverflowWriteFailed(t *testing.T) {
+	codec := &failCodec{}
+	if err := RegisterCodec(codec); err != nil {
+		t.Fatal(err)
+	}
+	dir := startTestDb(t, &api.TsdbConf{Tables: map[string]api.TableConf{"t": {Codec: "fail"}}})
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 10)
+	blkCap := db.layout().blockSize(gData_OVF) - gBH_LEN
+	big := bytes.Repeat([]byte("x"), int(5*blkCap))
+	// 第三个ovf block写失败, 前两个已经写盘
+	codec.calls, codec.fail = 0, 3
+	if err := db.Append(&api.FstTsdbValue{Timestamp: 11, Data: big}); !errors.Is(err, errEncode) {
+		t.Fatal(err)
+	}
+	if codec.calls != 3 {
+		t.Fatal("calls", codec.calls)
+	}
+	codec.fail = 0
+	if err := db.Append(&api.FstTsdbValue{Timestamp: 11, Data: big}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	checkTable(t, dir, "t")
+	l, err := NewTsdb(dir, "t", "s").GetLastN(11, 2)
+	if err != nil || l.Len() != 2 || !bytes.Equal(l.Back().Value.(*api.FstTsdbValue).Data, big) {
+		t.Fatal(err, l)
+	}
+}
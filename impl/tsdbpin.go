@@ -0,0 +1,151 @@
+package impl
+
+import (
+	"math"
+	"sync"
+
+	"github.com/tao/faststore/common"
+)
+
+// 读之前pin住table; 被替换下来的block要等pin早于替换的读都结束后才回收,
+// 否则别的句柄正在读的block可能已经被重新分配
+type tsdbPins struct {
+	epoch   uint64
+	readers map[uint64]int
+	retired []*retiredBlocks
+	held    map[*segFile]uint64 // Data引用了映射的seg文件, 等这个epoch之前的读都结束再release
+}
+
+type retiredBlocks struct {
+	epoch uint64
+	addrs map[string][]*BlockAddr
+}
+
+var gPinLock sync.Mutex
+var gPins = make(map[string]*tsdbPins)
+
+func getPins(table string) *tsdbPins {
+	p, ok := gPins[table]
+	if !ok {
+		p = &tsdbPins{readers: make(map[uint64]int), held: make(map[*segFile]uint64)}
+		gPins[table] = p
+	}
+	return p
+}
+
+func pinTable(table string) uint64 {
+	gPinLock.Lock()
+	defer gPinLock.Unlock()
+	p := getPins(table)
+	p.readers[p.epoch]++
+	return p.epoch
+}
+
+func unpinTable(dir, table string, epoch uint64) {
+	gPinLock.Lock()
+	p := getPins(table)
+	if p.readers[epoch]--; p.readers[epoch] <= 0 {
+		delete(p.readers, epoch)
+	}
+	ready := p.reclaim()
+	files := p.unhold()
+	gPinLock.Unlock()
+	for _, sf := range files {
+		sf.release()
+	}
+	for _, r := range ready {
+		if err := freeBlocks(dir, table, r.addrs); err != nil {
+			common.Logger.Warnf("free retired table=%s failed:%s", table, err)
+		}
+	}
+}
+
+// holdSeg 读到的Data直接引用了sf的映射, 调用者已经pin住table并持有sf的引用;
+// 同一个文件只留一个引用. epoch加一, 之后开始的读不会拖住这次的引用
+func holdSeg(table string, sf *segFile) {
+	gPinLock.Lock()
+	p := getPins(table)
+	_, ok := p.held[sf]
+	p.held[sf] = p.epoch
+	p.epoch++
+	gPinLock.Unlock()
+	if ok {
+		sf.release()
+	}
+}
+
+// unhold 取出已经没有读在用的seg文件
+func (p *tsdbPins) unhold() []*segFile {
+	oldest := uint64(math.MaxUint64)
+	for epoch := range p.readers {
+		if epoch < oldest {
+			oldest = epoch
+		}
+	}
+	files := make([]*segFile, 0)
+	for sf, epoch := range p.held {
+		if epoch < oldest {
+			files = append(files, sf)
+			delete(p.held, sf)
+		}
+	}
+	return files
+}
+
+// reclaim 取出已经没有读在用的block
+func (p *tsdbPins) reclaim() []*retiredBlocks {
+	oldest := p.epoch
+	for epoch := range p.readers {
+		if epoch < oldest {
+			oldest = epoch
+		}
+	}
+	ready := make([]*retiredBlocks, 0)
+	kept := p.retired[:0]
+	for _, r := range p.retired {
+		if r.epoch < oldest {
+			ready = append(ready, r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	p.retired = kept
+	return ready
+}
+
+// retireBlocks 没有读时直接回收, 否则等读结束; 调用前新的链和topRef必须已经落盘
+func retireBlocks(dir, table string, addrs map[string][]*BlockAddr) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	gPinLock.Lock()
+	p := getPins(table)
+	p.retired = append(p.retired, &retiredBlocks{epoch: p.epoch, addrs: addrs})
+	p.epoch++
+	ready := p.reclaim()
+	gPinLock.Unlock()
+	for _, r := range ready {
+		if err := freeBlocks(dir, table, r.addrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releasePins 停止时回收所有等待中的block, 没回收的会变成泄漏, 要用CheckTable修复
+func releasePins(dir string) {
+	gPinLock.Lock()
+	pins := gPins
+	gPins = make(map[string]*tsdbPins)
+	gPinLock.Unlock()
+	for table, p := range pins {
+		for sf := range p.held {
+			sf.release()
+		}
+		for _, r := range p.retired {
+			if err := freeBlocks(dir, table, r.addrs); err != nil {
+				common.Logger.Warnf("free retired table=%s failed:%s", table, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package impl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+// 打开的写句柄, 删除数据和修复空闲表时要避开
+var gWriterLock sync.Mutex
+var gWriters = make(map[string]map[*tsdbAppender]bool)
+
+// 正在compact的symbol, 这期间新的写句柄要等
+var gCompacting = make(map[string]bool)
+var gWriterCond = sync.NewCond(&gWriterLock)
+
+var gData_Types = []string{gData_RIDX, gData_IDX, gData_VAL, gData_OVF}
+
+// getAppender 第一次写时注册
+func (tsdb *fstTsdbImpl) getAppender() *tsdbAppender {
+	if tsdb.appender != nil {
+		return tsdb.appender
+	}
+	ta := &tsdbAppender{impl: tsdb}
+	gWriterLock.Lock()
+	for gCompacting[compactKey(tsdb.table, tsdb.symbol)] {
+		gWriterCond.Wait()
+	}
+	ws, ok := gWriters[tsdb.table]
+	if !ok {
+		ws = make(map[*tsdbAppender]bool)
+		gWriters[tsdb.table] = ws
+	}
+	ws[ta] = true
+	gWriterLock.Unlock()
+	tsdb.appender = ta
+	return ta
+}
+
+func (tsdb *fstTsdbImpl) closeAppender() error {
+	ta := tsdb.appender
+	err := ta.close()
+	gWriterLock.Lock()
+	if ws, ok := gWriters[tsdb.table]; ok {
+		delete(ws, ta)
+		if len(ws) == 0 {
+			delete(gWriters, tsdb.table)
+		}
+	}
+	gWriterLock.Unlock()
+	tsdb.appender = nil
+	return err
+}
+
+// getFloor head ridx block里第一个range的Low, DeleteBefore之后比它小的数据都不可见
+func getFloor(impl *fstTsdbImpl) (int64, error) {
+	topRef := &BlockAddr{}
+	if err := impl.getTopRef(topRef); err != nil {
+		if errors.Is(err, api.ErrEmpty) {
+			return math.MinInt64, nil
+		}
+		return 0, err
+	}
+	blk := &Block{}
+	if err := impl.readBlock(topRef, gData_RIDX, blk); err != nil {
+		return 0, err
+	}
+	return blockFloor(blk)
+}
+
+func blockFloor(blk *Block) (int64, error) {
+	if blk.BH.Len < gTSDB_RIDX_LEN {
+		return math.MinInt64, nil
+	}
+	ridx := &TsdbRangIndex{}
+	if err := ridx.UnmarshalBinary(blk.Data); err != nil {
+		return 0, err
+	}
+	return int64(ridx.Low), nil
+}
+
+func floorKey(symbol string) string {
+	return fmt.Sprintf("tsdb.del.%s", symbol)
+}
+
+// getDeleted DeleteBefore删到的位置, 没删过时是MinInt64
+func getDeleted(table, symbol string) (int64, error) {
+	buf, err := getBValue(table, floorKey(symbol))
+	if err != nil {
+		if errors.Is(err, api.ErrEmpty) {
+			return math.MinInt64, nil
+		}
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// checkFloor 迟到的数据不能写到已删除的区间, 否则同一leaf block里已删除的数据会重新可见
+func (ta *tsdbAppender) checkFloor(ts int64) error {
+	if ta.floor == nil {
+		floor, err := getDeleted(ta.impl.table, ta.impl.symbol)
+		if err != nil {
+			return err
+		}
+		ta.floor = &floor
+	}
+	if ts < *ta.floor {
+		return api.ErrOutOfOrder
+	}
+	return nil
+}
+
+// DeleteBefore 共用写句柄的数据先落盘, 下次写入时重新加载尾block; 正在compact时返回ErrBusy
+func (tsdb *fstTsdbImpl) DeleteBefore(ts int64) error {
+	s := tsdb.getSeries()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if w := s.writer; w != nil && w.appender != nil {
+		if err := w.closeAppender(); err != nil {
+			return err
+		}
+	}
+	return tsdb.unlinkLocked(ts)
+}
+
+func (tsdb *fstTsdbImpl) unlinkLocked(ts int64) error {
+	gWriterLock.Lock()
+	defer gWriterLock.Unlock()
+	if isBusy(tsdb.dataDir, tsdb.table, tsdb.symbol) {
+		return api.ErrBusy
+	}
+	return unlinkBefore(tsdb, ts)
+}
+
+// isBusy 有写句柄或者正在compact, 调用时持有gWriterLock
+func isBusy(dir, table, symbol string) bool {
+	if gCompacting[compactKey(table, symbol)] {
+		return true
+	}
+	for ta := range gWriters[table] {
+		if ta.impl.symbol == symbol && ta.impl.dataDir == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// unlinkBefore 找到第一个High>ts的range, 它所在的ridx block去掉前面的range后作为新的head,
+// 它的Low提高到ts; 保留下来的idx/leaf block断开Pre, 之前的block不再被引用
+func unlinkBefore(impl *fstTsdbImpl, ts int64) error {
+	topRef := &BlockAddr{}
+	if err := getTsData(impl.table, impl.symbol, topRef); err != nil {
+		if errors.Is(err, api.ErrEmpty) {
+			return nil
+		}
+		return err
+	}
+	rAddr := &BlockAddr{SegNo: topRef.SegNo, SegOffset: topRef.SegOffset}
+	rBlk := &Block{}
+	ridx := &TsdbRangIndex{}
+	k := uint32(0)
+	freed := map[string][]*BlockAddr{}
+	var last *BlockAddr
+	for {
+		if err := loadBlock(rAddr, impl.dataDir, impl.table, gData_RIDX, rBlk); err != nil {
+			return err
+		}
+		found := false
+		for k = 0; ((k + 1) * gTSDB_RIDX_LEN) <= rBlk.BH.Len; k++ {
+			if err := ridx.UnmarshalBinary(rBlk.Data[k*gTSDB_RIDX_LEN:]); err != nil {
+				return err
+			}
+			if int64(ridx.High) > ts {
+				found = true
+				break
+			}
+			last = &BlockAddr{SegNo: ridx.Addr.SegNo, SegOffset: ridx.Addr.SegOffset}
+			freed[gData_IDX] = append(freed[gData_IDX], last)
+		}
+		if found {
+			break
+		}
+		freed[gData_RIDX] = append(freed[gData_RIDX], rAddr)
+		if rBlk.BH.Next.SegNo == 0 {
+			// 全部删除
+			common.Logger.Infof("delete symbol=%s, all before %d", impl.symbol, ts)
+			if last != nil {
+				if err := freeLeafChain(impl, last, freed); err != nil {
+					return err
+				}
+			}
+			if err := delBValue(impl.table, floorKey(impl.symbol)); err != nil {
+				return err
+			}
+			if err := delBValue(impl.table, kindKey(impl.symbol)); err != nil {
+				return err
+			}
+			impl.getSeries().cacheKind(nil)
+			if err := delBValue(impl.table, impl.symbol); err != nil {
+				return err
+			}
+			return retireBlocks(impl.dataDir, impl.table, freed)
+		}
+		rAddr = &BlockAddr{SegNo: rBlk.BH.Next.SegNo, SegOffset: rBlk.BH.Next.SegOffset}
+	}
+	isHead := (*rAddr == *topRef)
+	if isHead && k == 0 && int64(ridx.Low) >= ts {
+		return nil
+	}
+	// 第一个保留的数据, 它之前的leaf/idx block都不要了
+	iBlk := &Block{}
+	if err := loadBlock(&ridx.Addr, impl.dataDir, impl.table, gData_IDX, iBlk); err != nil {
+		return err
+	}
+	kind, err := impl.getKind()
+	if err != nil {
+		return err
+	}
+	tidx := &TsdbIndex{}
+	pre := &TsdbIndex{}
+	for e := uint32(0); ((e + 1) * gTSDB_IDX_LEN) <= iBlk.BH.Len; e++ {
+		*pre = *tidx
+		if err := tidx.UnmarshalBinary(iBlk.Data[e*gTSDB_IDX_LEN:]); err != nil {
+			return err
+		}
+		if int64(tidx.Key) >= ts {
+			// 数值序列保留包含ts的chunk
+			if kind != 0 && e > 0 && int64(tidx.Key) > ts {
+				*tidx = *pre
+			}
+			break
+		}
+	}
+	lAddr := &BlockAddr{SegNo: tidx.Addr.SegNo, SegOffset: getValueSegOff(tidx.Addr.SegOffset, impl.layout().ObjSize)}
+	lBlk := &Block{}
+	if err := loadBlock(lAddr, impl.dataDir, impl.table, gData_VAL, lBlk); err != nil {
+		return err
+	}
+	for pre := lBlk.BH.Pre; pre.SegNo != 0; {
+		blk := &Block{}
+		if err := loadBlock(&pre, impl.dataDir, impl.table, gData_VAL, blk); err != nil {
+			return err
+		}
+		freed[gData_VAL] = append(freed[gData_VAL], &BlockAddr{SegNo: pre.SegNo, SegOffset: pre.SegOffset})
+		if err := blockOverflow(impl.dataDir, impl.table, blk, 0, collectTo(freed)); err != nil {
+			return err
+		}
+		pre = blk.BH.Pre
+	}
+	lBlk.BH.Pre = BlockAddr{}
+	if err := saveBlock(lAddr, impl.dataDir, impl.table, gData_VAL, lBlk); err != nil {
+		return err
+	}
+	iBlk.BH.Pre = BlockAddr{}
+	if err := saveBlock(&ridx.Addr, impl.dataDir, impl.table, gData_IDX, iBlk); err != nil {
+		return err
+	}
+	// 前移剩下的range, Off跟着变
+	cnt := rBlk.BH.Len / gTSDB_RIDX_LEN
+	for i := k; i < cnt; i++ {
+		item := &TsdbRangIndex{}
+		if err := item.UnmarshalBinary(rBlk.Data[i*gTSDB_RIDX_LEN:]); err != nil {
+			return err
+		}
+		item.Off = i - k + 1
+		if i == k && int64(item.Low) < ts {
+			item.Low = uint64(ts)
+		}
+		out, err := item.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		bcopy(rBlk.Data, out, (i-k)*gTSDB_RIDX_LEN, 0, gTSDB_RIDX_LEN)
+	}
+	rBlk.BH.Len = (cnt - k) * gTSDB_RIDX_LEN
+	rBlk.BH.Pre = BlockAddr{}
+	if err := saveBlock(rAddr, impl.dataDir, impl.table, gData_RIDX, rBlk); err != nil {
+		return err
+	}
+	deleted := make([]byte, 8)
+	binary.LittleEndian.PutUint64(deleted, uint64(ts))
+	if err := setBValue(impl.table, floorKey(impl.symbol), deleted); err != nil {
+		return err
+	}
+	common.Logger.Infof("delete symbol=%s before %d, head seg=%d,off=%d", impl.symbol, ts, rAddr.SegNo, rAddr.SegOffset)
+	if !isHead {
+		if err := saveTsData(impl.table, impl.symbol, rAddr); err != nil {
+			return err
+		}
+	}
+	return retireBlocks(impl.dataDir, impl.table, freed)
+}
+
+// freeLeafChain idx block里最后一个数据所在的leaf block, 以及它之前的所有leaf block和它们引用的ovf block
+func freeLeafChain(impl *fstTsdbImpl, idxAddr *BlockAddr, freed map[string][]*BlockAddr) error {
+	iBlk := &Block{}
+	if err := loadBlock(idxAddr, impl.dataDir, impl.table, gData_IDX, iBlk); err != nil {
+		return err
+	}
+	if iBlk.BH.Len < gTSDB_IDX_LEN {
+		return nil
+	}
+	tidx := &TsdbIndex{}
+	if err := tidx.UnmarshalBinary(iBlk.Data[iBlk.BH.Len-gTSDB_IDX_LEN:]); err != nil {
+		return err
+	}
+	addr := BlockAddr{SegNo: tidx.Addr.SegNo, SegOffset: getValueSegOff(tidx.Addr.SegOffset, impl.layout().ObjSize)}
+	for addr.SegNo != 0 {
+		blk := &Block{}
+		if err := loadBlock(&addr, impl.dataDir, impl.table, gData_VAL, blk); err != nil {
+			return err
+		}
+		freed[gData_VAL] = append(freed[gData_VAL], &BlockAddr{SegNo: addr.SegNo, SegOffset: addr.SegOffset})
+		if err := blockOverflow(impl.dataDir, impl.table, blk, 0, collectTo(freed)); err != nil {
+			return err
+		}
+		addr = blk.BH.Pre
+	}
+	return nil
+}
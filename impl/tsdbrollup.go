@@ -0,0 +1,659 @@
+package impl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	gROLLUP_RAW    = "raw"
+	gDEF_ROLLUP_MS = 60000
+	gAGG_LEN       = 48
+)
+
+// rollupTier 一层rollup, 写在symbol#name里, 每个值是一个bucket的tsdbAgg
+type rollupTier struct {
+	name string
+	step int64
+	keep int64
+}
+
+type rollupConf struct {
+	unit      time.Duration
+	decode    api.FstDecoder
+	rawKeep   int64
+	ttl       int64
+	symbolTtl map[string]int64
+	tiers     []*rollupTier
+	compact   float64
+}
+
+type tsdbRollup struct {
+	tables map[string]*rollupConf
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var gRollupLock sync.Mutex
+var gRollup *tsdbRollup
+
+func rollupSymbol(symbol, name string) string {
+	return symbol + "#" + name
+}
+
+func parseRollup(table string, tc api.TableConf) (*rollupConf, error) {
+	rc := &rollupConf{unit: time.Millisecond, decode: api.DecodeFloat64LE, compact: tc.CompactRatio}
+	if tc.TimeUnit != "" {
+		d, err := time.ParseDuration(tc.TimeUnit)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("table %s bad time_unit:%s", table, tc.TimeUnit)
+		}
+		rc.unit = d
+	}
+	switch tc.Decoder {
+	case "", api.DECODER_FLOAT64:
+	case api.DECODER_INT64:
+		rc.decode = api.DecodeInt64LE
+	default:
+		return nil, fmt.Errorf("table %s unknown decoder:%s", table, tc.Decoder)
+	}
+	if tc.Ttl != "" {
+		ttl, err := parseInterval(tc.Ttl, rc.unit)
+		if err != nil {
+			return nil, fmt.Errorf("table %s:%w", table, err)
+		}
+		rc.ttl = ttl
+	}
+	rc.symbolTtl = make(map[string]int64, len(tc.SymbolTtl))
+	for symbol, v := range tc.SymbolTtl {
+		ttl, err := parseInterval(v, rc.unit)
+		if err != nil {
+			return nil, fmt.Errorf("table %s symbol %s:%w", table, symbol, err)
+		}
+		rc.symbolTtl[symbol] = ttl
+	}
+	for _, r := range tc.Rollups {
+		var keep int64
+		if r.Keep != "" {
+			k, err := parseInterval(r.Keep, rc.unit)
+			if err != nil {
+				return nil, fmt.Errorf("table %s:%w", table, err)
+			}
+			keep = k
+		}
+		if r.Step == gROLLUP_RAW {
+			rc.rawKeep = keep
+			continue
+		}
+		step, err := parseInterval(r.Step, rc.unit)
+		if err != nil {
+			return nil, fmt.Errorf("table %s:%w", table, err)
+		}
+		rc.tiers = append(rc.tiers, &rollupTier{name: r.Step, step: step, keep: keep})
+	}
+	sort.Slice(rc.tiers, func(i, j int) bool { return rc.tiers[i].step < rc.tiers[j].step })
+	// 粗的一层由细的一层汇总, 周期必须是整数倍
+	for i := 1; i < len(rc.tiers); i++ {
+		if rc.tiers[i].step%rc.tiers[i-1].step != 0 {
+			return nil, fmt.Errorf("table %s rollup %s is not a multiple of %s", table, rc.tiers[i].name, rc.tiers[i-1].name)
+		}
+	}
+	return rc, nil
+}
+
+func getRollupConf(table string) *rollupConf {
+	gRollupLock.Lock()
+	defer gRollupLock.Unlock()
+	if gRollup == nil {
+		return nil
+	}
+	return gRollup.tables[table]
+}
+
+func (ag *tsdbAgg) marshal() []byte {
+	buf := make([]byte, gAGG_LEN)
+	lwd := binary.LittleEndian
+	lwd.PutUint64(buf, uint64(ag.count))
+	lwd.PutUint64(buf[8:], math.Float64bits(ag.sum))
+	lwd.PutUint64(buf[16:], math.Float64bits(ag.min))
+	lwd.PutUint64(buf[24:], math.Float64bits(ag.max))
+	lwd.PutUint64(buf[32:], math.Float64bits(ag.first))
+	lwd.PutUint64(buf[40:], math.Float64bits(ag.last))
+	return buf
+}
+
+func (ag *tsdbAgg) unmarshal(data []byte) error {
+	if len(data) < gAGG_LEN {
+		return fmt.Errorf("%w: rollup length=%d", api.ErrCorrupt, len(data))
+	}
+	lwd := binary.LittleEndian
+	ag.count = int64(lwd.Uint64(data))
+	ag.sum = math.Float64frombits(lwd.Uint64(data[8:]))
+	ag.min = math.Float64frombits(lwd.Uint64(data[16:]))
+	ag.max = math.Float64frombits(lwd.Uint64(data[24:]))
+	ag.first = math.Float64frombits(lwd.Uint64(data[32:]))
+	ag.last = math.Float64frombits(lwd.Uint64(data[40:]))
+	return nil
+}
+
+// merge o在ag之后
+func (ag *tsdbAgg) merge(o *tsdbAgg) {
+	if o.count == 0 {
+		return
+	}
+	if ag.count == 0 {
+		ag.min = o.min
+		ag.max = o.max
+		ag.first = o.first
+	}
+	if o.min < ag.min {
+		ag.min = o.min
+	}
+	if o.max > ag.max {
+		ag.max = o.max
+	}
+	ag.last = o.last
+	ag.sum += o.sum
+	ag.count += o.count
+}
+
+// sealedHigh tail leaf block的第一个时间戳, 之前的数据都在已写满的block里
+func sealedHigh(tsdb *fstTsdbImpl) (int64, error) {
+	rd, err := seekLeaf(tsdb, math.MaxInt64)
+	if err != nil {
+		return 0, err
+	}
+	tv := &TsdbValue{}
+	vLen, _ := valueLen(rd.block.Data)
+	if err = tv.unmarshal(rd.block.Data[gBLK_V_H_LEN:], int(vLen)); err != nil {
+		return 0, err
+	}
+	return tv.Timestamp, nil
+}
+
+// tierMark 这一层已经汇总到的位置(不含)
+func tierMark(series *fstTsdbImpl, step int64) (int64, bool, error) {
+	last, err := lastValue(series)
+	if err != nil || last == nil {
+		return math.MinInt64, false, err
+	}
+	return last.Timestamp + step, true, nil
+}
+
+// rollupOne 最细的一层从原始数据的已满block汇总, 其它层从上一层汇总;
+// 先重算迟到的数据改过的bucket
+func rollupOne(dir, table, symbol string, rc *rollupConf) error {
+	raw := NewTsdb(dir, table, symbol)
+	defer raw.Close()
+	if err := recomputeDirty(raw, rc); err != nil {
+		return err
+	}
+	srcMark, err := sealedHigh(raw)
+	if err != nil {
+		if errors.Is(err, api.ErrEmpty) {
+			return nil
+		}
+		return err
+	}
+	var src *fstTsdbImpl
+	for _, t := range rc.tiers {
+		series := NewTsdb(dir, table, rollupSymbol(symbol, t.name))
+		mark, _, err := tierMark(series, t.step)
+		if err == nil {
+			end := bucketStart(srcMark, t.step)
+			if mark < end {
+				err = rollupRange(raw, src, series, mark, end-1, t.step, rc.decode)
+			}
+			if err == nil {
+				srcMark, _, err = tierMark(series, t.step)
+			}
+		}
+		if src != nil {
+			src.Close()
+		}
+		src = series
+		if err != nil {
+			break
+		}
+	}
+	if src != nil {
+		src.Close()
+	}
+	return err
+}
+
+// rollupRange 重算时series要打开rewrite, 覆盖已经写过的bucket
+func rollupRange(raw, src, series *fstTsdbImpl, low, high, step int64, decode api.FstDecoder) error {
+	emit := func(ag *tsdbAgg) error {
+		return series.Append(&api.FstTsdbValue{Timestamp: ag.start, Data: ag.marshal()})
+	}
+	if src == nil {
+		return raw.aggregate(low, high, step, decode, emit)
+	}
+	return src.aggregateTier(low, high, step, emit)
+}
+
+func dirtyKey(symbol string) string {
+	return fmt.Sprintf("tsdb.dirty.%s", symbol)
+}
+
+// hasTiers 按配置判断, wal重放时rollup还没启动
+func hasTiers(table, symbol string) bool {
+	if gConf == nil || strings.ContainsAny(symbol, "@#") {
+		return false
+	}
+	for _, r := range gConf.Tables[table].Rollups {
+		if r.Step != gROLLUP_RAW {
+			return true
+		}
+	}
+	return false
+}
+
+var gDirtyLock sync.Mutex
+
+// gRecomputing 正在重算的序列和起点, 重算完之前查询也不能用这之后的rollup
+var gRecomputing = make(map[string]int64)
+
+func getDirty(table, symbol string) (int64, bool, error) {
+	buf, err := getBValue(table, dirtyKey(symbol))
+	if errors.Is(err, api.ErrEmpty) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(buf) < 8 {
+		return 0, false, fmt.Errorf("%w: dirty mark len=%d", api.ErrCorrupt, len(buf))
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), true, nil
+}
+
+// markRollupDirty 原始序列收到迟到的数据后调用, 记下最早的时间戳, 下一轮rollup从它所在的bucket重算.
+// 调用前数据已经对读可见, 之后开始的重算一定能读到
+func markRollupDirty(table, symbol string, ts int64) error {
+	if !hasTiers(table, symbol) {
+		return nil
+	}
+	if cur, ok, err := getDirty(table, symbol); err != nil || (ok && cur <= ts) {
+		return err
+	}
+	return blotDb.Update(func(tx *bolt.Tx) error {
+		buck, err := tableBucket(tx, table)
+		if err != nil {
+			return err
+		}
+		key := []byte(dirtyKey(symbol))
+		if v := buck.Get(key); len(v) >= 8 && int64(binary.LittleEndian.Uint64(v)) <= ts {
+			return nil
+		}
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(ts))
+		return buck.Put(key, buf)
+	})
+}
+
+// takeDirty 取出并删掉重算的起点, 之后到的迟到数据重新记
+func takeDirty(table, symbol string) (int64, bool, error) {
+	var from int64
+	ok := false
+	err := blotDb.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		key := []byte(dirtyKey(symbol))
+		v := buck.Get(key)
+		if v == nil {
+			return nil
+		}
+		if len(v) < 8 {
+			return fmt.Errorf("%w: dirty mark len=%d", api.ErrCorrupt, len(v))
+		}
+		from, ok = int64(binary.LittleEndian.Uint64(v)), true
+		gDirtyLock.Lock()
+		gRecomputing[table+"/"+symbol] = from
+		gDirtyLock.Unlock()
+		return buck.Delete(key)
+	})
+	return from, ok, err
+}
+
+// dirtyFrom 记下的和正在重算的起点里较早的一个, 这之后的rollup还没反映迟到的数据
+func dirtyFrom(table, symbol string) (int64, bool, error) {
+	from, ok, err := getDirty(table, symbol)
+	if err != nil {
+		return 0, false, err
+	}
+	gDirtyLock.Lock()
+	if v, busy := gRecomputing[table+"/"+symbol]; busy && (!ok || v < from) {
+		from, ok = v, true
+	}
+	gDirtyLock.Unlock()
+	return from, ok, nil
+}
+
+// recomputeDirty 从最早的迟到数据所在的bucket开始按层覆盖写到各层已经汇总到的位置.
+// 源序列里删掉了一部分的bucket算不全, 从删除位置之后的第一个bucket开始
+func recomputeDirty(raw *fstTsdbImpl, rc *rollupConf) error {
+	from, ok, err := takeDirty(raw.table, raw.symbol)
+	if err != nil || !ok {
+		return err
+	}
+	defer func() {
+		gDirtyLock.Lock()
+		delete(gRecomputing, raw.table+"/"+raw.symbol)
+		gDirtyLock.Unlock()
+	}()
+	var src *fstTsdbImpl
+	srcSymbol := raw.symbol
+	for _, t := range rc.tiers {
+		series := NewTsdb(raw.dataDir, raw.table, rollupSymbol(raw.symbol, t.name))
+		series.rewrite = true
+		var mark, floor int64
+		mark, ok, err = tierMark(series, t.step)
+		if err == nil {
+			floor, err = getDeleted(raw.table, srcSymbol)
+		}
+		if low := bucketStart(from, t.step); err == nil && ok {
+			if low < floor {
+				low = bucketStart(floor-1, t.step) + t.step
+			}
+			if low < mark {
+				err = rollupRange(raw, src, series, low, mark-1, t.step, rc.decode)
+			}
+		}
+		if src != nil {
+			src.Close()
+		}
+		src, srcSymbol = series, series.symbol
+		if err != nil {
+			break
+		}
+	}
+	if src != nil {
+		src.Close()
+	}
+	if err != nil {
+		// 下一轮再重算
+		return errors.Join(err, markRollupDirty(raw.table, raw.symbol, from))
+	}
+	return nil
+}
+
+// aggregateTier 把一层rollup按step重新分桶
+func (tsdb *fstTsdbImpl) aggregateTier(low, high, step int64, emit func(ag *tsdbAgg) error) error {
+	it := tsdb.Range(low, high)
+	defer it.Close()
+	var cur *tsdbAgg
+	for it.Next() {
+		v := it.Value()
+		part := &tsdbAgg{}
+		if err := part.unmarshal(v.Data); err != nil {
+			return err
+		}
+		start := low
+		if step > 0 {
+			start = bucketStart(v.Timestamp, step)
+		}
+		if cur != nil && cur.start != start {
+			if err := emit(cur); err != nil {
+				return err
+			}
+			cur = nil
+		}
+		if cur == nil {
+			cur = &tsdbAgg{start: start}
+		}
+		cur.merge(part)
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	if cur != nil {
+		return emit(cur)
+	}
+	return nil
+}
+
+// aggMerger 各层按时间顺序送来的部分结果, 同一个bucket合并后再输出; step<=0时都归到low
+type aggMerger struct {
+	cur  *tsdbAgg
+	low  int64
+	step int64
+	emit func(ag *tsdbAgg) error
+}
+
+func (m *aggMerger) add(ag *tsdbAgg) error {
+	if m.step <= 0 {
+		ag.start = m.low
+	}
+	if m.cur != nil && m.cur.start == ag.start {
+		m.cur.merge(ag)
+		return nil
+	}
+	if m.cur != nil {
+		if err := m.emit(m.cur); err != nil {
+			return err
+		}
+	}
+	m.cur = &tsdbAgg{start: ag.start}
+	m.cur.merge(ag)
+	return nil
+}
+
+func (m *aggMerger) flush() error {
+	if m.cur == nil {
+		return nil
+	}
+	return m.emit(m.cur)
+}
+
+// aggregateTiers 用能整除step的最粗一层算它完整覆盖的区间, 两头交给更细的层, 最后是原始数据;
+// 有还没重算的迟到数据时, 各层只用到它所在的bucket之前
+func (tsdb *fstTsdbImpl) aggregateTiers(tiers []*rollupTier, low, high, step int64, decode api.FstDecoder, add func(ag *tsdbAgg) error) error {
+	dirty, isDirty, err := dirtyFrom(tsdb.table, tsdb.symbol)
+	if err != nil {
+		return err
+	}
+	for len(tiers) > 0 {
+		t := tiers[len(tiers)-1]
+		finer := tiers[:len(tiers)-1]
+		series := NewTsdb(tsdb.dataDir, tsdb.table, rollupSymbol(tsdb.symbol, t.name))
+		mark, ok, err := tierMark(series, t.step)
+		if err != nil || !ok {
+			series.Close()
+			if err != nil {
+				return err
+			}
+			tiers = finer
+			continue
+		}
+		if isDirty && bucketStart(dirty, t.step) < mark {
+			mark = bucketStart(dirty, t.step)
+		}
+		lo := low
+		if low > math.MinInt64+t.step {
+			if lo = bucketStart(low, t.step); lo < low {
+				lo += t.step
+			}
+		}
+		end := mark
+		if high < mark-1 {
+			end = bucketStart(high+1, t.step)
+		}
+		if lo >= end {
+			series.Close()
+			tiers = finer
+			continue
+		}
+		if lo > low {
+			if err = tsdb.aggregateTiers(finer, low, lo-1, step, decode, add); err != nil {
+				series.Close()
+				return err
+			}
+		}
+		err = series.aggregateTier(lo, end-1, step, add)
+		series.Close()
+		if err != nil || end > high {
+			return err
+		}
+		return tsdb.aggregateTiers(finer, end, high, step, decode, add)
+	}
+	return tsdb.aggregate(low, high, step, decode, add)
+}
+
+// usableTiers 周期能整除step的层, step<=0时所有层都能用
+func (rc *rollupConf) usableTiers(step int64) []*rollupTier {
+	tiers := make([]*rollupTier, 0, len(rc.tiers))
+	for _, t := range rc.tiers {
+		if step <= 0 || step%t.step == 0 {
+			tiers = append(tiers, t)
+		}
+	}
+	return tiers
+}
+
+// listSeries table里所有的序列, 包括K线和rollup
+func listSeries(table string) ([]string, error) {
+	series := make([]string, 0)
+	err := blotDb.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(table))
+		if buck == nil {
+			return nil
+		}
+		return buck.ForEach(func(k, v []byte) error {
+			key := string(k)
+			if strings.HasPrefix(key, "tsdb.") || strings.HasPrefix(key, "fobj.") {
+				return nil
+			}
+			series = append(series, key)
+			return nil
+		})
+	})
+	return series, err
+}
+
+// retention symbol_ttl优先, 其次是table的ttl, 原始序列最后用rollup里raw的keep;
+// rollup序列用各自层的keep, 0表示永久保留
+func (rc *rollupConf) retention(name string) int64 {
+	if ttl, ok := rc.symbolTtl[name]; ok {
+		return ttl
+	}
+	if pos := strings.LastIndex(name, "#"); pos >= 0 {
+		for _, t := range rc.tiers {
+			if t.name == name[pos+1:] {
+				return t.keep
+			}
+		}
+		return 0
+	}
+	if rc.ttl > 0 || strings.Contains(name, "@") {
+		return rc.ttl
+	}
+	return rc.rawKeep
+}
+
+func startRollup(c *api.TsdbConf) error {
+	tables := make(map[string]*rollupConf)
+	for table, tc := range c.Tables {
+		if len(tc.Rollups) == 0 && tc.Ttl == "" && len(tc.SymbolTtl) == 0 && tc.CompactRatio <= 0 {
+			continue
+		}
+		rc, err := parseRollup(table, tc)
+		if err != nil {
+			return err
+		}
+		tables[table] = rc
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	ms := c.RollupMs
+	if ms <= 0 {
+		ms = gDEF_ROLLUP_MS
+	}
+	r := &tsdbRollup{tables: tables, stop: make(chan struct{}), done: make(chan struct{})}
+	gRollupLock.Lock()
+	gRollup = r
+	gRollupLock.Unlock()
+	go r.run(c.DataDir, time.Duration(ms)*time.Millisecond)
+	common.Logger.Infof("rollup started, tables=%d", len(tables))
+	return nil
+}
+
+func stopRollup() {
+	gRollupLock.Lock()
+	r := gRollup
+	gRollup = nil
+	gRollupLock.Unlock()
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+}
+
+func (r *tsdbRollup) run(dir string, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer func() {
+		ticker.Stop()
+		close(r.done)
+	}()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.pass(dir)
+		}
+	}
+}
+
+func (r *tsdbRollup) pass(dir string) {
+	for table, rc := range r.tables {
+		series, err := listSeries(table)
+		if err != nil {
+			common.Logger.Warnf("rollup table=%s list failed:%s", table, err)
+			continue
+		}
+		now := time.Now().UnixNano() / int64(rc.unit)
+		for _, name := range series {
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+			if len(rc.tiers) > 0 && !strings.ContainsAny(name, "@#") {
+				if err = rollupOne(dir, table, name, rc); err != nil {
+					common.Logger.Warnf("rollup table=%s, symbol=%s failed:%s", table, name, err)
+				}
+			}
+			if ttl := rc.retention(name); ttl > 0 {
+				db := NewTsdb(dir, table, name)
+				// 和DeleteBefore一样先把共用写句柄的数据落盘
+				err = db.DeleteBefore(now - ttl)
+				db.Close()
+				// ErrBusy是正在compact, 下一轮再删
+				if err != nil && !errors.Is(err, api.ErrBusy) {
+					common.Logger.Warnf("retention table=%s, symbol=%s failed:%s", table, name, err)
+				}
+			}
+			if rc.compact > 0 {
+				if err = compactIfFragmented(dir, table, name, rc.compact); err != nil && !errors.Is(err, api.ErrBusy) {
+					common.Logger.Warnf("compact table=%s, symbol=%s failed:%s", table, name, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package impl
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func floatValue(v float64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+	return buf
+}
+
+// checkRollup 用rollup算的结果和直接从原始数据算的一样
+func checkRollup(t *testing.T, dir string) {
+	t.Helper()
+	db := NewTsdb(dir, "t", "s")
+	defer db.Close()
+	for _, step := range []int64{100, 1000, 0} {
+		for _, fn := range []string{api.AGG_COUNT, api.AGG_SUM, api.AGG_MIN, api.AGG_MAX, api.AGG_FIRST, api.AGG_LAST} {
+			got, err := db.Aggregate(0, 50000, step, fn, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := db.Aggregate(0, 50000, step, fn, api.DecodeFloat64LE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatal(step, fn, len(got), len(want))
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatal(step, fn, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestRollupLatePoints(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{OutOfOrder: true, RollupMs: 3600000,
+		Tables: map[string]api.TableConf{"t": {LeafBlock: 4 << 10, Rollups: []api.RollupConf{{Step: "100ms"}, {Step: "1s"}}}}})
+	db := NewTsdb(dir, "t", "s")
+	for ts := int64(2); ts <= 40000; ts += 2 {
+		if err := db.Append(&api.FstTsdbValue{Timestamp: ts, Data: floatValue(float64(ts))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	rc := getRollupConf("t")
+	if err := rollupOne(dir, "t", "s", rc); err != nil {
+		t.Fatal(err)
+	}
+	mark, ok, err := tierMark(NewTsdb(dir, "t", rollupSymbol("s", "1s")), 1000)
+	if err != nil || !ok || mark < 10000 {
+		t.Fatal(err, mark)
+	}
+	// 迟到的数据和改写落在已经汇总过的bucket里
+	db = NewTsdb(dir, "t", "s")
+	for ts := int64(501); ts < 5000; ts += 2 {
+		if err = db.Append(&api.FstTsdbValue{Timestamp: ts, Data: floatValue(float64(-ts))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Append(&api.FstTsdbValue{Timestamp: 8000, Data: floatValue(1e9)}); err != nil {
+		t.Fatal(err)
+	}
+	if from, ok, err := getDirty("t", "s"); err != nil || !ok || from != 501 {
+		t.Fatal(err, from)
+	}
+	checkRollup(t, dir)
+	if err = rollupOne(dir, "t", "s", rc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := dirtyFrom("t", "s"); err != nil || ok {
+		t.Fatal(err, ok)
+	}
+	checkRollup(t, dir)
+	db.Close()
+	crashDb(t)
+	checkRollup(t, dir)
+}
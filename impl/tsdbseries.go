@@ -0,0 +1,226 @@
+package impl
+
+import (
+	"sync"
+
+	"github.com/tao/faststore/api"
+)
+
+// tsdbSeries 每个table/symbol一个, 同一symbol的所有句柄共用一个写句柄.
+// 写入和改写block时持有lock的写锁; 句柄读盘时持有读锁, 不会读到写了一半的block,
+// 写句柄还没落盘的尾block在读开始时复制一份
+type tsdbSeries struct {
+	key      string
+	lock     sync.RWMutex
+	writer   *fstTsdbImpl
+	writers  int // 写过数据还没关闭的句柄
+	refs     int
+	kindLock sync.Mutex
+	kind     *uint8
+}
+
+// tsdbSnap 读开始时写句柄的topRef和尾block, ridx block里已经补上最后一个range;
+// late是还没合并的迟到数据, 读的时候叠加在链上的数据上
+type tsdbSnap struct {
+	topRef *BlockAddr
+	blocks map[string]map[BlockAddr]*Block
+	late   []*api.FstTsdbValue
+}
+
+var gSeriesLock sync.Mutex
+var gSeries = make(map[string]*tsdbSeries)
+
+func seriesOpen(dir, table, symbol string) *tsdbSeries {
+	key := dir + "/" + compactKey(table, symbol)
+	gSeriesLock.Lock()
+	defer gSeriesLock.Unlock()
+	s, ok := gSeries[key]
+	if !ok {
+		s = &tsdbSeries{key: key}
+		gSeries[key] = s
+	}
+	s.refs++
+	return s
+}
+
+func (s *tsdbSeries) unref() {
+	gSeriesLock.Lock()
+	defer gSeriesLock.Unlock()
+	s.refs--
+	if s.refs == 0 {
+		delete(gSeries, s.key)
+	}
+}
+
+// closeSeries StopDb时没关闭的句柄都作废, 写句柄的登记也一起清掉
+func closeSeries() {
+	gSeriesLock.Lock()
+	defer gSeriesLock.Unlock()
+	gSeries = make(map[string]*tsdbSeries)
+	gWriterLock.Lock()
+	gWriters = make(map[string]map[*tsdbAppender]bool)
+	gWriterLock.Unlock()
+}
+
+func (s *tsdbSeries) cacheKind(kind *uint8) {
+	s.kindLock.Lock()
+	s.kind = kind
+	s.kindLock.Unlock()
+}
+
+// getSeries 关闭之后再用的句柄重新登记
+func (tsdb *fstTsdbImpl) getSeries() *tsdbSeries {
+	if tsdb.series == nil {
+		tsdb.series = seriesOpen(tsdb.dataDir, tsdb.table, tsdb.symbol)
+	}
+	return tsdb.series
+}
+
+// lockWriter 持有写锁, 返回共用的写句柄, 由调用者解锁
+func (tsdb *fstTsdbImpl) lockWriter() *fstTsdbImpl {
+	s := tsdb.getSeries()
+	waitCompact(tsdb.table, tsdb.symbol)
+	s.lock.Lock()
+	if s.writer == nil {
+		w := &fstTsdbImpl{table: tsdb.table, dataDir: tsdb.dataDir, symbol: tsdb.symbol, series: s}
+		w.candles = newCandles(w)
+		s.writer = w
+	}
+	if !tsdb.wrote {
+		tsdb.wrote = true
+		s.writers++
+	}
+	s.writer.noWal = tsdb.noWal
+	s.writer.rewrite = tsdb.rewrite
+	return s.writer
+}
+
+// release 写过数据的句柄关闭时把共用写句柄的数据落盘, 最后一个关闭时关掉写句柄
+func (tsdb *fstTsdbImpl) release() error {
+	s := tsdb.series
+	if s == nil {
+		return nil
+	}
+	var err error
+	if tsdb.wrote {
+		s.lock.Lock()
+		s.writers--
+		if s.writers == 0 {
+			err = s.writer.closeWriter()
+			s.writer = nil
+		} else if s.writer.appender != nil {
+			err = s.writer.appender.close()
+		}
+		s.lock.Unlock()
+		tsdb.wrote = false
+	}
+	s.unref()
+	tsdb.series = nil
+	return err
+}
+
+// inner 不经过series的锁直接读写, 调用者保证这期间没有写句柄
+func (tsdb *fstTsdbImpl) inner() *fstTsdbImpl {
+	return &fstTsdbImpl{table: tsdb.table, dataDir: tsdb.dataDir, symbol: tsdb.symbol, series: tsdb.getSeries()}
+}
+
+// view 句柄读开始时复制写句柄的尾block和暂存区; 写句柄自己和内部直接读的不需要
+func (tsdb *fstTsdbImpl) view() (*fstTsdbImpl, error) {
+	if !tsdb.handle {
+		return tsdb, nil
+	}
+	s := tsdb.getSeries()
+	s.lock.RLock()
+	v := &fstTsdbImpl{table: tsdb.table, dataDir: tsdb.dataDir, symbol: tsdb.symbol, series: s, handle: true, snap: s.snapshot()}
+	s.lock.RUnlock()
+	return v, nil
+}
+
+// snapshot 调用时持有读锁
+func (s *tsdbSeries) snapshot() *tsdbSnap {
+	snap := &tsdbSnap{blocks: make(map[string]map[BlockAddr]*Block)}
+	if s.writer == nil || s.writer.appender == nil {
+		return snap
+	}
+	ta := s.writer.appender
+	if len(ta.late) > 0 {
+		// 暂存区在原地插入, 只复制指针; 数据本身不会再改
+		snap.late = append([]*api.FstTsdbValue(nil), ta.late...)
+	}
+	if ta.ridxCache == nil {
+		return snap
+	}
+	rBlk := snap.add(ta.ridxCache, gTSDB_RIDX_LEN)
+	if ta.lastRidx != nil {
+		// 最后一个range只在内存里更新High, 还没写进ridx block时接在后面
+		out, _ := ta.lastRidx.MarshalBinary()
+		off := rBlk.BH.Len
+		if ta.lastRidx.Off != 0 {
+			off = (ta.lastRidx.Off - 1) * gTSDB_RIDX_LEN
+		}
+		copy(rBlk.Data[off:], out)
+		if (off + gTSDB_RIDX_LEN) > rBlk.BH.Len {
+			rBlk.BH.Len = off + gTSDB_RIDX_LEN
+		}
+	}
+	if rBlk.BH.Len > 0 && ta.topRef != nil {
+		snap.topRef = &BlockAddr{SegNo: ta.topRef.SegNo, SegOffset: ta.topRef.SegOffset}
+	}
+	if ta.idxCache != nil {
+		snap.add(ta.idxCache, 0)
+	}
+	if ta.datCache != nil {
+		snap.add(ta.datCache, 0)
+	}
+	return snap
+}
+
+func (snap *tsdbSnap) add(ca *tsdbWRCache, extra uint32) *Block {
+	blk := &Block{BH: ca.block.BH, Data: make([]byte, uint32(len(ca.block.Data))+extra)}
+	copy(blk.Data, ca.block.Data[:ca.block.BH.Len])
+	blks, ok := snap.blocks[ca.dataType]
+	if !ok {
+		blks = make(map[BlockAddr]*Block)
+		snap.blocks[ca.dataType] = blks
+	}
+	blks[*ca.addr] = blk
+	return blk
+}
+
+// readBlock 句柄读时先看快照, 否则持有读锁读盘
+func (tsdb *fstTsdbImpl) readBlock(addr *BlockAddr, datype string, blk *Block) error {
+	return tsdb.readBlockAs(addr, datype, blk, false)
+}
+
+// readBlockAs shared时Data可能和快照, 块缓存或者映射共用, 调用者只能读, 并且要pin住table
+func (tsdb *fstTsdbImpl) readBlockAs(addr *BlockAddr, datype string, blk *Block, shared bool) error {
+	if tsdb.snap != nil {
+		if b, ok := tsdb.snap.blocks[datype][*addr]; ok {
+			*blk = *b
+			return nil
+		}
+	}
+	if tsdb.handle {
+		s := tsdb.getSeries()
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+	}
+	return loadBlockAs(addr, tsdb.dataDir, tsdb.table, datype, blk, shared)
+}
+
+// readNext 读Next指向的block; 写句柄换block时先写满的block, 新block落盘之前Pre对不上, 当作链尾
+func (tsdb *fstTsdbImpl) readNext(cur BlockAddr, next *BlockAddr, datype string, blk *Block, shared bool) (bool, error) {
+	if err := tsdb.readBlockAs(next, datype, blk, shared); err != nil {
+		return false, err
+	}
+	return blk.BH.Pre == cur, nil
+}
+
+// getTopRef 还没落盘的新symbol用快照里的topRef
+func (tsdb *fstTsdbImpl) getTopRef(ref *BlockAddr) error {
+	if tsdb.snap != nil && tsdb.snap.topRef != nil {
+		*ref = *tsdb.snap.topRef
+		return nil
+	}
+	return getTsData(tsdb.table, tsdb.symbol, ref)
+}
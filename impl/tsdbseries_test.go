@@ -0,0 +1,89 @@
+package impl
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+// scanValues 读一遍快照, 检查顺序和内容, 返回条数
+func scanValues(t *testing.T, db *fstTsdbImpl) int64 {
+	it := db.Range(math.MinInt64, math.MaxInt64)
+	defer it.Close()
+	n, last := int64(0), int64(0)
+	for it.Next() {
+		v := it.Value()
+		if v.Timestamp <= last || string(v.Data) != string(testValue(v.Timestamp)) {
+			t.Errorf("ts=%d after %d", v.Timestamp, last)
+			return n
+		}
+		last = v.Timestamp
+		n++
+	}
+	if it.Err() != nil {
+		t.Error(it.Err())
+	}
+	return n
+}
+
+func TestSeriesSharedWriter(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	const W, N = 4, 3000
+	var ts int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < W; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db := NewTsdb(dir, "t", "s")
+			defer db.Close()
+			for i := 0; i < N; i++ {
+				mu.Lock()
+				ts++
+				err := db.Append(&api.FstTsdbValue{Timestamp: ts, Data: testValue(ts)})
+				mu.Unlock()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	var stop int32
+	var rg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		rg.Add(1)
+		go func() {
+			defer rg.Done()
+			db := NewTsdb(dir, "t", "s")
+			defer db.Close()
+			last := int64(0)
+			for atomic.LoadInt32(&stop) == 0 {
+				// 快照里的数据只会变多, 不会出现空洞
+				n := scanValues(t, db)
+				if n < last {
+					t.Errorf("went back %d < %d", n, last)
+					return
+				}
+				last = n
+				p, err := db.GetPage(0, math.MaxInt64, "", 10)
+				if err != nil && err != api.ErrEmpty {
+					t.Error(err)
+					return
+				}
+				if p != nil && len(p.Values) > 0 && p.Values[0].Timestamp != 1 {
+					t.Error("page start", p.Values[0].Timestamp)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	atomic.StoreInt32(&stop, 1)
+	rg.Wait()
+	checkValues(t, dir, "t", "s", W*N)
+}
@@ -0,0 +1,40 @@
+package impl
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tao/faststore/api"
+)
+
+type tsdbStats struct {
+	syncCount   int64
+	syncNanos   int64
+	cacheHits   int64
+	cacheMisses int64
+}
+
+var gStats tsdbStats
+
+func (st *tsdbStats) addSync(cost time.Duration) {
+	atomic.AddInt64(&st.syncCount, 1)
+	atomic.AddInt64(&st.syncNanos, int64(cost))
+}
+
+func (st *tsdbStats) addCache(hit bool) {
+	if hit {
+		atomic.AddInt64(&st.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&st.cacheMisses, 1)
+	}
+}
+
+func GetStats() api.FstStats {
+	return api.FstStats{
+		SyncCount:   atomic.LoadInt64(&gStats.syncCount),
+		SyncNanos:   atomic.LoadInt64(&gStats.syncNanos),
+		CacheHits:   atomic.LoadInt64(&gStats.cacheHits),
+		CacheMisses: atomic.LoadInt64(&gStats.cacheMisses),
+		CacheBytes:  gBlockCache.bytes(),
+	}
+}
@@ -0,0 +1,214 @@
+package impl
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+var (
+	gDur_None     = 0
+	gDur_Block    = 1
+	gDur_Interval = 2
+	gDur_Append   = 3
+	gDEF_SYNC_MS  = 1000
+)
+
+type durability struct {
+	level    int
+	interval time.Duration
+}
+
+type tsdbSyncer struct {
+	lock  sync.Mutex
+	dirty map[string]time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+var gSyncer *tsdbSyncer
+
+func parseDurability(mode string, ms int) (durability, error) {
+	if ms <= 0 {
+		ms = gDEF_SYNC_MS
+	}
+	d := durability{interval: time.Duration(ms) * time.Millisecond}
+	switch mode {
+	case "", api.DURABILITY_NONE:
+		d.level = gDur_None
+	case api.DURABILITY_BLOCK:
+		d.level = gDur_Block
+	case api.DURABILITY_INTERVAL:
+		d.level = gDur_Interval
+	case api.DURABILITY_APPEND:
+		d.level = gDur_Append
+	default:
+		return d, fmt.Errorf("unknown durability:%s", mode)
+	}
+	return d, nil
+}
+
+// getDurability table级别的配置优先
+func getDurability(table string) durability {
+	if gConf == nil {
+		return durability{}
+	}
+	mode, ms := gConf.Durability, gConf.SyncMs
+	if tc, ok := gConf.Tables[table]; ok && tc.Durability != "" {
+		mode, ms = tc.Durability, tc.SyncMs
+	}
+	d, _ := parseDurability(mode, ms)
+	return d
+}
+
+// durableSync 按表的持久化策略处理一次写入, event是gDur_Block(block落盘)或gDur_Append(一次追加)
+func durableSync(f *os.File, table, name string, event int) error {
+	d := getDurability(table)
+	if d.level == gDur_Interval {
+		markDirty(name, d.interval)
+		return nil
+	}
+	if (d.level == gDur_Append) || (d.level == gDur_Block && event == gDur_Block) {
+		return timedSync(f.Sync)
+	}
+	return nil
+}
+
+func timedSync(call func() error) error {
+	start := time.Now()
+	err := call()
+	gStats.addSync(time.Since(start))
+	if err != nil {
+		common.Logger.Warnf("sync failed:%s", err)
+	}
+	return err
+}
+
+func syncFileByName(name string) error {
+	f, err := os.OpenFile(name, os.O_RDONLY, 0755)
+	if err != nil {
+		return err
+	}
+	err = timedSync(f.Sync)
+	f.Close()
+	return err
+}
+
+func startSyncer(c *api.TsdbConf) error {
+	global, err := parseDurability(c.Durability, c.SyncMs)
+	if err != nil {
+		return err
+	}
+	tick := time.Duration(0)
+	if global.level == gDur_Interval {
+		tick = global.interval
+	}
+	// strict 有表要求block/append落盘
+	strict := (global.level == gDur_Block) || (global.level == gDur_Append)
+	for table, tc := range c.Tables {
+		d, err := parseDurability(tc.Durability, tc.SyncMs)
+		if err != nil {
+			return fmt.Errorf("table %s:%w", table, err)
+		}
+		if tc.Durability == "" {
+			d = global
+		}
+		if d.level == gDur_Interval && (tick == 0 || d.interval < tick) {
+			tick = d.interval
+		}
+		if d.level == gDur_Block || d.level == gDur_Append {
+			strict = true
+		}
+	}
+	// bolt里的topRef和分配记录是所有表共用的, 默认每次提交都fsync; 只有明确配置了none/interval
+	// 并且所有表都不要求block/append落盘时才关掉, interval时随tick刷
+	blotDb.NoSync = (c.Durability != "") && !strict
+	if tick == 0 {
+		return nil
+	}
+	gSyncer = &tsdbSyncer{dirty: make(map[string]time.Time), stop: make(chan struct{}), done: make(chan struct{})}
+	go gSyncer.run(tick, blotDb.NoSync)
+	common.Logger.Infof("syncer started, tick=%s", tick)
+	return nil
+}
+
+func stopSyncer() {
+	if gSyncer == nil {
+		return
+	}
+	close(gSyncer.stop)
+	<-gSyncer.done
+	gSyncer.syncDue(time.Time{})
+	gSyncer = nil
+}
+
+func markDirty(name string, interval time.Duration) {
+	s := gSyncer
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if _, ok := s.dirty[name]; !ok {
+		s.dirty[name] = time.Now().Add(interval)
+	}
+	s.lock.Unlock()
+}
+
+func (s *tsdbSyncer) run(tick time.Duration, withBolt bool) {
+	ticker := time.NewTicker(tick)
+	defer func() {
+		ticker.Stop()
+		close(s.done)
+	}()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.syncDue(now)
+			if withBolt {
+				_ = timedSync(blotDb.Sync)
+			}
+		}
+	}
+}
+
+// syncDue now为零值时全部刷盘, 返回第一个刷盘错误
+func (s *tsdbSyncer) syncDue(now time.Time) error {
+	s.lock.Lock()
+	names := make([]string, 0, len(s.dirty))
+	for name, due := range s.dirty {
+		if now.IsZero() || !due.After(now) {
+			names = append(names, name)
+			delete(s.dirty, name)
+		}
+	}
+	s.lock.Unlock()
+	var first error
+	for _, name := range names {
+		if err := syncFileByName(name); err != nil {
+			common.Logger.Warnf("sync file=%s failed:%s", name, err)
+			if first == nil && !os.IsNotExist(err) {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// syncAll interval策略下还没刷的文件和bolt立即刷盘, 删除wal之前调用
+func syncAll() error {
+	if s := gSyncer; s != nil {
+		if err := s.syncDue(time.Time{}); err != nil {
+			return err
+		}
+	}
+	if blotDb != nil && blotDb.NoSync {
+		return timedSync(blotDb.Sync)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package impl
+
+import (
+	"testing"
+
+	"github.com/tao/faststore/api"
+)
+
+func TestBoltSyncDefault(t *testing.T) {
+	cases := []struct {
+		c      api.TsdbConf
+		noSync bool
+	}{
+		{api.TsdbConf{}, false},
+		{api.TsdbConf{Durability: api.DURABILITY_NONE}, true},
+		{api.TsdbConf{Durability: api.DURABILITY_INTERVAL}, true},
+		{api.TsdbConf{Durability: api.DURABILITY_NONE, Tables: map[string]api.TableConf{"t": {Durability: api.DURABILITY_BLOCK}}}, false},
+		{api.TsdbConf{Tables: map[string]api.TableConf{"t": {Durability: api.DURABILITY_NONE}}}, false},
+	}
+	for i, cs := range cases {
+		startTestDb(t, &cs.c)
+		if blotDb.NoSync != cs.noSync {
+			t.Fatal(i, blotDb.NoSync)
+		}
+		StopDb()
+	}
+}
@@ -0,0 +1,247 @@
+package impl
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+// tsdbWal 每个table一个, 同一table的所有写句柄共用.
+// 写入超过gWAL_CKPT_BYTES后在后台checkpoint: 换到新的wal文件, 把table所有写句柄的数据
+// 落盘并刷盘之后, 删掉换下来的文件
+type tsdbWal struct {
+	table string
+	lg    *fstLoggerImpl
+	refs  int
+	dirty bool
+	bytes int64
+	ckpt  bool
+}
+
+var gWAL_CKPT_BYTES = int64(64 << 20)
+
+var gWalLock sync.Mutex
+var gWals = make(map[string]*tsdbWal)
+var gWalCkpts sync.WaitGroup
+
+func newWalLogger(dir, table string) *fstLoggerImpl {
+	return &fstLoggerImpl{dir: dir, table: table, sub: gWal_Dir}
+}
+
+func walOpen(dir, table string) *tsdbWal {
+	gWalLock.Lock()
+	defer gWalLock.Unlock()
+	w, ok := gWals[table]
+	if !ok {
+		w = &tsdbWal{table: table, lg: newWalLogger(dir, table)}
+		gWals[table] = w
+	}
+	w.refs++
+	return w
+}
+
+// log 先写wal再写数据, 返回前已经write到文件
+func (w *tsdbWal) log(symbol string, values []api.FstTsdbValue) error {
+	gWalLock.Lock()
+	defer gWalLock.Unlock()
+	for i := range values {
+		if err := w.lg.append(symbol, &values[i]); err != nil {
+			common.Logger.Warnf("wal table=%s, symbol=%s append failed:%s", w.table, symbol, err)
+			return err
+		}
+		w.bytes += int64(len(symbol) + len(values[i].Data))
+	}
+	if err := w.lg.flush(); err != nil {
+		return err
+	}
+	if w.bytes >= gWAL_CKPT_BYTES && !w.ckpt {
+		// 调用者持有自己series的锁, checkpoint要锁所有series, 放到后台
+		w.ckpt = true
+		w.bytes = 0
+		gWalCkpts.Add(1)
+		go w.checkpoint()
+	}
+	return w.lg.sync(gDur_Append)
+}
+
+func (w *tsdbWal) checkpoint() {
+	defer gWalCkpts.Done()
+	gWalLock.Lock()
+	if gWals[w.table] != w {
+		w.ckpt = false
+		gWalLock.Unlock()
+		return
+	}
+	number, err := w.lg.roll()
+	gWalLock.Unlock()
+	if err == nil {
+		// 换文件之前写进wal的数据, 拿到series的锁时都已经交给了写句柄
+		err = flushWriters(w.lg.dir, w.table)
+	}
+	if err == nil {
+		err = syncAll()
+	}
+	gWalLock.Lock()
+	defer gWalLock.Unlock()
+	w.ckpt = false
+	if err != nil {
+		common.Logger.Warnf("wal table=%s checkpoint failed:%s", w.table, err)
+		return
+	}
+	// 期间最后一个句柄关闭了, wal已经由release处理
+	if gWals[w.table] != w {
+		return
+	}
+	if err = w.lg.removeTo(number); err != nil {
+		common.Logger.Warnf("wal table=%s remove to %d failed:%s", w.table, number, err)
+		return
+	}
+	common.Logger.Infof("wal table=%s checkpoint to %d", w.table, number)
+}
+
+// release 最后一个句柄关闭时, 如果所有数据都已落盘就删除wal
+func (w *tsdbWal) release(clean bool) {
+	gWalLock.Lock()
+	defer gWalLock.Unlock()
+	w.refs--
+	if !clean {
+		w.dirty = true
+	}
+	if w.refs > 0 {
+		return
+	}
+	w.lg.Close()
+	delete(gWals, w.table)
+	if !w.dirty {
+		// interval策略下数据可能还没刷盘
+		if err := syncAll(); err != nil {
+			common.Logger.Warnf("wal table=%s sync failed:%s", w.table, err)
+			w.dirty = true
+		}
+	}
+	if w.dirty {
+		common.Logger.Warnf("wal table=%s is kept for replay", w.table)
+		return
+	}
+	if err := os.RemoveAll(w.lg.logDir()); err != nil {
+		common.Logger.Warnf("remove wal table=%s failed:%s", w.table, err)
+	}
+}
+
+// flushWriters 依次持有table里每个symbol的series写锁, 把共用写句柄的数据落盘
+func flushWriters(dir, table string) error {
+	gWriterLock.Lock()
+	series := make([]*tsdbSeries, 0, len(gWriters[table]))
+	for ta := range gWriters[table] {
+		if s := ta.impl.series; s != nil && ta.impl.dataDir == dir {
+			series = append(series, s)
+		}
+	}
+	gWriterLock.Unlock()
+	for _, s := range series {
+		s.lock.Lock()
+		var err error
+		if w := s.writer; w != nil && w.appender != nil {
+			err = w.appender.close()
+		}
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closeWals() {
+	gWalCkpts.Wait()
+	gWalLock.Lock()
+	defer gWalLock.Unlock()
+	for table, w := range gWals {
+		w.lg.Close()
+		delete(gWals, table)
+	}
+}
+
+func (tsdb *fstTsdbImpl) logWal(values []api.FstTsdbValue) error {
+	if tsdb.noWal {
+		return nil
+	}
+	if tsdb.wal == nil {
+		tsdb.wal = walOpen(tsdb.dataDir, tsdb.table)
+	}
+	return tsdb.wal.log(tsdb.symbol, values)
+}
+
+// replayWal 启动时重放上次没有正常关闭的写入, 已经落盘的数据会被当作重复跳过
+func replayWal(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		table := e.Name()
+		lg := newWalLogger(dir, table)
+		if _, err := os.Stat(lg.logDir()); err != nil {
+			continue
+		}
+		common.Logger.Infof("replay wal table=%s", table)
+		tsdbs := make(map[string]*fstTsdbImpl)
+		var callErr error
+		number := 0
+		err = lg.ForEach(func(key string, value *api.FstTsdbValue) error {
+			db, ok := tsdbs[key]
+			if !ok {
+				db = NewTsdb(dir, table, key)
+				db.noWal = true
+				// K线和rollup重算写的覆盖数据
+				db.rewrite = strings.ContainsAny(key, "@#")
+				tsdbs[key] = db
+			}
+			err := db.Append(value)
+			if errors.Is(err, api.ErrOutOfOrder) || errors.Is(err, api.ErrDuplicateTimestamp) {
+				return nil
+			}
+			if err != nil {
+				callErr = err
+				return err
+			}
+			number++
+			return nil
+		})
+		var corrupt *api.CorruptError
+		if err != nil && callErr == nil && !errors.Is(err, api.ErrEmpty) {
+			if !errors.As(err, &corrupt) || !corrupt.Tail {
+				// 后面还有确认过的数据, 保留wal
+				common.Logger.Warnf("replay wal table=%s failed:%s", table, err)
+				callErr = err
+			} else {
+				// 最后一帧可能只写了一半
+				common.Logger.Warnf("replay wal table=%s stop at:%s", table, err)
+			}
+		}
+		for _, db := range tsdbs {
+			if err := db.release(); err != nil && callErr == nil {
+				callErr = err
+			}
+		}
+		common.Logger.Infof("replay wal table=%s, symbols=%d, values=%d", table, len(tsdbs), number)
+		if callErr != nil {
+			return callErr
+		}
+		// 重放写进去的数据刷盘之后才能删wal
+		if err = syncAll(); err != nil {
+			return err
+		}
+		if err = os.RemoveAll(lg.logDir()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/tao/faststore/api"
+	"github.com/tao/faststore/common"
+)
+
+func startTestDb(t *testing.T, c *api.TsdbConf) string {
+	t.Helper()
+	if c.DataDir == "" {
+		c.DataDir = t.TempDir()
+	}
+	c.Level, c.File, c.MaxSize = "warn", c.DataDir+"/log", 50
+	common.InitLogger(c)
+	if err := StartDb(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(StopDb)
+	return c.DataDir
+}
+
+// crashDb 不关闭句柄直接停掉, 相当于进程被杀
+func crashDb(t *testing.T) {
+	t.Helper()
+	c := gConf
+	StopDb()
+	if err := StartDb(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testValue(ts int64) []byte {
+	return []byte(fmt.Sprint("v", ts))
+}
+
+// checkValues 所有数据都在并且按顺序
+func checkValues(t *testing.T, dir, table, symbol string, n int64) {
+	t.Helper()
+	db := NewTsdb(dir, table, symbol)
+	defer db.Close()
+	it := db.Range(math.MinInt64, math.MaxInt64)
+	defer it.Close()
+	ts := int64(1)
+	for it.Next() {
+		v := it.Value()
+		if v.Timestamp != ts || string(v.Data) != string(testValue(ts)) {
+			t.Fatalf("ts=%d, want %d", v.Timestamp, ts)
+		}
+		ts++
+	}
+	if it.Err() != nil || ts-1 != n {
+		t.Fatal(it.Err(), ts-1, n)
+	}
+}
+
+func appendValues(t *testing.T, db *fstTsdbImpl, from, to int64) {
+	t.Helper()
+	for ts := from; ts <= to; ts++ {
+		if err := db.Append(&api.FstTsdbValue{Timestamp: ts, Data: testValue(ts)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func walFile(dir, table string, n int) string {
+	return fmt.Sprintf("%s/%s/%s/%s-%04d.log", dir, table, gWal_Dir, table, n)
+}
+
+func TestWalReplay(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 5000)
+	crashDb(t)
+	if _, err := os.Stat(walFile(dir, "t", 1)); err == nil {
+		t.Fatal("wal is not removed after replay")
+	}
+	checkValues(t, dir, "t", "s", 5000)
+}
+
+func TestWalTornTail(t *testing.T) {
+	dir := startTestDb(t, &api.TsdbConf{})
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 3000)
+	closeWals()
+	// 最后一帧只写了帧头和一部分数据
+	f, err := os.OpenFile(walFile(dir, "t", 1), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := make([]byte, gLOG_H_LEN+10)
+	putIntToB(torn, 100)
+	f.Write(torn)
+	f.Close()
+	crashDb(t)
+	checkValues(t, dir, "t", "s", 3000)
+}
+
+func TestWalCorrupt(t *testing.T) {
+	c := &api.TsdbConf{}
+	dir := startTestDb(t, c)
+	db := NewTsdb(dir, "t", "s")
+	appendValues(t, db, 1, 3000)
+	closeWals()
+	StopDb()
+	// 中间一帧的数据坏了, 后面还有确认过的帧
+	name := walFile(dir, "t", 1)
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)/2] ^= 0xff
+	if err = os.WriteFile(name, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = StartDb(c)
+	if !errors.Is(err, api.ErrCorrupt) {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(name); err != nil {
+		t.Fatal("wal is removed", err)
+	}
+}
+
+func TestWalCheckpoint(t *testing.T) {
+	old := gWAL_CKPT_BYTES
+	gWAL_CKPT_BYTES = 16 << 10
+	defer func() { gWAL_CKPT_BYTES = old }()
+	dir := startTestDb(t, &api.TsdbConf{Durability: api.DURABILITY_INTERVAL})
+	db := NewTsdb(dir, "t", "s")
+	other := NewTsdb(dir, "t", "x")
+	for ts := int64(1); ts <= 20000; ts++ {
+		appendValues(t, db, ts, ts)
+		appendValues(t, other, ts, ts)
+		if ts%2000 == 0 {
+			gWalCkpts.Wait()
+		}
+	}
+	gWalCkpts.Wait()
+	head, tail, err := findLogFiles(dir+"/t/"+gWal_Dir, "t")
+	if err != nil || head <= 1 || tail-head > 1 {
+		t.Fatal("wal is not truncated", head, tail, err)
+	}
+	crashDb(t)
+	checkValues(t, dir, "t", "s", 20000)
+	checkValues(t, dir, "t", "x", 20000)
+}